@@ -5,11 +5,41 @@ package main
 */
 import "C"
 import (
+	"bytes"
+	"strings"
+	"sync"
 	"unsafe"
 
 	"github.com/tartancz/golangMyPackages/pkg/portrelay"
 )
 
+var (
+	protocolMu sync.RWMutex
+	protocol   portrelay.MessageProtocol = portrelay.NewBinaryMessageProtocol()
+)
+
+func currentProtocol() portrelay.MessageProtocol {
+	protocolMu.RLock()
+	defer protocolMu.RUnlock()
+	return protocol
+}
+
+// SetProtocol selects the registered codec used by EncodeMessage and
+// DecodeMessage. It returns NULL on success and an error string otherwise.
+//
+//export SetProtocol
+func SetProtocol(name *C.char) *C.char {
+	p, err := portrelay.NewProtocol(C.GoString(name))
+	if err != nil {
+		return C.CString("ERROR:" + err.Error())
+	}
+
+	protocolMu.Lock()
+	defer protocolMu.Unlock()
+	protocol = p
+	return nil
+}
+
 
 //export EncodeMessage
 func EncodeMessage(command *C.char, argc C.int, argv **C.char) *C.char {
@@ -24,28 +54,78 @@ func EncodeMessage(command *C.char, argc C.int, argv **C.char) *C.char {
 		Arguments: args,
 	}
 
-	proto := portrelay.NewBinaryMessageProtocol()
-	encoded := proto.Encode(msg)
+	encoded, err := portrelay.AppendEncode(currentProtocol(), nil, msg)
+	if err != nil {
+		return C.CString("ERROR:" + err.Error())
+	}
 	return C.CString(string(encoded))
 }
 
+// DecodeMessage decodes a NUL-terminated frame and returns the message in
+// the format of the "json" codec, like DecodeMessageBytes.
+//
 //export DecodeMessage
 func DecodeMessage(data *C.char) *C.char {
 	s := C.GoString(data)
-	proto := portrelay.NewBinaryMessageProtocol()
-	msg, err := proto.DecodeString(s)
+	msg, err := currentProtocol().Decode(strings.NewReader(s))
 	if err != nil {
 		return C.CString("ERROR:" + err.Error())
 	}
 
-	// For simplicity return JSON
-	json := `{"command":"` + msg.Command + `","args":[`
-	for i, a := range msg.Arguments {
-		if i > 0 {
-			json += ","
+	return jsonMessage(msg)
+}
+
+// EncodeMessageBytes is EncodeMessage for arguments that may contain NUL
+// bytes: argument i is argl[i] bytes long. The frame is returned in a
+// malloc'd buffer of *outLen bytes that the caller must free. On error an
+// "ERROR:" string is returned and *outLen is -1.
+//
+//export EncodeMessageBytes
+func EncodeMessageBytes(command *C.char, argc C.int, argv **C.char, argl *C.int, outLen *C.int) unsafe.Pointer {
+	msg := portrelay.Message{
+		Command:   C.GoString(command),
+		Arguments: make([]string, int(argc)),
+	}
+	if argc > 0 {
+		argSlice := unsafe.Slice(argv, int(argc))
+		lenSlice := unsafe.Slice(argl, int(argc))
+		for i := range argSlice {
+			msg.Arguments[i] = C.GoStringN(argSlice[i], lenSlice[i])
 		}
-		json += `"` + a + `"`
 	}
-	json += "]}"
-	return C.CString(json)
+
+	encoded, err := portrelay.AppendEncode(currentProtocol(), nil, msg)
+	if err != nil {
+		*outLen = -1
+		return unsafe.Pointer(C.CString("ERROR:" + err.Error()))
+	}
+	*outLen = C.int(len(encoded))
+	return C.CBytes(encoded)
+}
+
+// DecodeMessageBytes decodes a frame of length bytes that may contain NUL
+// bytes. The message is returned in the format of the "json" codec, where
+// binary arguments are base64 encoded in "args_base64".
+//
+//export DecodeMessageBytes
+func DecodeMessageBytes(data unsafe.Pointer, length C.int) *C.char {
+	frame := C.GoBytes(data, length)
+	msg, err := currentProtocol().Decode(bytes.NewReader(frame))
+	if err != nil {
+		return C.CString("ERROR:" + err.Error())
+	}
+
+	return jsonMessage(msg)
+}
+
+// jsonMessage returns msg in the format of the "json" codec, which base64
+// encodes binary arguments instead of mangling them. Typed values are
+// returned in their text form.
+func jsonMessage(msg *portrelay.Message) *C.char {
+	msg.Values = nil
+	out, err := portrelay.NewJSONLinesProtocol().AppendEncode(nil, *msg)
+	if err != nil {
+		return C.CString("ERROR:" + err.Error())
+	}
+	return C.CString(strings.TrimSuffix(string(out), "\n"))
 }
@@ -0,0 +1,134 @@
+package main
+
+import (
+	"bufio"
+	"errors"
+	"io"
+
+	"github.com/tartancz/golangMyPackages/pkg/portrelay"
+)
+
+func encode(args []string, stdin io.Reader, stdout, stderr io.Writer) error {
+	var opts options
+	fs := newFlagSet("encode", stderr, &opts, "binary")
+	messageFlags(fs, &opts)
+	fs.Usage = func() {
+		io.WriteString(fs.Output(), "usage: portrelay encode [flags] [command [arguments...]]\n\n"+
+			"Without a command, json lines are read from stdin.\n\n")
+		fs.PrintDefaults()
+	}
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	p, err := opts.newProtocol()
+	if err != nil {
+		return err
+	}
+
+	write := func(msg portrelay.Message) error {
+		frame, err := portrelay.AppendEncode(p, nil, msg)
+		if err != nil {
+			return err
+		}
+		opts.printFrame(stderr, ">", frame)
+		_, err = stdout.Write(frame)
+		return err
+	}
+
+	if fs.NArg() > 0 {
+		return write(opts.message(fs.Args()))
+	}
+	dec := portrelay.NewProtocolDecoder(human, stdin)
+	for {
+		msg, err := dec.Next()
+		if errors.Is(err, io.EOF) {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		if err := write(*msg); err != nil {
+			return err
+		}
+	}
+}
+
+func decode(args []string, stdin io.Reader, stdout, stderr io.Writer) error {
+	var opts options
+	fs := newFlagSet("decode", stderr, &opts, "auto")
+	fs.Usage = func() {
+		io.WriteString(fs.Output(), "usage: portrelay decode [flags] < frames\n\n"+
+			"With -p auto the protocol is detected from the first frame, and binary\n"+
+			"frames may be mixed with compressed ones.\n\n")
+		fs.PrintDefaults()
+	}
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+
+	in := &recorder{r: stdin}
+	buf := bufio.NewReader(in)
+	var p portrelay.MessageProtocol
+	var err error
+	if opts.protocol == "auto" {
+		p, err = portrelay.DetectProtocol(peekLine(buf))
+		// Compressed frames may follow plain ones, as peers that negotiated
+		// compression send small frames uncompressed.
+		if bp, ok := p.(*portrelay.BinaryMessageProtocol); ok {
+			p = portrelay.NewCompressedProtocol(bp, 0)
+		}
+	} else {
+		p, err = opts.newProtocol()
+	}
+	if err != nil {
+		return err
+	}
+
+	dec := portrelay.NewProtocolDecoder(p, buf)
+	for {
+		msg, err := dec.Next()
+		if errors.Is(err, io.EOF) && len(in.consumed(dec.Buffered())) == 0 {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		opts.printFrame(stderr, "<", in.consumed(dec.Buffered()))
+		in.discard(dec.Buffered())
+		printMessage(stdout, *msg)
+	}
+}
+
+// peekLine returns the first line in buf without consuming it, or as much of
+// it as fits in the buffer.
+func peekLine(buf *bufio.Reader) []byte {
+	for n := 1; ; n++ {
+		b, err := buf.Peek(n)
+		if err != nil || b[n-1] == '\n' {
+			return b
+		}
+	}
+}
+
+// recorder keeps what was read from r until it is discarded, so that the
+// bytes of each decoded frame can be shown.
+type recorder struct {
+	r    io.Reader
+	data []byte
+}
+
+func (r *recorder) Read(p []byte) (int, error) {
+	n, err := r.r.Read(p)
+	r.data = append(r.data, p[:n]...)
+	return n, err
+}
+
+// consumed returns the recorded bytes that were decoded, given how many are
+// still buffered.
+func (r *recorder) consumed(buffered int) []byte {
+	return r.data[:len(r.data)-buffered]
+}
+
+func (r *recorder) discard(buffered int) {
+	r.data = append(r.data[:0], r.data[len(r.data)-buffered:]...)
+}
@@ -0,0 +1,144 @@
+// Command portrelay encodes, decodes and exchanges portrelay messages, for
+// debugging a link without writing Go code.
+//
+// Messages are shown in the json protocol, one per line, which is also what
+// encode reads when no message is given on its command line.
+package main
+
+import (
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+
+	"github.com/tartancz/golangMyPackages/pkg/portrelay"
+)
+
+const usage = `usage: portrelay <command> [flags] [arguments]
+
+commands:
+  encode     write a message, or json lines from stdin, in the wire format
+  decode     print the wire format messages on stdin as json lines
+  send       connect to an endpoint, send a message and print the replies
+  listen     run a test endpoint that prints and echoes what it receives
+  protocols  list the protocols that can be used with -p
+
+Run portrelay <command> -h for the flags of a command.
+`
+
+func main() {
+	os.Exit(run(os.Args[1:], os.Stdin, os.Stdout, os.Stderr))
+}
+
+// run runs the command in args and returns the exit code.
+func run(args []string, stdin io.Reader, stdout, stderr io.Writer) int {
+	if len(args) == 0 {
+		fmt.Fprint(stderr, usage)
+		return 2
+	}
+
+	commands := map[string]func(args []string, stdin io.Reader, stdout, stderr io.Writer) error{
+		"encode":    encode,
+		"decode":    decode,
+		"send":      send,
+		"listen":    listen,
+		"protocols": protocols,
+	}
+	command, ok := commands[args[0]]
+	if !ok {
+		fmt.Fprintf(stderr, "portrelay: unknown command %q\n\n%s", args[0], usage)
+		return 2
+	}
+
+	err := command(args[1:], stdin, stdout, stderr)
+	if err == flag.ErrHelp {
+		return 0
+	}
+	if err != nil {
+		fmt.Fprintf(stderr, "portrelay %s: %v\n", args[0], err)
+		return 1
+	}
+	return 0
+}
+
+func protocols(args []string, stdin io.Reader, stdout, stderr io.Writer) error {
+	for _, name := range portrelay.Codecs() {
+		fmt.Fprintln(stdout, name)
+	}
+	return nil
+}
+
+// options are the flags shared by the commands.
+type options struct {
+	protocol string
+	verbose  bool
+
+	id      uint64
+	replyTo uint64
+	headers headerFlag
+}
+
+func newFlagSet(name string, stderr io.Writer, opts *options, protocol string) *flag.FlagSet {
+	fs := flag.NewFlagSet(name, flag.ContinueOnError)
+	fs.SetOutput(stderr)
+	fs.StringVar(&opts.protocol, "p", protocol, "protocol, one of "+strings.Join(portrelay.Codecs(), ", "))
+	fs.BoolVar(&opts.verbose, "v", false, "show raw frames on stderr")
+	return fs
+}
+
+// messageFlags adds the flags that fill in a message given on the command line.
+func messageFlags(fs *flag.FlagSet, opts *options) {
+	fs.Uint64Var(&opts.id, "id", 0, "message ID")
+	fs.Uint64Var(&opts.replyTo, "reply-to", 0, "ID of the message this one replies to")
+	fs.Var(&opts.headers, "H", "header as name=value; may be repeated")
+}
+
+// message builds the message given by args, a command and its arguments.
+func (o *options) message(args []string) portrelay.Message {
+	msg := portrelay.Message{Command: args[0], Arguments: args[1:], ID: o.id, ReplyTo: o.replyTo}
+	for _, h := range o.headers {
+		msg.SetHeader(h[0], h[1])
+	}
+	return msg
+}
+
+func (o *options) newProtocol() (portrelay.MessageProtocol, error) {
+	return portrelay.NewProtocol(o.protocol)
+}
+
+type headerFlag [][2]string
+
+func (h *headerFlag) String() string {
+	return fmt.Sprint(*h)
+}
+
+func (h *headerFlag) Set(s string) error {
+	name, value, ok := strings.Cut(s, "=")
+	if !ok || name == "" {
+		return fmt.Errorf("header %q is not name=value", s)
+	}
+	*h = append(*h, [2]string{name, value})
+	return nil
+}
+
+var human = portrelay.NewJSONLinesProtocol()
+
+// printMessage writes msg to w as a json line. Typed values are shown by
+// their text, which is what Arguments hold.
+func printMessage(w io.Writer, msg portrelay.Message) {
+	msg.Values = nil
+	line, err := human.AppendEncode(nil, msg)
+	if err != nil {
+		fmt.Fprintf(w, "%+v\n", msg)
+		return
+	}
+	w.Write(line)
+}
+
+// printFrame shows a raw frame on w when verbose output is on.
+func (o *options) printFrame(w io.Writer, direction string, frame []byte) {
+	if o.verbose {
+		fmt.Fprintf(w, "%s %q\n", direction, frame)
+	}
+}
@@ -0,0 +1,114 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"net"
+	"strings"
+	"testing"
+
+	"github.com/tartancz/golangMyPackages/pkg/portrelay"
+)
+
+func runCommand(t *testing.T, stdin string, args ...string) (stdout, stderr string) {
+	t.Helper()
+	var out, errOut bytes.Buffer
+	if code := run(args, strings.NewReader(stdin), &out, &errOut); code != 0 {
+		t.Fatalf("portrelay %s: exit code %d, stderr: %s", strings.Join(args, " "), code, errOut.String())
+	}
+	return out.String(), errOut.String()
+}
+
+func TestEncode(t *testing.T) {
+	out, _ := runCommand(t, "", "encode", "-id", "7", "-H", "trace-id=abc", "set", "key", "a b")
+	want := "@7\n|1\n$8\ntrace-id\n$3\nabc\n*3\n$3\nset\n$3\nkey\n$3\na b\n"
+	if out != want {
+		t.Errorf("encode wrote %q, want %q", out, want)
+	}
+
+	out, _ = runCommand(t, "", "encode", "-p", "resp", "PING")
+	if want := "*1\r\n$4\r\nPING\r\n"; out != want {
+		t.Errorf("encode -p resp wrote %q, want %q", out, want)
+	}
+}
+
+func TestEncodeDecode(t *testing.T) {
+	lines := `{"command":"set","args":["key","value"],"id":1}` + "\n" +
+		`{"command":"bin","args_base64":["/w=="]}` + "\n" +
+		`{"command":"ping","headers":{"trace-id":"abc"}}` + "\n"
+
+	for _, protocol := range []string{"binary", "json", "binary+deflate"} {
+		frames, _ := runCommand(t, lines, "encode", "-p", protocol)
+		// The protocol is detected from the frames.
+		out, _ := runCommand(t, frames, "decode")
+		if out != lines {
+			t.Errorf("%s: decode printed %q, want %q", protocol, out, lines)
+		}
+	}
+}
+
+func TestDecode_MixedCompression(t *testing.T) {
+	msg := portrelay.Message{Command: "set", Arguments: []string{strings.Repeat("a", 100)}}
+	compressed := portrelay.NewCompressedProtocol(portrelay.NewBinaryMessageProtocol(), 1).Encode(msg)
+	if compressed[0] != '~' {
+		t.Fatalf("frame %q is not compressed", compressed)
+	}
+	frames := "*1\n$4\nping\n" + string(compressed) + "*1\n$4\npong\n"
+
+	out, _ := runCommand(t, frames, "decode")
+	want := `{"command":"ping"}` + "\n" + `{"command":"set","args":["` + msg.Arguments[0] + `"]}` + "\n" + `{"command":"pong"}` + "\n"
+	if out != want {
+		t.Errorf("decode printed %q, want %q", out, want)
+	}
+}
+
+func TestDecode_Verbose(t *testing.T) {
+	frames := "*1\n$1\na\n*1\n$1\nb\n"
+	out, raw := runCommand(t, frames, "decode", "-v", "-p", "binary")
+	if want := `{"command":"a"}` + "\n" + `{"command":"b"}` + "\n"; out != want {
+		t.Errorf("decode printed %q, want %q", out, want)
+	}
+	if want := `< "*1\n$1\na\n"` + "\n" + `< "*1\n$1\nb\n"` + "\n"; raw != want {
+		t.Errorf("decode -v showed %q, want %q", raw, want)
+	}
+}
+
+func TestDecode_Truncated(t *testing.T) {
+	var out, errOut bytes.Buffer
+	if code := run([]string{"decode", "-p", "binary"}, strings.NewReader("*2\n$1\na\n"), &out, &errOut); code != 1 {
+		t.Errorf("decode of a truncated frame: exit code %d, want 1", code)
+	}
+}
+
+func TestSendListen(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	ready := make(chan net.Addr, 1)
+	done := make(chan error, 1)
+	var listenOut bytes.Buffer
+	go func() {
+		done <- listenContext(ctx, []string{"-addr", "127.0.0.1:0"}, &syncWriter{w: &listenOut}, &bytes.Buffer{}, ready)
+	}()
+	addr := (<-ready).String()
+
+	for _, protocol := range []string{"binary", "json"} {
+		out, _ := runCommand(t, "", "send", "-addr", addr, "-p", protocol, "-call", "-wait", "5s", "echo", "hi")
+		if want := `{"command":"echo","args":["hi"],"reply_to":1}` + "\n"; out != want {
+			t.Errorf("%s: send printed %q, want %q", protocol, out, want)
+		}
+	}
+
+	cancel()
+	if err := <-done; err != nil {
+		t.Errorf("listen: unexpected error: %v", err)
+	}
+	if got := strings.Count(listenOut.String(), `"command":"echo"`); got != 2 {
+		t.Errorf("listen printed %q, want both messages", listenOut.String())
+	}
+}
+
+func TestUnknownCommand(t *testing.T) {
+	var out, errOut bytes.Buffer
+	if code := run([]string{"frobnicate"}, nil, &out, &errOut); code != 2 {
+		t.Errorf("exit code %d, want 2", code)
+	}
+}
@@ -0,0 +1,209 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"os/signal"
+	"sync"
+	"time"
+
+	"github.com/tartancz/golangMyPackages/pkg/portrelay"
+)
+
+func send(args []string, stdin io.Reader, stdout, stderr io.Writer) error {
+	var opts options
+	fs := newFlagSet("send", stderr, &opts, "binary")
+	messageFlags(fs, &opts)
+	addr := fs.String("addr", "localhost:8080", "address of the endpoint")
+	call := fs.Bool("call", false, "wait for the reply to the message and exit")
+	wait := fs.Duration("wait", time.Second, "how long to print replies for, or to wait for the reply with -call")
+	handshake := fs.Bool("handshake", false, "start with a handshake")
+	fs.Usage = func() {
+		io.WriteString(fs.Output(), "usage: portrelay send [flags] command [arguments...]\n\n")
+		fs.PrintDefaults()
+	}
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	if fs.NArg() == 0 {
+		fs.Usage()
+		return errors.New("no command given")
+	}
+	p, err := opts.newProtocol()
+	if err != nil {
+		return err
+	}
+	host, port, err := net.SplitHostPort(*addr)
+	if err != nil {
+		return err
+	}
+
+	out := &syncWriter{w: stdout}
+	client := portrelay.NewClient(p)
+	client.Handshake = *handshake
+	client.OnUnhandled = func(msg portrelay.Message, _ io.Writer) {
+		printMessage(out, msg)
+	}
+	client.SetDialer(func(ctx context.Context, network, address string) (net.Conn, error) {
+		conn, err := (&net.Dialer{Timeout: *wait}).DialContext(ctx, network, address)
+		if err != nil || !opts.verbose {
+			return conn, err
+		}
+		return &verboseConn{Conn: conn, opts: &opts, w: stderr}, nil
+	})
+	if err := client.Start(context.Background(), host, port); err != nil {
+		return err
+	}
+	defer client.Close()
+
+	msg := opts.message(fs.Args())
+	if *call {
+		ctx, cancel := context.WithTimeout(context.Background(), *wait)
+		defer cancel()
+		resp, err := client.Call(ctx, msg)
+		if err != nil {
+			return err
+		}
+		printMessage(out, *resp)
+		return nil
+	}
+
+	if err := client.SendMessage(msg); err != nil {
+		return err
+	}
+	time.Sleep(*wait)
+	return nil
+}
+
+func listen(args []string, stdin io.Reader, stdout, stderr io.Writer) error {
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt)
+	defer stop()
+	return listenContext(ctx, args, stdout, stderr, nil)
+}
+
+// listenContext runs the listen command until ctx is done. ready, if not
+// nil, receives the address listened on.
+func listenContext(ctx context.Context, args []string, stdout, stderr io.Writer, ready chan<- net.Addr) error {
+	var opts options
+	fs := newFlagSet("listen", stderr, &opts, "")
+	addr := fs.String("addr", "localhost:8080", "address to listen on")
+	echo := fs.Bool("echo", true, "reply to every message with its command and arguments")
+	handshake := fs.Bool("handshake", false, "expect every connection to start with a handshake")
+	fs.Usage = func() {
+		io.WriteString(fs.Output(), "usage: portrelay listen [flags]\n\n"+
+			"Without -p, the protocol of every connection is detected.\n\n")
+		fs.PrintDefaults()
+	}
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+
+	var p portrelay.MessageProtocol
+	if opts.protocol != "" {
+		var err error
+		if p, err = opts.newProtocol(); err != nil {
+			return err
+		}
+	}
+
+	out := &syncWriter{w: stdout}
+	stderr = &syncWriter{w: stderr}
+	router := portrelay.NewRouter()
+	router.NotFound = portrelay.FuncHandler{
+		Func: func(msg portrelay.Message, w io.Writer) {
+			printMessage(out, msg)
+			if msg.Stream != nil {
+				n, err := io.Copy(io.Discard, msg.Stream)
+				fmt.Fprintf(stderr, "stream of %d bytes, %v\n", n, err)
+			}
+			if *echo {
+				resp := portrelay.Message{Command: msg.Command, Arguments: msg.Arguments, Values: msg.Values}
+				if err := portrelay.Reply(w, msg, resp); err != nil {
+					fmt.Fprintf(stderr, "reply: %v\n", err)
+				}
+			}
+		},
+	}
+	server := portrelay.NewServer(p, router)
+	server.Sniff = p == nil
+	server.Handshake = *handshake
+	server.OnConnect = func(c *portrelay.ServerConn) {
+		fmt.Fprintf(stderr, "%s connected, speaking %s\n", c.RemoteAddr(), portrelay.ProtocolName(c.Protocol()))
+	}
+	server.OnDisconnect = func(c *portrelay.ServerConn, err error) {
+		fmt.Fprintf(stderr, "%s disconnected: %v\n", c.RemoteAddr(), err)
+	}
+
+	l, err := net.Listen("tcp", *addr)
+	if err != nil {
+		return err
+	}
+	fmt.Fprintf(stderr, "listening on %s\n", l.Addr())
+	if ready != nil {
+		ready <- l.Addr()
+	}
+	if opts.verbose {
+		l = &verboseListener{Listener: l, opts: &opts, w: stderr}
+	}
+
+	go func() {
+		<-ctx.Done()
+		shutdownCtx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+		server.Shutdown(shutdownCtx)
+	}()
+	if err := server.Serve(l); !errors.Is(err, portrelay.ErrServerClosed) {
+		return err
+	}
+	return nil
+}
+
+// syncWriter serialises writes from concurrent handlers.
+type syncWriter struct {
+	mu sync.Mutex
+	w  io.Writer
+}
+
+func (w *syncWriter) Write(p []byte) (int, error) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	return w.w.Write(p)
+}
+
+// verboseConn shows everything read from and written to a connection.
+type verboseConn struct {
+	net.Conn
+	opts *options
+	w    io.Writer
+}
+
+func (c *verboseConn) Read(p []byte) (int, error) {
+	n, err := c.Conn.Read(p)
+	if n > 0 {
+		c.opts.printFrame(c.w, "<", p[:n])
+	}
+	return n, err
+}
+
+func (c *verboseConn) Write(p []byte) (int, error) {
+	c.opts.printFrame(c.w, ">", p)
+	return c.Conn.Write(p)
+}
+
+type verboseListener struct {
+	net.Listener
+	opts *options
+	w    io.Writer
+}
+
+func (l *verboseListener) Accept() (net.Conn, error) {
+	conn, err := l.Listener.Accept()
+	if err != nil {
+		return nil, err
+	}
+	return &verboseConn{Conn: conn, opts: l.opts, w: l.w}, nil
+}
@@ -0,0 +1,59 @@
+package portrelay
+
+import (
+	"context"
+	"slices"
+)
+
+// SendBatch writes msgs to the server with a single write, which saves a
+// round of system calls and packets per message. If one of them cannot be
+// encoded, none is sent and the *EncodeError is returned.
+func (c *Client) SendBatch(ctx context.Context, msgs ...Message) error {
+	if len(msgs) == 0 {
+		return nil
+	}
+	msgs = slices.Clone(msgs)
+	for i := range msgs {
+		c.stamp(&msgs[i])
+	}
+	return c.write(ctx, msgs)
+}
+
+// CallBatch sends msgs like SendBatch, each with a fresh ID, without waiting
+// for any reply in between, and then waits for all the replies. replies[i]
+// answers msgs[i], in whatever order the server sent them. On error the
+// replies received so far are returned along with it; the others are nil.
+func (c *Client) CallBatch(ctx context.Context, msgs ...Message) (replies []*Message, err error) {
+	if err := c.checkCall(); err != nil {
+		return nil, err
+	}
+
+	if _, ok := ctx.Deadline(); !ok && c.CallTimeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, c.CallTimeout)
+		defer cancel()
+	}
+
+	msgs = slices.Clone(msgs)
+	pending := make([]chan *Message, len(msgs))
+	for i := range msgs {
+		reply, err := c.prepareCall(ctx, &msgs[i])
+		if err != nil {
+			return nil, err
+		}
+		defer c.removePending(msgs[i].ID)
+		pending[i] = reply
+	}
+
+	if err := c.SendBatch(ctx, msgs...); err != nil {
+		return nil, err
+	}
+
+	replies = make([]*Message, len(msgs))
+	for i, reply := range pending {
+		if replies[i], err = waitReply(ctx, reply); err != nil {
+			return replies, err
+		}
+	}
+	return replies, nil
+}
@@ -0,0 +1,150 @@
+package portrelay
+
+import (
+	"context"
+	"errors"
+	"io"
+	"reflect"
+	"strconv"
+	"testing"
+	"time"
+)
+
+// writeCounter counts the Write calls made to it.
+type writeCounter struct {
+	writes int
+	data   []byte
+}
+
+func (w *writeCounter) Write(p []byte) (int, error) {
+	w.writes++
+	w.data = append(w.data, p...)
+	return len(p), nil
+}
+
+func TestEncoder_EncodeBatch(t *testing.T) {
+	msgs := []Message{
+		{Command: "a", Arguments: []string{"1"}},
+		{Command: "b", ID: 7},
+	}
+	for _, p := range []MessageProtocol{NewBinaryMessageProtocol(), NewJSONLinesProtocol(), NewRESPProtocol()} {
+		w := &writeCounter{}
+		if err := NewProtocolEncoder(p, w).EncodeBatch(msgs); err != nil {
+			t.Fatalf("%s: unexpected error: %v", ProtocolName(p), err)
+		}
+		if w.writes != 1 {
+			t.Errorf("%s: EncodeBatch() made %d writes, want 1", ProtocolName(p), w.writes)
+		}
+
+		var want []byte
+		for _, msg := range msgs {
+			want, _ = AppendEncode(p, want, msg)
+		}
+		if string(w.data) != string(want) {
+			t.Errorf("%s: EncodeBatch() wrote %q, want %q", ProtocolName(p), w.data, want)
+		}
+	}
+}
+
+func TestEncoder_EncodeBatchError(t *testing.T) {
+	w := &writeCounter{}
+	msgs := []Message{{Command: "ok"}, {Command: "bad", Values: []Value{IntValue(1)}, Arguments: []string{"1"}}}
+	err := NewProtocolEncoder(NewJSONLinesProtocol(), w).EncodeBatch(msgs)
+
+	var encodeErr *EncodeError
+	if !errors.As(err, &encodeErr) {
+		t.Errorf("EncodeBatch() error = %v, want *EncodeError", err)
+	}
+	if w.writes != 0 {
+		t.Errorf("EncodeBatch() wrote %q despite the error", w.data)
+	}
+}
+
+func TestClientSendBatch(t *testing.T) {
+	received := make(chan string, 3)
+	router := NewRouter()
+	router.Register("note", FuncHandler{
+		Func: func(msg Message, out io.Writer) {
+			received <- msg.Arguments[0] + " " + msg.Header(HeaderSender)
+		},
+	})
+	client := startCallClient(t, router)
+	client.Headers = map[string]string{HeaderSender: "svc"}
+
+	msgs := []Message{
+		{Command: "note", Arguments: []string{"1"}},
+		{Command: "note", Arguments: []string{"2"}},
+		{Command: "note", Arguments: []string{"3"}},
+	}
+	if err := client.SendBatch(context.Background(), msgs...); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	for _, want := range []string{"1 svc", "2 svc", "3 svc"} {
+		select {
+		case got := <-received:
+			if got != want {
+				t.Errorf("received %q, want %q", got, want)
+			}
+		case <-time.After(5 * time.Second):
+			t.Fatalf("%q was not received", want)
+		}
+	}
+	if msgs[0].Headers != nil {
+		t.Errorf("SendBatch() changed the caller's messages: %+v", msgs[0])
+	}
+}
+
+func TestClientCallBatch(t *testing.T) {
+	router := NewRouter()
+	router.Register("sleep", FuncHandler{
+		Func: func(msg Message, out io.Writer) {
+			// Later requests are answered first.
+			ms, _ := strconv.Atoi(msg.Arguments[0])
+			go func() {
+				time.Sleep(time.Duration(ms) * time.Millisecond)
+				Reply(out, msg, Message{Command: "slept", Arguments: msg.Arguments})
+			}()
+		},
+	})
+	client := startCallClient(t, router)
+
+	var msgs []Message
+	for _, ms := range []string{"30", "20", "10", "0"} {
+		msgs = append(msgs, Message{Command: "sleep", Arguments: []string{ms}})
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	replies, err := client.CallBatch(ctx, msgs...)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	for i, reply := range replies {
+		if !reflect.DeepEqual(reply.Arguments, msgs[i].Arguments) {
+			t.Errorf("reply %d got = %+v, want arguments %v", i, reply, msgs[i].Arguments)
+		}
+	}
+	if msgs[0].ID != 0 {
+		t.Errorf("CallBatch() changed the caller's messages: %+v", msgs[0])
+	}
+}
+
+func TestClientCallBatch_Timeout(t *testing.T) {
+	router := NewRouter()
+	router.Register("echo", FuncHandler{
+		Func: func(msg Message, out io.Writer) {
+			Reply(out, msg, Message{Command: "echo"})
+		},
+	})
+	router.Register("unanswered", FuncHandler{Func: func(Message, io.Writer) {}})
+	client := startCallClient(t, router)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	replies, err := client.CallBatch(ctx, Message{Command: "echo"}, Message{Command: "unanswered"})
+	if !errors.Is(err, context.DeadlineExceeded) {
+		t.Fatalf("CallBatch() error = %v, want %v", err, context.DeadlineExceeded)
+	}
+	if replies[0] == nil || replies[1] != nil {
+		t.Errorf("CallBatch() replies = %v, want only the first", replies)
+	}
+}
@@ -0,0 +1,142 @@
+package portrelay
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"maps"
+	"time"
+)
+
+// ErrConnectionClosed is returned for calls that were still waiting for a
+// reply when the connection was lost.
+var ErrConnectionClosed = errors.New("portrelay: connection closed")
+
+// ErrCannotReply is returned by Reply when the handler's writer cannot send messages.
+var ErrCannotReply = errors.New("portrelay: writer cannot send messages")
+
+// MessageSender is implemented by handler writers that can send whole
+// messages, such as ServerConn and the writer of Client handlers.
+type MessageSender interface {
+	Send(msg Message) error
+}
+
+// Reply answers req with resp through out, the writer the handler was called with.
+// The request's HeaderTraceID is carried over unless resp sets its own.
+func Reply(out io.Writer, req Message, resp Message) error {
+	sender, ok := out.(MessageSender)
+	if !ok {
+		return ErrCannotReply
+	}
+	resp.ReplyTo = req.ID
+	if trace := req.Header(HeaderTraceID); trace != "" {
+		resp.Headers = maps.Clone(resp.Headers)
+		stampHeaders(&resp, map[string]string{HeaderTraceID: trace})
+	}
+	return sender.Send(resp)
+}
+
+// Call sends msg with a fresh ID and waits for the message that replies to it.
+// It gives up when ctx is done, after CallTimeout if ctx has no deadline, or
+// with ErrConnectionClosed when the connection drops first. Errors encoding
+// or writing msg are returned as they are.
+func (c *Client) Call(ctx context.Context, msg Message) (*Message, error) {
+	if err := c.checkCall(); err != nil {
+		return nil, err
+	}
+
+	if _, ok := ctx.Deadline(); !ok && c.CallTimeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, c.CallTimeout)
+		defer cancel()
+	}
+
+	reply, err := c.prepareCall(ctx, &msg)
+	if err != nil {
+		return nil, err
+	}
+	defer c.removePending(msg.ID)
+
+	if err := c.Send(ctx, msg); err != nil {
+		return nil, err
+	}
+	return waitReply(ctx, reply)
+}
+
+func (c *Client) checkCall() error {
+	if _, _, err := c.current(); err != nil {
+		return err
+	}
+	if !c.supports(CapMessageIDs) {
+		return fmt.Errorf("%w: %s", ErrNotNegotiated, CapMessageIDs)
+	}
+	return nil
+}
+
+// prepareCall gives msg a fresh ID and the deadline of ctx, and registers
+// it as waiting for a reply.
+func (c *Client) prepareCall(ctx context.Context, msg *Message) (chan *Message, error) {
+	msg.ID = c.nextID.Add(1)
+	if deadline, ok := ctx.Deadline(); ok && msg.Header(HeaderDeadline) == "" {
+		msg.Headers = maps.Clone(msg.Headers)
+		msg.SetHeader(HeaderDeadline, deadline.UTC().Format(time.RFC3339Nano))
+	}
+	return c.addPending(msg.ID)
+}
+
+func waitReply(ctx context.Context, reply chan *Message) (*Message, error) {
+	select {
+	case resp, ok := <-reply:
+		if !ok {
+			return nil, ErrConnectionClosed
+		}
+		return resp, nil
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+}
+
+func (c *Client) addPending(id uint64) (chan *Message, error) {
+	c.pendingMu.Lock()
+	defer c.pendingMu.Unlock()
+	if c.pending == nil {
+		return nil, ErrConnectionClosed
+	}
+	ch := make(chan *Message, 1)
+	c.pending[id] = ch
+	return ch, nil
+}
+
+func (c *Client) removePending(id uint64) {
+	c.pendingMu.Lock()
+	defer c.pendingMu.Unlock()
+	delete(c.pending, id)
+}
+
+// resolvePending hands msg to the Call waiting for it and reports whether there was one.
+func (c *Client) resolvePending(msg *Message) bool {
+	c.pendingMu.Lock()
+	defer c.pendingMu.Unlock()
+	ch, ok := c.pending[msg.ReplyTo]
+	if !ok {
+		return false
+	}
+	delete(c.pending, msg.ReplyTo)
+	ch <- msg
+	return true
+}
+
+// failPending releases every waiting Call with ErrConnectionClosed. With
+// reject set, new calls are rejected as well.
+func (c *Client) failPending(reject bool) {
+	c.pendingMu.Lock()
+	defer c.pendingMu.Unlock()
+	for id, ch := range c.pending {
+		close(ch)
+		delete(c.pending, id)
+	}
+	if reject {
+		c.pending = nil
+	}
+}
@@ -0,0 +1,187 @@
+package portrelay
+
+import (
+	"context"
+	"errors"
+	"io"
+	"net"
+	"reflect"
+	"sync"
+	"testing"
+	"time"
+)
+
+func startCallClient(t *testing.T, router *CommandRouter) *Client {
+	t.Helper()
+
+	addr := startTestServer(t, NewServer(NewBinaryMessageProtocol(), router))
+	host, port, _ := net.SplitHostPort(addr)
+
+	client := NewClient(NewBinaryMessageProtocol())
+	if err := client.Start(context.Background(), host, port); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	t.Cleanup(func() { client.Close() })
+	return client
+}
+
+func TestClientCall_MatchesReplies(t *testing.T) {
+	router := NewRouter()
+	router.Register("echo", FuncHandler{
+		Func: func(msg Message, out io.Writer) {
+			Reply(out, msg, Message{Command: "echo", Arguments: msg.Arguments})
+		},
+	})
+	client := startCallClient(t, router)
+
+	var wg sync.WaitGroup
+	for _, arg := range []string{"a", "b", "c", "d"} {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			resp, err := client.Call(context.Background(), Message{Command: "echo", Arguments: []string{arg}})
+			if err != nil {
+				t.Errorf("Call(%s): unexpected error: %v", arg, err)
+				return
+			}
+			if !reflect.DeepEqual(resp.Arguments, []string{arg}) {
+				t.Errorf("Call(%s) got arguments %v", arg, resp.Arguments)
+			}
+			if resp.ReplyTo == 0 {
+				t.Errorf("Call(%s) reply has no ReplyTo", arg)
+			}
+		}()
+	}
+	wg.Wait()
+}
+
+func TestClientCall_BinaryArguments(t *testing.T) {
+	router := NewRouter()
+	router.Register("echo", FuncHandler{
+		Func: func(msg Message, out io.Writer) {
+			Reply(out, msg, NewBytesMessage("echo", msg.ArgsBytes()...))
+		},
+	})
+	client := startCallClient(t, router)
+
+	payload := make([]byte, 256)
+	for i := range payload {
+		payload[i] = byte(i)
+	}
+	resp, err := client.Call(context.Background(), NewBytesMessage("echo", payload, []byte{0}))
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if !reflect.DeepEqual(resp.ArgsBytes(), [][]byte{payload, {0}}) {
+		t.Errorf("Call() got arguments %q", resp.Arguments)
+	}
+}
+
+func TestClientCall_Timeout(t *testing.T) {
+	router := NewRouter()
+	router.Register("ignore", FuncHandler{Func: func(msg Message, out io.Writer) {}})
+	client := startCallClient(t, router)
+	client.CallTimeout = 50 * time.Millisecond
+
+	if _, err := client.Call(context.Background(), Message{Command: "ignore"}); !errors.Is(err, context.DeadlineExceeded) {
+		t.Errorf("Call() error = %v, want %v", err, context.DeadlineExceeded)
+	}
+
+	client.pendingMu.Lock()
+	defer client.pendingMu.Unlock()
+	if len(client.pending) != 0 {
+		t.Errorf("pending calls after timeout = %d, want 0", len(client.pending))
+	}
+}
+
+func TestClientCall_Cancel(t *testing.T) {
+	router := NewRouter()
+	router.Register("ignore", FuncHandler{Func: func(msg Message, out io.Writer) {}})
+	client := startCallClient(t, router)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	time.AfterFunc(50*time.Millisecond, cancel)
+	if _, err := client.Call(ctx, Message{Command: "ignore"}); !errors.Is(err, context.Canceled) {
+		t.Errorf("Call() error = %v, want %v", err, context.Canceled)
+	}
+}
+
+func TestClientCall_ConnectionDropped(t *testing.T) {
+	router := NewRouter()
+	router.Register("hangup", FuncHandler{
+		Func: func(msg Message, out io.Writer) {
+			out.(*ServerConn).Close()
+		},
+	})
+	client := startCallClient(t, router)
+
+	if _, err := client.Call(context.Background(), Message{Command: "hangup"}); !errors.Is(err, ErrConnectionClosed) {
+		t.Errorf("Call() error = %v, want %v", err, ErrConnectionClosed)
+	}
+	if _, err := client.Call(context.Background(), Message{Command: "hangup"}); !errors.Is(err, ErrConnectionClosed) {
+		t.Errorf("Call() after drop error = %v, want %v", err, ErrConnectionClosed)
+	}
+}
+
+func TestClientCall_EncodeError(t *testing.T) {
+	router := NewRouter()
+	router.Register("echo", FuncHandler{
+		Func: func(msg Message, out io.Writer) {
+			Reply(out, msg, Message{Command: "echo", Arguments: msg.Arguments})
+		},
+	})
+	addr := startTestServer(t, NewServer(NewBinaryMessageProtocol(), router))
+	host, port, _ := net.SplitHostPort(addr)
+
+	client := NewClient(&BinaryMessageProtocol{Limits: DecodeLimits{MaxArgSize: 4}})
+	if err := client.Start(context.Background(), host, port); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	_, err := client.Call(context.Background(), Message{Command: "echo", Arguments: []string{"too large"}})
+	var encodeErr *EncodeError
+	if !errors.As(err, &encodeErr) {
+		t.Fatalf("Call() error = %v, want *EncodeError", err)
+	}
+	if err := client.SendMessage(Message{Command: "too large"}); !errors.As(err, &encodeErr) {
+		t.Fatalf("SendMessage() error = %v, want *EncodeError", err)
+	}
+
+	// Nothing was written, so the connection is still in sync.
+	resp, err := client.Call(context.Background(), Message{Command: "echo", Arguments: []string{"ok"}})
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if !reflect.DeepEqual(resp.Arguments, []string{"ok"}) {
+		t.Errorf("Call() got arguments %v, want [ok]", resp.Arguments)
+	}
+}
+
+func TestReply_WriterWithoutSend(t *testing.T) {
+	if err := Reply(io.Discard, Message{ID: 1}, Message{}); !errors.Is(err, ErrCannotReply) {
+		t.Errorf("Reply() error = %v, want %v", err, ErrCannotReply)
+	}
+}
+
+func TestReply_ClientHandler(t *testing.T) {
+	client := NewClient(NewBinaryMessageProtocol())
+	client.RegisterHandler("ask", FuncHandler{
+		Func: func(msg Message, out io.Writer) {
+			if err := Reply(out, msg, Message{Command: "answer"}); err != nil {
+				t.Errorf("Reply() unexpected error: %v", err)
+			}
+		},
+	})
+	peer := pipeClient(t, client)
+	defer client.Close()
+
+	p := NewBinaryMessageProtocol()
+	go p.EncodeTo(peer, Message{Command: "ask", ID: 7})
+	resp, err := NewProtocolDecoder(p, peer).Next()
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if resp.Command != "answer" || resp.ReplyTo != 7 {
+		t.Errorf("reply = %+v, want an answer to 7", resp)
+	}
+}
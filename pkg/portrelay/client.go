@@ -1,116 +1,717 @@
 package portrelay
 
 import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
 	"errors"
+	"fmt"
 	"io"
+	"maps"
 	"net"
 	"os"
 	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
 )
 
-type Dialer func(network, address string) (net.Conn, error)
+// Dialer opens the connection a Client runs on, like net.Dialer.DialContext.
+type Dialer func(ctx context.Context, network, address string) (net.Conn, error)
+
+// ErrNotConnected is returned when a Client is used before Start succeeded.
+var ErrNotConnected = errors.New("portrelay: client not connected")
+
+// ErrClientClosed is returned when a Client is used after Close or Shutdown.
+var ErrClientClosed = errors.New("portrelay: client closed")
+
+// DefaultCloseTimeout bounds how long Client.Close waits for queued messages
+// and running handlers.
+const DefaultCloseTimeout = 5 * time.Second
+
+// ClientState is the stage of a Client's lifecycle.
+type ClientState int32
+
+const (
+	// StateIdle is a Client that was not started yet, or whose Start failed.
+	StateIdle ClientState = iota
+	// StateConnecting is a Client inside Start, or reconnecting after its
+	// connection dropped.
+	StateConnecting
+	// StateConnected is a Client whose connection is up.
+	StateConnected
+	// StateClosed is a Client whose connection was lost for good, or that
+	// was closed.
+	StateClosed
+)
+
+func (s ClientState) String() string {
+	switch s {
+	case StateIdle:
+		return "idle"
+	case StateConnecting:
+		return "connecting"
+	case StateConnected:
+		return "connected"
+	case StateClosed:
+		return "closed"
+	}
+	return fmt.Sprintf("ClientState(%d)", int32(s))
+}
 
 type Client struct {
 	//
-	messageChan  chan Message
 	OnAnyMessage func(string, io.Writer)
 	OnUnhandled  func(Message, io.Writer)
 	Handlers     map[string]Handler
-	conn         net.Conn
-	protocol     MessageProtocol
-	dial         Dialer
+	// Headers are set on every message sent by Send and Call that does not
+	// set them itself, for example HeaderSender.
+	Headers map[string]string
+	// CallTimeout bounds Call when its context has no deadline. Zero means no limit.
+	CallTimeout time.Duration
+	// Handshake makes Start exchange a Hello with the server before any
+	// frame is sent. The server must have it enabled too.
+	Handshake bool
+	// Capabilities are advertised in the handshake. Nil means SupportedCapabilities().
+	Capabilities Capabilities
+	// HandshakeTimeout bounds the handshake. Zero means DefaultHandshakeTimeout.
+	HandshakeTimeout time.Duration
+	// TLSConfig makes Start speak TLS over the dialed connection. An empty
+	// ServerName defaults to the host passed to Start; client certificates
+	// for mutual TLS go in Certificates. Certificate problems are reported
+	// as *TLSError. HandshakeTimeout bounds the TLS handshake as well.
+	TLSConfig *tls.Config
+	// Reconnect makes the client connect again when its connection drops.
+	// Nil means a lost connection leaves the client closed.
+	Reconnect *ReconnectPolicy
+	// Heartbeat makes the client ping the server and drop the connection
+	// once it stops answering. With Handshake set, only servers that
+	// advertise CapHeartbeat are pinged. Nil means no pings are sent; the
+	// server's pings are answered either way.
+	Heartbeat *HeartbeatPolicy
+
+	// OnConnect is called whenever a connection is up, by Start or by a
+	// reconnect, before its first message is read.
+	OnConnect func(*Client)
+	// OnDisconnect is called whenever a connection ends, with the error
+	// that ended it: a *NetError when reading or writing failed, including
+	// the server closing the connection or no longer answering heartbeats,
+	// or a *DecodeError for a frame that
+	// could not be decoded. err is nil after Close or Shutdown. The client
+	// has already started to reconnect, if it does. Close and Shutdown wait
+	// for OnDisconnect, so it must not call them.
+	OnDisconnect func(c *Client, err error)
+	// OnError is called with every error on the connection that no caller
+	// of Send or Call receives, whether it ends the connection or not. It
+	// must not block.
+	OnError func(c *Client, err error)
+	// SkipDecodeError reports whether the client carries on reading after a
+	// frame that could not be decoded. Whether that works depends on the
+	// protocol and the error, as the rest of the frame may still be unread.
+	// Nil means every decode error ends the connection, apart from frames
+	// dropped by a Verifier, which are always skipped.
+	SkipDecodeError func(err *DecodeError) bool
+
+	protocol MessageProtocol
+	dial     Dialer
+
+	mu          sync.Mutex
+	state       ClientState
+	link        *link
+	negotiated  Capabilities
+	host, port  string
+	reconnected chan struct{} // closed when a reconnect ends, either way
+	shut        bool
+	stop        context.Context // done once Shutdown starts
+	cancelStop  context.CancelFunc
+
+	sends    activity // Send calls past the shutdown check
+	handlers activity
+	loops    sync.WaitGroup // reader, writer and reconnect goroutines
+
+	nextID    atomic.Uint64
+	pendingMu sync.Mutex
+	pending   map[uint64]chan *Message
+	streams   streams
+}
+
+// link is a connection of a Client and the goroutines serving it.
+type link struct {
+	conn     net.Conn
+	messages chan outgoing
+	// done is closed once the connection is lost.
+	done      chan struct{}
+	heartbeat *heartbeat
+
+	mu  sync.Mutex
+	err error // why the connection ended
+}
+
+// fail records err as the reason the connection ended, unless there is one
+// already, and closes it.
+func (l *link) fail(err error) {
+	l.mu.Lock()
+	if l.err == nil {
+		l.err = err
+	}
+	l.mu.Unlock()
+	l.conn.Close()
+}
+
+func (l *link) cause() error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.err
+}
+
+// clientWriter is what Client handlers write to. Writes go straight to the
+// connection the message arrived on, while Send writes a whole message on
+// it, so Reply works as it does on a ServerConn.
+type clientWriter struct {
+	client *Client
+	link   *link
+}
+
+func (w clientWriter) Write(p []byte) (int, error) {
+	return w.link.conn.Write(p)
+}
+
+// Send stamps msg with Client.Headers and writes it on the connection.
+func (w clientWriter) Send(msg Message) error {
+	w.client.stamp(&msg)
+	return w.link.send(msg)
+}
+
+// send writes msg on l, unlike Client.Send, which writes on whatever
+// connection the client has.
+func (l *link) send(msg Message) error {
+	out := outgoing{msgs: []Message{msg}, result: make(chan error, 1)}
+	select {
+	case l.messages <- out:
+	case <-l.done:
+		return ErrConnectionClosed
+	}
+	return <-out.result
 }
 
 func NewClient(protocol MessageProtocol) *Client {
+	stop, cancel := context.WithCancel(context.Background())
 	return &Client{
-		Handlers: make(map[string]Handler),
-		protocol: protocol,
-		dial:     net.Dial,
+		Handlers:   make(map[string]Handler),
+		protocol:   protocol,
+		dial:       new(net.Dialer).DialContext,
+		stop:       stop,
+		cancelStop: cancel,
 	}
 }
 
-func (s *Client) Start(host, port string) error {
-	if s.conn != nil {
+// Start connects to the server and starts serving the connection. ctx
+// bounds dialing and the handshakes; once Start has returned it no longer
+// matters. An empty host or port is taken from the BOT_CLIENT_HOST and
+// BOT_CLIENT_PORT environment variables.
+func (s *Client) Start(ctx context.Context, host, port string) error {
+	s.mu.Lock()
+	if s.shut {
+		s.mu.Unlock()
+		return ErrClientClosed
+	}
+	if s.state != StateIdle {
+		s.mu.Unlock()
 		return errors.New("client already started")
 	}
+	s.state = StateConnecting
+	s.mu.Unlock()
 
+	c, dec, caps, err := s.connect(ctx, host, port)
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if err != nil {
+		s.state = StateIdle
+		return err
+	}
+	if s.shut {
+		c.Close()
+		s.state = StateClosed
+		return ErrClientClosed
+	}
+	s.host, s.port = host, port
+	s.establish(c, dec, caps)
+	return nil
+}
+
+// establish makes c the client's connection. The caller holds s.mu.
+func (s *Client) establish(c net.Conn, dec *Decoder, caps Capabilities) {
+	s.state = StateConnected
+	s.negotiated = caps
+	s.link = &link{conn: c, messages: make(chan outgoing), done: make(chan struct{})}
+	if !s.Handshake || caps.Has(CapHeartbeat) {
+		s.link.heartbeat = newHeartbeat(s.Heartbeat)
+	}
+	s.serve(s.link, dec)
+	if s.reconnected != nil {
+		close(s.reconnected)
+		s.reconnected = nil
+	}
+}
+
+// connect dials the server and runs the handshakes.
+func (s *Client) connect(ctx context.Context, host, port string) (net.Conn, *Decoder, Capabilities, error) {
 	if host == "" {
 		var exists bool
 		if host, exists = os.LookupEnv("BOT_CLIENT_HOST"); !exists {
-			return errors.New("no host specified")
+			return nil, nil, nil, errors.New("no host specified")
 		}
 	}
 
 	if port == "" {
 		var exists bool
 		if port, exists = os.LookupEnv("BOT_CLIENT_PORT"); !exists {
-			return errors.New("no port specified")
+			return nil, nil, nil, errors.New("no port specified")
 		}
 	}
 
-	c, err := s.dial("tcp", net.JoinHostPort(host, port))
+	c, err := s.dial(ctx, "tcp", net.JoinHostPort(host, port))
 	if err != nil {
-		return &ConnError{Err: err} //errors.New("failed to connect to server: " + err.Error())
+		if ctx.Err() != nil {
+			err = ctx.Err()
+		}
+		return nil, nil, nil, &ConnError{Err: err} //errors.New("failed to connect to server: " + err.Error())
 	}
-	s.conn = c
-	s.messageChan = make(chan Message)
 
+	// Closing the connection is the one way to interrupt the handshakes.
+	stop := context.AfterFunc(ctx, func() { c.Close() })
+	fail := func(err error) (net.Conn, *Decoder, Capabilities, error) {
+		c.Close()
+		if ctx.Err() != nil {
+			return nil, nil, nil, ctx.Err()
+		}
+		return nil, nil, nil, err
+	}
+
+	if s.TLSConfig != nil {
+		tlsConn, err := clientTLS(c, s.TLSConfig, host, s.HandshakeTimeout)
+		if err != nil {
+			return fail(err)
+		}
+		c = tlsConn
+	}
+
+	dec := NewProtocolDecoder(s.protocol, c)
+	var caps Capabilities
+	if s.Handshake {
+		caps, err = handshake(c, dec.buf, localHello(s.protocol, s.Capabilities), s.HandshakeTimeout)
+		if err != nil {
+			return fail(err)
+		}
+	}
+
+	if !stop() {
+		return fail(ctx.Err())
+	}
+	return c, dec, caps, nil
+}
+
+// serve starts the goroutines writing and reading l.
+func (s *Client) serve(l *link, dec *Decoder) {
+	s.pendingMu.Lock()
+	if s.pending == nil {
+		s.pending = make(map[uint64]chan *Message)
+	}
+	s.pendingMu.Unlock()
+	enc := NewProtocolEncoder(encodingProtocol(s.protocol, s.Handshake, s.negotiated), l.conn)
+	writer := clientWriter{client: s, link: l}
+	control := newControlWriter()
+
+	s.loops.Add(3)
 	go func() {
-		for msg := range s.messageChan {
-			encoded := s.protocol.Encode(msg)
-			_, err := c.Write(encoded)
-			if err != nil {
+		defer s.loops.Done()
+		control.run(l.done, func(msg Message) { l.send(msg) })
+	}()
+	go func() {
+		defer s.loops.Done()
+		for {
+			var out outgoing
+			select {
+			case out = <-l.messages:
+			case <-l.done:
+				return
+			}
+
+			var err error
+			if len(out.msgs) == 1 {
+				err = enc.Encode(out.msgs[0])
+			} else {
+				err = enc.EncodeBatch(out.msgs)
+			}
+			var encodeErr *EncodeError
+			if err != nil && !errors.As(err, &encodeErr) {
+				// Only a failed write breaks the connection; a message that
+				// could not be encoded was never sent. Closing it stops the
+				// reader, which tells everybody else.
+				err = &NetError{Op: "write", Err: err}
+				s.reportError(err)
+				l.fail(err)
+				out.result <- err
 				return
 			}
+			out.result <- err
 		}
 	}()
 
 	go func() {
+		defer s.loops.Done()
+		defer close(l.done)
+		defer s.disconnected(l)
+		defer s.lost()
+		defer s.streams.closeAll(ErrConnectionClosed)
+
+		if s.OnConnect != nil {
+			s.OnConnect(s)
+		}
+		if l.heartbeat != nil {
+			s.loops.Add(1)
+			go func() {
+				defer s.loops.Done()
+				l.heartbeat.run(l.done, func(ping Message) { control.push(ping) }, func(err error) {
+					s.reportError(err)
+					l.fail(err)
+				})
+			}()
+		}
+
 		for {
-			message, err := s.protocol.Decode(c)
+			l.heartbeat.resume()
+			message, err := dec.Next()
+			l.heartbeat.pause()
 			if err != nil {
-				//TODO: better error handling
+				if l.cause() != nil || s.closing() {
+					// The connection was closed on purpose; reading from
+					// it was bound to fail.
+					return
+				}
+				err = readError(err)
+				s.reportError(err)
+				var decodeErr *DecodeError
+				if isDroppedFrame(err) || errors.As(err, &decodeErr) && s.SkipDecodeError != nil && s.SkipDecodeError(decodeErr) {
+					continue
+				}
+				// Otherwise the stream is out of sync, so the connection
+				// cannot be used any further.
+				l.fail(err)
 				return
 			}
 
+			if message.ReplyTo != 0 && s.resolvePending(message) {
+				continue
+			}
+			if l.heartbeat.handle(*message, func(pong Message) { control.push(pong) }) {
+				continue
+			}
+			if s.streams.handle(*message, func(msg Message) { control.push(msg) }) {
+				continue
+			}
+
+			stream, err := s.streams.start(message, func(msg Message) { l.send(msg) })
+			if err != nil {
+				control.push(cancelStream(message.Header(HeaderStream), err.Error()))
+				continue
+			}
 			if handler, exists := s.Handlers[message.Command]; exists {
-				go handler.Handle(*message, c)
+				s.goHandle(func() {
+					handler.Handle(*message, writer)
+					closeStream(stream)
+				})
 			} else if s.OnUnhandled != nil {
-				go s.OnUnhandled(*message, c)
+				s.goHandle(func() {
+					s.OnUnhandled(*message, writer)
+					closeStream(stream)
+				})
+			} else {
+				closeStream(stream)
 			}
 
 			if s.OnAnyMessage != nil {
-				go s.OnAnyMessage(message.Command, c)
+				s.goHandle(func() { s.OnAnyMessage(message.Command, writer) })
 			}
 		}
 	}()
+}
 
-	s.conn = c
-	return nil
+// State returns the stage of the client's lifecycle.
+func (c *Client) State() ClientState {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.state
 }
 
-func (s *Client) StartWithRetry(host, port string, retries int) error {
-	for i := 0; i < retries; i++ {
-		var connErr *ConnError
-		if err := s.Start(host, port); errors.Is(err, connErr) {
-			continue
-		} else {
+// current returns the client's connection, or ErrNotConnected or
+// ErrConnectionClosed when it has none. While the client reconnects with
+// ReconnectPolicy.Queue set, it returns a channel to wait on instead.
+func (c *Client) current() (*link, <-chan struct{}, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	switch c.state {
+	case StateConnected:
+		return c.link, nil, nil
+	case StateClosed:
+		if c.shut {
+			return nil, nil, ErrClientClosed
+		}
+		return nil, nil, ErrConnectionClosed
+	}
+	if c.shut {
+		return nil, nil, ErrClientClosed
+	}
+	if c.reconnected != nil && c.Reconnect.Queue {
+		return nil, c.reconnected, nil
+	}
+	return nil, nil, ErrNotConnected
+}
+
+// outgoing is a message, or a batch of them, queued for the writer
+// goroutine, which reports the outcome of encoding and writing it on result.
+type outgoing struct {
+	msgs   []Message
+	result chan error
+}
+
+// Send writes msg to the server and returns once it has been written. It
+// gives up when ctx is done, and returns ErrNotConnected before Start has
+// succeeded and ErrConnectionClosed once the connection is lost. A message
+// the protocol cannot encode is reported as an *EncodeError and leaves the
+// connection usable.
+func (c *Client) Send(ctx context.Context, msg Message) error {
+	c.stamp(&msg)
+	return c.write(ctx, []Message{msg})
+}
+
+// SendMessage is Send without a context.
+func (c *Client) SendMessage(msg Message) error {
+	return c.Send(context.Background(), msg)
+}
+
+// stamp sets c.Headers on msg without changing the caller's map.
+func (c *Client) stamp(msg *Message) {
+	if len(c.Headers) > 0 {
+		msg.Headers = maps.Clone(msg.Headers)
+		stampHeaders(msg, c.Headers)
+	}
+}
+
+// write hands msgs to the writer goroutine, which writes them at once, and
+// waits for the result.
+func (c *Client) write(ctx context.Context, msgs []Message) error {
+	c.mu.Lock()
+	if c.shut {
+		c.mu.Unlock()
+		return ErrClientClosed
+	}
+	c.sends.add()
+	c.mu.Unlock()
+	defer c.sends.done()
+
+	out := outgoing{msgs: msgs, result: make(chan error, 1)}
+	for queued := false; !queued; {
+		if err := ctx.Err(); err != nil {
 			return err
 		}
+		l, reconnected, err := c.current()
+		if err != nil {
+			return err
+		}
+		if reconnected != nil {
+			select {
+			case <-reconnected:
+			case <-ctx.Done():
+			}
+			continue
+		}
+
+		select {
+		case l.messages <- out:
+			queued = true
+		case <-l.done:
+			// Lost before it was written, so it can wait for a reconnect.
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
 
+	select {
+	case err := <-out.result:
+		return err
+	case <-ctx.Done():
+		return ctx.Err()
 	}
+}
 
-	return errors.New("failed to start server after retries")
+// Negotiated returns the capabilities agreed on in the handshake.
+// It is nil when the handshake is disabled.
+func (c *Client) Negotiated() Capabilities {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.negotiated
+}
+
+// PeerCertificate returns the server's verified certificate, or nil when
+// the connection does not use TLS.
+func (c *Client) PeerCertificate() *x509.Certificate {
+	l, _, err := c.current()
+	if l == nil || err != nil {
+		return nil
+	}
+	return verifiedPeer(l.conn)
 }
 
-func (c *Client) SendMessage(msg Message) {
-	c.messageChan <- msg
+// supports reports whether capability may be used on the current connection.
+// Without a handshake there is nothing to go by, so everything is allowed.
+func (c *Client) supports(capability Capability) bool {
+	return !c.Handshake || c.Negotiated().Has(capability)
+}
+
+// SetDialer replaces net.Dial as the way Start connects, for example with
+// MuxSession.Dial to run the client on a stream of a shared connection.
+func (c *Client) SetDialer(dial Dialer) {
+	c.dial = dial
 }
 
 func (c *Client) RegisterHandler(command string, handler Handler) {
 	c.Handlers[strings.ToLower(command)] = handler
 }
 
+// readError makes err a *NetError when reading from the connection failed,
+// as opposed to decoding what was read.
+func readError(err error) error {
+	if isNetError(err) {
+		return &NetError{Op: "read", Err: err}
+	}
+	return err
+}
+
+// isNetError reports whether err comes from the connection, as opposed to
+// what was sent over it.
+func isNetError(err error) bool {
+	var netErr net.Error
+	return errors.Is(err, io.EOF) || errors.Is(err, io.ErrUnexpectedEOF) || errors.Is(err, io.ErrClosedPipe) ||
+		errors.Is(err, net.ErrClosed) || errors.As(err, &netErr)
+}
+
+func (c *Client) reportError(err error) {
+	if c.OnError != nil {
+		c.OnError(c, err)
+	}
+}
+
+// closing reports whether Close or Shutdown was called.
+func (c *Client) closing() bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.shut
+}
+
+// disconnected reports the end of l to OnDisconnect.
+func (c *Client) disconnected(l *link) {
+	if c.OnDisconnect == nil {
+		return
+	}
+	err := l.cause()
+	if c.closing() {
+		// Whatever the reader saw was the result of closing the connection.
+		err = nil
+	}
+	c.OnDisconnect(c, err)
+}
+
+// goHandle runs a handler in its own goroutine, which Shutdown waits for.
+func (c *Client) goHandle(handle func()) {
+	c.handlers.add()
+	go func() {
+		defer c.handlers.done()
+		handle()
+	}()
+}
+
+// Shutdown stops the client gracefully. New sends fail with ErrClientClosed
+// at once, while those already under way are still written. Once they are,
+// and the running handlers have returned, the connection is closed. If ctx
+// is done first, the connection is closed anyway and ctx's error returned.
+// Either way every goroutine of the client has ended when Shutdown returns,
+// apart from handlers that are still running.
+//
+// A handler that calls Shutdown waits for itself until ctx is done.
+func (c *Client) Shutdown(ctx context.Context) error {
+	c.mu.Lock()
+	c.shut = true
+	c.cancelStop()
+	c.mu.Unlock()
+
+	err := c.sends.wait(ctx)
+	if err == nil {
+		err = c.handlers.wait(ctx)
+	}
+
+	c.mu.Lock()
+	if c.link != nil {
+		c.link.conn.Close()
+	}
+	if c.state != StateConnected && c.state != StateConnecting {
+		// Nothing is left to stop the client when its connection goes.
+		c.state = StateClosed
+	}
+	c.mu.Unlock()
+	c.loops.Wait()
+	return err
+}
+
+// Close is Shutdown with a deadline of DefaultCloseTimeout.
 func (c *Client) Close() error {
-	return nil
+	ctx, cancel := context.WithTimeout(context.Background(), DefaultCloseTimeout)
+	defer cancel()
+	return c.Shutdown(ctx)
+}
+
+// activity counts work in progress. Unlike a sync.WaitGroup, more work
+// may start while somebody waits for it to end.
+type activity struct {
+	mu   sync.Mutex
+	n    int
+	idle chan struct{} // closed when n drops to zero
+}
+
+func (a *activity) add() {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	a.n++
+}
+
+func (a *activity) done() {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	a.n--
+	if a.n == 0 && a.idle != nil {
+		close(a.idle)
+		a.idle = nil
+	}
+}
+
+// wait waits until no work is in progress or ctx is done.
+func (a *activity) wait(ctx context.Context) error {
+	a.mu.Lock()
+	if a.n == 0 {
+		a.mu.Unlock()
+		return nil
+	}
+	if a.idle == nil {
+		a.idle = make(chan struct{})
+	}
+	idle := a.idle
+	a.mu.Unlock()
+
+	select {
+	case <-idle:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
 }
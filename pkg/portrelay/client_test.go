@@ -1,10 +1,14 @@
 package portrelay
 
 import (
+	"context"
+	"errors"
 	"io"
 	"net"
+	"reflect"
 	"strings"
 	"testing"
+	"time"
 )
 
 func pingHandler(msg Message, out io.Writer) {
@@ -20,37 +24,425 @@ func TestClientStart_MockDial(t *testing.T) {
 	writer := make(chan []byte)
 	defer close(writer)
 
-	client.dial = func(network, address string) (net.Conn, error) {
-		c1, c2 := net.Pipe() 
+	client.dial = func(ctx context.Context, network, address string) (net.Conn, error) {
+		c1, c2 := net.Pipe()
 		go func() {
 			defer c2.Close()
-			
+
 			for msg := range writer {
 				_, err := c2.Write(msg)
 				if err != nil {
-					t.Fatalf("unexpected error: %v", err)
+					t.Errorf("unexpected error: %v", err)
+					return
 				}
 			}
 		}()
 		return c1, nil
 	}
 
-	err := client.Start("fakehost", "1234")
+	err := client.Start(context.Background(), "fakehost", "1234")
 	if err != nil {
 		t.Fatalf("unexpected error: %v", err)
 	}
 
 	defer client.Close()
-	
+
 	tests := []struct {
 		name     string
 		input    []byte
 		expected *Message
 	}{
-		{}
+		{name: "Command without arguments", input: []byte("*1\n$4\nping\n"), expected: &Message{Command: "ping", Arguments: []string{}}},
+		{name: "Command with arguments", input: []byte("*3\n$4\nping\n$2\n-t\n$4\ntest\n"), expected: &Message{Command: "ping", Arguments: []string{"-t", "test"}}},
+	}
+
+	received := make(chan Message)
+	client.RegisterHandler("ping", FuncHandler{
+		Func: func(msg Message, out io.Writer) {
+			received <- msg
+		},
+	})
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			writer <- tt.input
+
+			select {
+			case got := <-received:
+				if !reflect.DeepEqual(&got, tt.expected) {
+					t.Errorf("handler got = %v, want %v", got, tt.expected)
+				}
+			case <-time.After(time.Second):
+				t.Fatal("handler was not called")
+			}
+		})
+	}
+}
+
+func TestClientStart_BackToBackMessages(t *testing.T) {
+	client := NewClient(NewBinaryMessageProtocol())
+	p := NewBinaryMessageProtocol()
+
+	client.dial = func(ctx context.Context, network, address string) (net.Conn, error) {
+		c1, c2 := net.Pipe()
+		go func() {
+			defer c2.Close()
+			// Both frames go out in a single write, as if they had arrived in one TCP segment.
+			frames := append(p.Encode(Message{Command: "ping", Arguments: []string{"1"}}), p.Encode(Message{Command: "ping", Arguments: []string{"2"}})...)
+			c2.Write(frames)
+			io.Copy(io.Discard, c2)
+		}()
+		return c1, nil
+	}
+
+	received := make(chan Message, 2)
+	client.RegisterHandler("ping", FuncHandler{
+		Func: func(msg Message, out io.Writer) {
+			received <- msg
+		},
+	})
+
+	if err := client.Start(context.Background(), "fakehost", "1234"); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	defer client.Close()
+
+	got := map[string]bool{}
+	for i := 0; i < 2; i++ {
+		select {
+		case msg := <-received:
+			got[msg.Arguments[0]] = true
+		case <-time.After(time.Second):
+			t.Fatalf("received %d of 2 messages", i)
+		}
+	}
+	if !got["1"] || !got["2"] {
+		t.Errorf("received arguments %v, want 1 and 2", got)
+	}
+}
+
+func TestClient_SendBeforeStart(t *testing.T) {
+	client := NewClient(NewBinaryMessageProtocol())
+	if client.State() != StateIdle {
+		t.Errorf("State() = %v, want %v", client.State(), StateIdle)
+	}
+	if err := client.SendMessage(Message{Command: "ping"}); !errors.Is(err, ErrNotConnected) {
+		t.Errorf("SendMessage() error = %v, want %v", err, ErrNotConnected)
+	}
+	if _, err := client.Call(context.Background(), Message{Command: "ping"}); !errors.Is(err, ErrNotConnected) {
+		t.Errorf("Call() error = %v, want %v", err, ErrNotConnected)
+	}
+}
+
+func TestClientStart_Context(t *testing.T) {
+	// The server never answers the handshake.
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	defer l.Close()
+	go func() {
+		conn, err := l.Accept()
+		if err == nil {
+			defer conn.Close()
+			io.Copy(io.Discard, conn)
+		}
+	}()
+	host, port, _ := net.SplitHostPort(l.Addr().String())
+
+	client := NewClient(NewBinaryMessageProtocol())
+	client.Handshake = true
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	if err := client.Start(ctx, host, port); !errors.Is(err, context.DeadlineExceeded) {
+		t.Errorf("Start() error = %v, want %v", err, context.DeadlineExceeded)
+	}
+	if client.State() != StateIdle {
+		t.Errorf("State() after a failed Start = %v, want %v", client.State(), StateIdle)
+	}
+
+	ctx, cancel = context.WithCancel(context.Background())
+	cancel()
+	if err := client.Start(ctx, host, port); !errors.Is(err, context.Canceled) {
+		t.Errorf("Start() with a cancelled context error = %v, want %v", err, context.Canceled)
+	}
+}
+
+func TestClient_ConnectionLost(t *testing.T) {
+	client := NewClient(NewBinaryMessageProtocol())
+	peers := make(chan net.Conn, 1)
+	client.dial = func(ctx context.Context, network, address string) (net.Conn, error) {
+		c1, c2 := net.Pipe()
+		peers <- c2
+		return c1, nil
+	}
+	if err := client.Start(context.Background(), "fakehost", "1234"); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if client.State() != StateConnected {
+		t.Errorf("State() = %v, want %v", client.State(), StateConnected)
+	}
+	peer := <-peers
+
+	// Nobody reads the other end, so the write cannot finish.
+	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Millisecond)
+	defer cancel()
+	if err := client.Send(ctx, Message{Command: "ping"}); !errors.Is(err, context.DeadlineExceeded) {
+		t.Errorf("Send() error = %v, want %v", err, context.DeadlineExceeded)
+	}
+
+	peer.Close()
+	deadline := time.Now().Add(5 * time.Second)
+	for client.State() != StateClosed && time.Now().Before(deadline) {
+		time.Sleep(time.Millisecond)
+	}
+	if client.State() != StateClosed {
+		t.Fatalf("State() = %v, want %v", client.State(), StateClosed)
+	}
+	if err := client.SendMessage(Message{Command: "ping"}); !errors.Is(err, ErrConnectionClosed) {
+		t.Errorf("SendMessage() error = %v, want %v", err, ErrConnectionClosed)
+	}
+}
+
+func TestClientShutdown(t *testing.T) {
+	client := NewClient(NewBinaryMessageProtocol())
+	peers := make(chan net.Conn, 1)
+	client.dial = func(ctx context.Context, network, address string) (net.Conn, error) {
+		c1, c2 := net.Pipe()
+		peers <- c2
+		return c1, nil
+	}
+	handled := make(chan struct{})
+	client.RegisterHandler("slow", FuncHandler{
+		Func: func(msg Message, out io.Writer) {
+			time.Sleep(50 * time.Millisecond)
+			close(handled)
+		},
+	})
+	if err := client.Start(context.Background(), "fakehost", "1234"); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	peer := <-peers
+	peer.Write(NewBinaryMessageProtocol().Encode(Message{Command: "slow"}))
+
+	// The peer does not read yet, so the message stays queued.
+	sent := make(chan error, 1)
+	go func() {
+		sent <- client.SendMessage(Message{Command: "queued"})
+	}()
+	time.Sleep(10 * time.Millisecond)
+
+	shutdown := make(chan error, 1)
+	go func() {
+		shutdown <- client.Shutdown(context.Background())
+	}()
+	got, err := NewDecoder(peer).Next()
+	if err != nil || got.Command != "queued" {
+		t.Fatalf("peer read %+v, %v, want the queued message", got, err)
 	}
+	if err := <-sent; err != nil {
+		t.Errorf("SendMessage() of the queued message error = %v", err)
+	}
+
+	if err := <-shutdown; err != nil {
+		t.Errorf("Shutdown() error = %v", err)
+	}
+	select {
+	case <-handled:
+	default:
+		t.Errorf("Shutdown() returned before the handler")
+	}
+	if client.State() != StateClosed {
+		t.Errorf("State() = %v, want %v", client.State(), StateClosed)
+	}
+	if err := client.SendMessage(Message{Command: "late"}); !errors.Is(err, ErrClientClosed) {
+		t.Errorf("SendMessage() after Shutdown error = %v, want %v", err, ErrClientClosed)
+	}
+	if err := client.Start(context.Background(), "fakehost", "1234"); !errors.Is(err, ErrClientClosed) {
+		t.Errorf("Start() after Shutdown error = %v, want %v", err, ErrClientClosed)
+	}
+}
+
+func TestClientShutdown_Deadline(t *testing.T) {
+	client := NewClient(NewBinaryMessageProtocol())
+	client.dial = func(ctx context.Context, network, address string) (net.Conn, error) {
+		c1, c2 := net.Pipe()
+		go func() {
+			c2.Write(NewBinaryMessageProtocol().Encode(Message{Command: "stuck"}))
+			io.Copy(io.Discard, c2)
+		}()
+		return c1, nil
+	}
+	started, release := make(chan struct{}), make(chan struct{})
+	defer close(release)
+	client.RegisterHandler("stuck", FuncHandler{
+		Func: func(msg Message, out io.Writer) {
+			close(started)
+			<-release
+		},
+	})
+	if err := client.Start(context.Background(), "fakehost", "1234"); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	<-started
+
+	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Millisecond)
+	defer cancel()
+	if err := client.Shutdown(ctx); !errors.Is(err, context.DeadlineExceeded) {
+		t.Errorf("Shutdown() error = %v, want %v", err, context.DeadlineExceeded)
+	}
+	if client.State() != StateClosed {
+		t.Errorf("State() = %v, want %v", client.State(), StateClosed)
+	}
+}
+
+func TestClientClose_StopsReconnecting(t *testing.T) {
+	client := NewClient(NewBinaryMessageProtocol())
+	client.Reconnect = &ReconnectPolicy{InitialDelay: time.Hour}
+	client.dial = func(ctx context.Context, network, address string) (net.Conn, error) {
+		c1, c2 := net.Pipe()
+		c2.Close()
+		return c1, nil
+	}
+	if err := client.Start(context.Background(), "fakehost", "1234"); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	closed := make(chan error, 1)
+	go func() {
+		closed <- client.Close()
+	}()
+	select {
+	case err := <-closed:
+		if err != nil {
+			t.Errorf("Close() error = %v", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("Close() waited for the reconnect")
+	}
+	if client.State() != StateClosed {
+		t.Errorf("State() = %v, want %v", client.State(), StateClosed)
+	}
+	if err := client.Close(); err != nil {
+		t.Errorf("second Close() error = %v", err)
+	}
+}
+
+// pipeClient starts a client on one end of a net.Pipe and returns the other.
+func pipeClient(t *testing.T, client *Client) net.Conn {
+	t.Helper()
+	peers := make(chan net.Conn, 1)
+	client.dial = func(ctx context.Context, network, address string) (net.Conn, error) {
+		c1, c2 := net.Pipe()
+		peers <- c2
+		return c1, nil
+	}
+	if err := client.Start(context.Background(), "fakehost", "1234"); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	return <-peers
+}
 
+func TestClient_Hooks(t *testing.T) {
+	client := NewClient(NewBinaryMessageProtocol())
+	connected := make(chan *Client, 1)
+	disconnected := make(chan error, 1)
+	errs := make(chan error, 1)
+	client.OnConnect = func(c *Client) { connected <- c }
+	client.OnDisconnect = func(c *Client, err error) { disconnected <- err }
+	client.OnError = func(c *Client, err error) { errs <- err }
+	peer := pipeClient(t, client)
 
+	if got := <-connected; got != client {
+		t.Errorf("OnConnect() got %p, want the client", got)
+	}
+	peer.Close()
+
+	err := <-disconnected
+	var netErr *NetError
+	if !errors.As(err, &netErr) || netErr.Op != "read" || !errors.Is(err, io.EOF) {
+		t.Errorf("OnDisconnect() error = %v, want a *NetError reading io.EOF", err)
+	}
+	if got := <-errs; got != err {
+		t.Errorf("OnError() error = %v, want %v", got, err)
+	}
+}
+
+func TestClient_HooksAfterClose(t *testing.T) {
+	client := NewClient(NewBinaryMessageProtocol())
+	disconnected := make(chan error, 1)
+	client.OnDisconnect = func(c *Client, err error) { disconnected <- err }
+	client.OnError = func(c *Client, err error) { t.Errorf("OnError() called with %v", err) }
+	pipeClient(t, client)
+
+	client.Close()
+	if err := <-disconnected; err != nil {
+		t.Errorf("OnDisconnect() after Close error = %v, want nil", err)
+	}
+}
+
+func TestClient_DecodeError(t *testing.T) {
+	client := NewClient(NewBinaryMessageProtocol())
+	disconnected := make(chan error, 1)
+	client.OnDisconnect = func(c *Client, err error) { disconnected <- err }
+	peer := pipeClient(t, client)
+	defer client.Close()
+
+	peer.Write([]byte("*x\n"))
+	err := <-disconnected
+	var decodeErr *DecodeError
+	var netErr *NetError
+	if !errors.As(err, &decodeErr) || errors.As(err, &netErr) {
+		t.Errorf("OnDisconnect() error = %v, want a *DecodeError", err)
+	}
+}
+
+func TestClient_SkipDecodeError(t *testing.T) {
+	client := NewClient(NewJSONLinesProtocol())
+	errs := make(chan error, 1)
+	client.OnError = func(c *Client, err error) { errs <- err }
+	client.SkipDecodeError = func(err *DecodeError) bool { return true }
+	received := make(chan Message, 1)
+	client.RegisterHandler("ping", FuncHandler{
+		Func: func(msg Message, out io.Writer) { received <- msg },
+	})
+	peer := pipeClient(t, client)
+	defer client.Close()
+
+	peer.Write([]byte("not json\n" + `{"command":"ping"}` + "\n"))
+	var decodeErr *DecodeError
+	if err := <-errs; !errors.As(err, &decodeErr) {
+		t.Errorf("OnError() error = %v, want a *DecodeError", err)
+	}
+	select {
+	case msg := <-received:
+		if msg.Command != "ping" {
+			t.Errorf("handler got %+v", msg)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("the message after the bad frame was not handled")
+	}
+}
+
+func TestClient_WriteError(t *testing.T) {
+	client := NewClient(NewBinaryMessageProtocol())
+	disconnected := make(chan error, 1)
+	client.OnDisconnect = func(c *Client, err error) { disconnected <- err }
+	peer := pipeClient(t, client)
+	defer client.Close()
+
+	// Reading from a net.Pipe whose far end is closed fails too, so the
+	// write is made to fail on its own.
+	client.link.conn.SetWriteDeadline(time.Now())
+	err := client.SendMessage(Message{Command: "ping"})
+	var netErr *NetError
+	if !errors.As(err, &netErr) || netErr.Op != "write" {
+		t.Errorf("SendMessage() error = %v, want a *NetError writing", err)
+	}
+	if got := <-disconnected; got != err {
+		t.Errorf("OnDisconnect() error = %v, want %v", got, err)
+	}
+	peer.Close()
 }
 
 // func TestClientHandler(t *testing.T) {
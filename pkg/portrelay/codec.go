@@ -0,0 +1,115 @@
+package portrelay
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"sync"
+)
+
+// Decoder reads consecutive messages from a stream. Unlike calling
+// MessageProtocol.Decode on the stream directly, it keeps its read buffer
+// between messages, so bytes that arrive together with one message are
+// still there when the next one is decoded.
+type Decoder struct {
+	protocol MessageProtocol
+	buf      *bufio.Reader
+}
+
+// NewDecoder returns a Decoder reading BinaryMessageProtocol frames from r.
+func NewDecoder(r io.Reader) *Decoder {
+	return NewProtocolDecoder(NewBinaryMessageProtocol(), r)
+}
+
+// NewProtocolDecoder returns a Decoder reading frames of the given protocol from r.
+func NewProtocolDecoder(protocol MessageProtocol, r io.Reader) *Decoder {
+	buf, ok := r.(*bufio.Reader)
+	if !ok {
+		buf = bufio.NewReader(r)
+	}
+	return &Decoder{protocol: protocol, buf: buf}
+}
+
+// Next decodes the next message from the stream.
+func (d *Decoder) Next() (*Message, error) {
+	return d.protocol.Decode(d.buf)
+}
+
+// Buffered returns the number of bytes already read from the stream but not yet decoded.
+func (d *Decoder) Buffered() int {
+	return d.buf.Buffered()
+}
+
+// Encoder writes messages to a stream, one frame per Encode call or a
+// batch of frames per EncodeBatch call.
+type Encoder struct {
+	protocol MessageProtocol
+	w        io.Writer
+}
+
+// NewEncoder returns an Encoder writing BinaryMessageProtocol frames to w.
+func NewEncoder(w io.Writer) *Encoder {
+	return NewProtocolEncoder(NewBinaryMessageProtocol(), w)
+}
+
+// NewProtocolEncoder returns an Encoder writing frames of the given protocol to w.
+func NewProtocolEncoder(protocol MessageProtocol, w io.Writer) *Encoder {
+	return &Encoder{protocol: protocol, w: w}
+}
+
+// Encode writes msg as a single frame.
+func (e *Encoder) Encode(msg Message) error {
+	return EncodeTo(e.protocol, e.w, msg)
+}
+
+// EncodeBatch writes msgs as consecutive frames with a single Write. If any
+// of them cannot be encoded, nothing is written.
+func (e *Encoder) EncodeBatch(msgs []Message) error {
+	return writeFrames(e.w, e.protocol, msgs)
+}
+
+var frameBuffers = sync.Pool{
+	New: func() any { return new([]byte) },
+}
+
+// writeFrame encodes message into a pooled buffer and writes it to w with
+// a single Write, so concurrent writers never interleave partial frames.
+func writeFrame(w io.Writer, p MessageProtocol, message Message) error {
+	buf := frameBuffers.Get().(*[]byte)
+	defer func() {
+		// Keep the occasional huge frame from pinning its memory.
+		if cap(*buf) <= 64<<10 {
+			frameBuffers.Put(buf)
+		}
+	}()
+
+	frame, err := AppendEncode(p, (*buf)[:0], message)
+	*buf = frame
+	if err != nil {
+		return err
+	}
+	_, err = w.Write(frame)
+	return err
+}
+
+// writeFrames is writeFrame for several messages at once.
+func writeFrames(w io.Writer, p MessageProtocol, messages []Message) error {
+	buf := frameBuffers.Get().(*[]byte)
+	defer func() {
+		if cap(*buf) <= 64<<10 {
+			frameBuffers.Put(buf)
+		}
+	}()
+
+	frames := (*buf)[:0]
+	for i, message := range messages {
+		var err error
+		frames, err = AppendEncode(p, frames, message)
+		*buf = frames
+		if err != nil {
+			return fmt.Errorf("message %d of the batch: %w", i, err)
+		}
+	}
+	_, err := w.Write(frames)
+	return err
+}
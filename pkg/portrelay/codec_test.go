@@ -0,0 +1,92 @@
+package portrelay
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"reflect"
+	"testing"
+)
+
+func TestDecoder_BackToBackMessages(t *testing.T) {
+	expected := []*Message{
+		{Command: "first", Arguments: []string{"a"}},
+		{Command: "second", Arguments: []string{}},
+		{Command: "third", Arguments: []string{"b", "c"}},
+	}
+
+	p := NewBinaryMessageProtocol()
+	var stream bytes.Buffer
+	for _, msg := range expected {
+		stream.Write(p.Encode(*msg))
+	}
+
+	dec := NewDecoder(&stream)
+	for i, want := range expected {
+		got, err := dec.Next()
+		if err != nil {
+			t.Fatalf("Next() #%d: unexpected error: %v", i, err)
+		}
+		if !reflect.DeepEqual(got, want) {
+			t.Errorf("Next() #%d got = %v, want %v", i, got, want)
+		}
+	}
+
+	if _, err := dec.Next(); !errors.Is(err, io.EOF) {
+		t.Errorf("Next() after last message: error = %v, want %v", err, io.EOF)
+	}
+}
+
+func TestDecoder_Buffered(t *testing.T) {
+	p := NewBinaryMessageProtocol()
+	first := p.Encode(Message{Command: "first"})
+	second := p.Encode(Message{Command: "second"})
+
+	dec := NewDecoder(bytes.NewReader(append(first, second...)))
+	if _, err := dec.Next(); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if dec.Buffered() != len(second) {
+		t.Errorf("Buffered() = %d, want %d", dec.Buffered(), len(second))
+	}
+}
+
+func TestEncoder_Encode(t *testing.T) {
+	var out bytes.Buffer
+	enc := NewEncoder(&out)
+
+	if err := enc.Encode(Message{Command: "TestCommand", Arguments: []string{"-t"}}); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if err := enc.Encode(Message{Command: "Next"}); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	expected := "*2\n$11\nTestCommand\n$2\n-t\n*1\n$4\nNext\n"
+	if out.String() != expected {
+		t.Errorf("Encode() wrote %q, want %q", out.String(), expected)
+	}
+}
+
+func TestEncoder_ProtocolWithoutFrameEncoder(t *testing.T) {
+	p := legacyProtocol{NewBinaryMessageProtocol()}
+	msg := Message{Command: "ping", Arguments: []string{"a"}}
+
+	var buf bytes.Buffer
+	if err := NewProtocolEncoder(p, &buf).EncodeBatch([]Message{msg, msg}); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	want := string(p.Encode(msg)) + string(p.Encode(msg))
+	if buf.String() != want {
+		t.Errorf("EncodeBatch() wrote %q, want %q", buf.String(), want)
+	}
+
+	// Encode reports a message it cannot encode only by returning nil.
+	buf.Reset()
+	p = legacyProtocol{&BinaryMessageProtocol{Limits: DecodeLimits{MaxArgs: 1}}}
+	err := NewProtocolEncoder(p, &buf).Encode(msg)
+	var encodeErr *EncodeError
+	if !errors.As(err, &encodeErr) || !errors.Is(err, ErrNotEncodable) || buf.Len() != 0 {
+		t.Errorf("Encode() error = %v and wrote %q, want an *EncodeError and nothing", err, buf.String())
+	}
+}
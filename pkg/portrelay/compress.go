@@ -0,0 +1,196 @@
+package portrelay
+
+import (
+	"bufio"
+	"bytes"
+	"compress/flate"
+	"fmt"
+	"io"
+	"math"
+	"strconv"
+	"strings"
+)
+
+// CapCompression allows frames to be sent compressed by CompressedProtocol.
+const CapCompression Capability = "compression"
+
+// StageDecompress is the DecodeError stage reported when a compressed frame cannot be inflated.
+const StageDecompress = "decompress frame"
+
+// FORMAT
+// CompressedProtocol: frames of the wrapped protocol are sent unchanged, or as
+// "~<number of compressed bytes>\n<deflate data>\n" when compressing made them smaller.
+//
+// CompressedProtocol keeps the name and version of the protocol it wraps;
+// whether compression may be used is negotiated with CapCompression.
+type CompressedProtocol struct {
+	Inner MessageProtocol
+	// Threshold is the smallest encoded frame, in bytes, that gets compressed.
+	Threshold int
+	// Level is the compress/flate level used for compressed frames.
+	Level int
+	// MaxFrameSize bounds both the compressed and the inflated size of a
+	// frame. Zero means no limit.
+	MaxFrameSize int
+}
+
+func NewCompressedProtocol(inner MessageProtocol, threshold int) *CompressedProtocol {
+	return &CompressedProtocol{
+		Inner:        inner,
+		Threshold:    threshold,
+		Level:        flate.DefaultCompression,
+		MaxFrameSize: DefaultDecodeLimits.MaxFrameSize,
+	}
+}
+
+func (p *CompressedProtocol) Name() string {
+	return ProtocolName(p.Inner)
+}
+
+func (p *CompressedProtocol) Version() int {
+	return ProtocolVersion(p.Inner)
+}
+
+// Encode returns the frame of message, or nil when it cannot be encoded.
+// AppendEncode and EncodeTo report why.
+func (p *CompressedProtocol) Encode(message Message) []byte {
+	frame, err := p.AppendEncode(nil, message)
+	if err != nil {
+		return nil
+	}
+	return frame
+}
+
+// AppendEncode appends the frame of message to dst, compressed when that
+// makes it smaller. Errors of the wrapped protocol are returned unchanged.
+func (p *CompressedProtocol) AppendEncode(dst []byte, message Message) ([]byte, error) {
+	start := len(dst)
+	dst, err := AppendEncode(p.Inner, dst, message)
+	if err != nil {
+		return dst, err
+	}
+	frame := dst[start:]
+	if len(frame) < p.Threshold {
+		return dst, nil
+	}
+
+	var compressed bytes.Buffer
+	w, err := flate.NewWriter(&compressed, p.Level)
+	if err != nil {
+		// Only an invalid Level gets here; the frame still goes out.
+		return dst, nil
+	}
+	w.Write(frame)
+	w.Close()
+
+	if compressed.Len() >= len(frame) {
+		return dst, nil
+	}
+
+	dst = append(dst[:start], '~')
+	dst = strconv.AppendInt(dst, int64(compressed.Len()), 10)
+	dst = append(dst, '\n')
+	dst = append(dst, compressed.Bytes()...)
+	return append(dst, '\n'), nil
+}
+
+// EncodeTo writes the frame of message to w in a single Write.
+func (p *CompressedProtocol) EncodeTo(w io.Writer, message Message) error {
+	return writeFrame(w, p, message)
+}
+
+func (p *CompressedProtocol) Decode(reader io.Reader) (*Message, error) {
+	buf, ok := reader.(*bufio.Reader)
+	if !ok {
+		buf = bufio.NewReader(reader)
+	}
+
+	marker, err := buf.Peek(1)
+	if err != nil || marker[0] != '~' {
+		// Not compressed, or nothing to read: the wrapped protocol reports it.
+		return p.Inner.Decode(buf)
+	}
+
+	r := &frameReader{buf: buf, limits: DecodeLimits{
+		MaxFrameSize:  p.MaxFrameSize,
+		MaxLineLength: DefaultDecodeLimits.MaxLineLength,
+	}}
+	line, err := r.readLine("read compressed frame header", -1, "could not read '~<length>' line")
+	if err != nil {
+		return nil, err
+	}
+
+	var size int
+	if _, err := fmt.Sscanf(line, "~%d\n", &size); err != nil || size < 0 {
+		if err == nil {
+			err = fmt.Errorf("invalid format")
+		}
+		return nil, &DecodeError{
+			Stage:   "parse compressed frame header",
+			Index:   -1,
+			Details: fmt.Sprintf("invalid line: %q", strings.TrimSpace(line)),
+			Err:     err,
+		}
+	}
+	// Checked before size+1 is taken, which could overflow.
+	limit := p.MaxFrameSize
+	if limit <= 0 {
+		limit = math.MaxInt - 1
+	}
+	if size > limit {
+		return nil, exceeded(-1, "compressed frame of %d bytes exceeds %d", size, limit)
+	}
+	if err := r.grow(-1, size+1); err != nil {
+		return nil, err
+	}
+
+	data := make([]byte, size+1)
+	if n, err := io.ReadFull(buf, data); err != nil {
+		return nil, &DecodeError{
+			Stage:   "read compressed data",
+			Index:   -1,
+			Details: fmt.Sprintf("expected %d bytes, got %d", size+1, n),
+			Err:     err,
+		}
+	}
+	if data[size] != '\n' {
+		return nil, &DecodeError{
+			Stage:   "validate newline after data",
+			Index:   -1,
+			Details: fmt.Sprintf("expected newline, got %q", data[size]),
+			Err:     fmt.Errorf("invalid format"),
+		}
+	}
+
+	inflater := flate.NewReader(bytes.NewReader(data[:size]))
+	defer inflater.Close()
+
+	var src io.Reader = inflater
+	if p.MaxFrameSize > 0 {
+		src = io.LimitReader(inflater, int64(p.MaxFrameSize)+1)
+	}
+	frame, err := io.ReadAll(src)
+	if err != nil {
+		return nil, &DecodeError{
+			Stage:   StageDecompress,
+			Index:   -1,
+			Details: fmt.Sprintf("inflating %d bytes", size),
+			Err:     err,
+		}
+	}
+	if p.MaxFrameSize > 0 && len(frame) > p.MaxFrameSize {
+		return nil, exceeded(-1, "inflated frame larger than %d bytes", p.MaxFrameSize)
+	}
+
+	return p.Inner.Decode(bytes.NewReader(frame))
+}
+
+// encodingProtocol returns the protocol to encode with on a connection.
+// Compression is dropped when a handshake took place and the peer did not
+// agree to it; decoding always accepts both forms.
+func encodingProtocol(p MessageProtocol, handshake bool, caps Capabilities) MessageProtocol {
+	if cp, ok := p.(*CompressedProtocol); ok && handshake && !caps.Has(CapCompression) {
+		return cp.Inner
+	}
+	return p
+}
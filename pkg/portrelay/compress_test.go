@@ -0,0 +1,176 @@
+package portrelay
+
+import (
+	"bytes"
+	"compress/flate"
+	"context"
+	"crypto/rand"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestCompressedProtocol_RoundTrip(t *testing.T) {
+	random := make([]byte, 4096)
+	rand.Read(random)
+
+	tests := []struct {
+		name           string
+		message        *Message
+		wantCompressed bool
+	}{
+		{name: "Below threshold", message: &Message{Command: "small", Arguments: []string{"a"}}, wantCompressed: false},
+		{name: "Compressible", message: &Message{Command: "log", Arguments: []string{strings.Repeat("line of log output\n", 200)}}, wantCompressed: true},
+		{name: "Incompressible", message: &Message{Command: "blob", Arguments: []string{string(random)}}, wantCompressed: false},
+		{name: "With id", message: &Message{Command: "log", Arguments: []string{strings.Repeat("x", 1000)}, ID: 7}, wantCompressed: true},
+	}
+
+	p := NewCompressedProtocol(NewBinaryMessageProtocol(), 256)
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			encoded := p.Encode(*tt.message)
+			if compressed := encoded[0] == '~'; compressed != tt.wantCompressed {
+				t.Errorf("Encode() compressed = %v, want %v", compressed, tt.wantCompressed)
+			}
+			if !tt.wantCompressed && !bytes.Equal(encoded, p.Inner.(*BinaryMessageProtocol).Encode(*tt.message)) {
+				t.Errorf("Encode() changed a frame it did not compress")
+			}
+
+			got, err := p.Decode(bytes.NewReader(encoded))
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			if !reflect.DeepEqual(got, tt.message) {
+				t.Errorf("Decode() got = %v, want %v", got, tt.message)
+			}
+		})
+	}
+}
+
+func TestCompressedProtocol_DecodeErrors(t *testing.T) {
+	var bomb bytes.Buffer
+	w, _ := flate.NewWriter(&bomb, flate.BestCompression)
+	w.Write(NewBinaryMessageProtocol().Encode(Message{Command: "bomb", Arguments: []string{strings.Repeat("0", 1<<20)}}))
+	w.Close()
+
+	tests := []struct {
+		name      string
+		input     string
+		wantStage string
+	}{
+		{name: "Corrupt data", input: "~4\n\xff\xff\xff\xff\n", wantStage: StageDecompress},
+		{name: "Invalid header", input: "~abc\n", wantStage: "parse compressed frame header"},
+		{name: "Truncated data", input: "~10\nabc", wantStage: "read compressed data"},
+		{name: "Missing newline", input: "~1\nab", wantStage: "validate newline after data"},
+		{name: "Size beyond limit", input: "~9223372036854775807\n", wantStage: StageLimitExceeded},
+		{name: "Inflates beyond limit", input: fmt.Sprintf("~%d\n%s\n", bomb.Len(), bomb.String()), wantStage: StageLimitExceeded},
+	}
+
+	p := NewCompressedProtocol(NewBinaryMessageProtocol(), 0)
+	p.MaxFrameSize = 64 << 10
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := p.Decode(strings.NewReader(tt.input))
+			var decodeErr *DecodeError
+			if !errors.As(err, &decodeErr) || decodeErr.Stage != tt.wantStage {
+				t.Errorf("Decode() error = %v, want stage %q", err, tt.wantStage)
+			}
+		})
+	}
+}
+
+// recordingConn remembers the first byte of every write.
+type recordingConn struct {
+	net.Conn
+	firstBytes chan byte
+}
+
+func (c recordingConn) Write(p []byte) (int, error) {
+	if len(p) > 0 {
+		select {
+		case c.firstBytes <- p[0]:
+		default:
+		}
+	}
+	return c.Conn.Write(p)
+}
+
+func TestCompressedProtocol_Negotiation(t *testing.T) {
+	large := Message{Command: "echo", Arguments: []string{strings.Repeat("compress me ", 100)}}
+
+	tests := []struct {
+		name           string
+		server         MessageProtocol
+		wantCompressed bool
+	}{
+		{name: "Both peers compress", server: NewCompressedProtocol(NewBinaryMessageProtocol(), 64), wantCompressed: true},
+		{name: "Server without compression", server: NewBinaryMessageProtocol(), wantCompressed: false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			host, port, _ := startHandshakeServer(t, tt.server, nil)
+
+			client := NewClient(NewCompressedProtocol(NewBinaryMessageProtocol(), 64))
+			client.Handshake = true
+			firstBytes := make(chan byte, 16)
+			client.dial = func(ctx context.Context, network, address string) (net.Conn, error) {
+				c, err := net.Dial(network, address)
+				return recordingConn{Conn: c, firstBytes: firstBytes}, err
+			}
+			if err := client.Start(context.Background(), host, port); err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			defer client.Close()
+			<-firstBytes // the hello
+
+			if got := client.Negotiated().Has(CapCompression); got != tt.wantCompressed {
+				t.Errorf("Negotiated() has compression = %v, want %v", got, tt.wantCompressed)
+			}
+
+			resp, err := client.Call(context.Background(), large)
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			if !reflect.DeepEqual(resp.Arguments, large.Arguments) {
+				t.Errorf("Call() returned different arguments")
+			}
+			if compressed := <-firstBytes == '~'; compressed != tt.wantCompressed {
+				t.Errorf("request sent compressed = %v, want %v", compressed, tt.wantCompressed)
+			}
+		})
+	}
+}
+
+func TestCompressedProtocol_Decoder(t *testing.T) {
+	p := NewCompressedProtocol(NewBinaryMessageProtocol(), 64)
+	messages := []Message{
+		{Command: "a", Arguments: []string{strings.Repeat("a", 500)}},
+		{Command: "b", Arguments: []string{}},
+		{Command: "c", Arguments: []string{strings.Repeat("c", 500)}},
+	}
+
+	var stream bytes.Buffer
+	enc := NewProtocolEncoder(p, &stream)
+	for _, msg := range messages {
+		enc.Encode(msg)
+	}
+
+	dec := NewProtocolDecoder(p, &stream)
+	for _, want := range messages {
+		got, err := dec.Next()
+		if err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		if !reflect.DeepEqual(*got, want) {
+			t.Errorf("Next() got command %q, want %q", got.Command, want.Command)
+		}
+	}
+	if _, err := dec.Next(); !errors.Is(err, io.EOF) {
+		t.Errorf("Next() error = %v, want %v", err, io.EOF)
+	}
+}
@@ -0,0 +1,378 @@
+// Package conformance checks MessageProtocol implementations against the
+// behaviour the rest of portrelay relies on, and ships test vectors that
+// pin down the BinaryMessageProtocol wire format byte for byte.
+//
+// A codec's own test file only needs:
+//
+//	func TestConformance(t *testing.T) {
+//		conformance.Run(t, func() portrelay.MessageProtocol { return NewMyProtocol() }, conformance.Options{})
+//	}
+//
+//	func FuzzDecode(f *testing.F) {
+//		conformance.Fuzz(f, func() portrelay.MessageProtocol { return NewMyProtocol() })
+//	}
+package conformance
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"math"
+	"math/rand"
+	"reflect"
+	"strings"
+	"testing"
+	"unicode/utf8"
+
+	"github.com/tartancz/golangMyPackages/pkg/portrelay"
+)
+
+// Options adjusts the suite for codecs that cannot carry everything.
+type Options struct {
+	// TextOnly skips messages that are not valid UTF-8.
+	TextOnly bool
+	// NoIDs skips messages with an ID or ReplyTo, for wire formats that
+	// cannot carry them.
+	NoIDs bool
+	// NoHeaders skips messages with headers, for wire formats that cannot
+	// carry them.
+	NoHeaders bool
+	// FoldCase compares commands case-insensitively, for wire formats
+	// that lowercase the commands they decode.
+	FoldCase bool
+}
+
+// equal is Equal, with commands compared as opts asks.
+func (opts Options) equal(got, want portrelay.Message) bool {
+	if opts.FoldCase && strings.EqualFold(got.Command, want.Command) {
+		got.Command = want.Command
+	}
+	return Equal(got, want)
+}
+
+// Messages returns the messages every check is run with.
+func Messages() []portrelay.Message {
+	allBytes := make([]byte, 256)
+	for i := range allBytes {
+		allBytes[i] = byte(i)
+	}
+
+	return []portrelay.Message{
+		{Command: "TestCommand"},
+		{Command: "TestCommand", Arguments: []string{"-t", "TestArgument"}},
+		{Command: "Test Command", Arguments: []string{"arg 1", "arg 2"}},
+		{Command: ""},
+		{Command: "TestCommand", Arguments: []string{""}},
+		{Command: "TestCommand", Arguments: []string{"", "", ""}},
+		{Command: "TestCommand", Arguments: []string{"line\nbreak", "crlf\r\n", "*1\n$3\nfoo\n", `{"command":"x"}`}},
+		{Command: "unicode", Arguments: []string{"žluťoučký kůň", "🚀"}},
+		{Command: "TestCommand", ID: 42},
+		{Command: "TestCommand", Arguments: []string{"reply"}, ID: 43, ReplyTo: 42},
+		{Command: "binary", Arguments: []string{"nul\x00byte", string(allBytes)}},
+		{Command: "large", Arguments: []string{strings.Repeat("0123456789", 10000)}},
+		{Command: "headers", Arguments: []string{"x"}, Headers: map[string]string{
+			portrelay.HeaderTraceID:     "4bf92f3577b34da6",
+			portrelay.HeaderContentType: "text/plain; charset=utf-8",
+			"x-empty":                   "",
+		}},
+	}
+}
+
+// Run runs every conformance check against protocols made by newProtocol.
+func Run(t *testing.T, newProtocol func() portrelay.MessageProtocol, opts Options) {
+	messages := Messages()
+	if opts.TextOnly {
+		messages = textOnly(messages)
+	}
+	if opts.NoIDs {
+		messages = without(messages, func(msg portrelay.Message) bool { return msg.ID != 0 || msg.ReplyTo != 0 })
+	}
+	if opts.NoHeaders {
+		messages = without(messages, func(msg portrelay.Message) bool { return msg.Headers != nil })
+	}
+
+	t.Run("RoundTrip", func(t *testing.T) { checkRoundTrip(t, newProtocol(), messages, opts) })
+	t.Run("Stream", func(t *testing.T) { checkStream(t, newProtocol(), messages, opts) })
+	t.Run("Append", func(t *testing.T) { checkAppend(t, newProtocol(), messages) })
+	t.Run("Truncation", func(t *testing.T) { checkTruncation(t, newProtocol(), messages) })
+	t.Run("Garbage", func(t *testing.T) { checkGarbage(t, newProtocol()) })
+	t.Run("Identity", func(t *testing.T) { checkIdentity(t, newProtocol()) })
+}
+
+func checkRoundTrip(t *testing.T, p portrelay.MessageProtocol, messages []portrelay.Message, opts Options) {
+	for _, msg := range messages {
+		got, err := p.Decode(bytes.NewReader(encode(t, p, msg)))
+		if err != nil {
+			t.Errorf("%s: Decode(Encode()) error = %v", describe(msg), err)
+			continue
+		}
+		if !opts.equal(*got, msg) {
+			t.Errorf("%s: Decode(Encode()) = %+v, want %+v", describe(msg), *got, msg)
+		}
+	}
+}
+
+// checkStream decodes all messages from one stream, as a connection would.
+func checkStream(t *testing.T, p portrelay.MessageProtocol, messages []portrelay.Message, opts Options) {
+	var stream bytes.Buffer
+	for _, msg := range messages {
+		if err := portrelay.EncodeTo(p, &stream, msg); err != nil {
+			t.Fatalf("%s: EncodeTo() error = %v", describe(msg), err)
+		}
+	}
+
+	dec := portrelay.NewProtocolDecoder(p, &stream)
+	for _, msg := range messages {
+		got, err := dec.Next()
+		if err != nil {
+			t.Fatalf("%s: Next() error = %v", describe(msg), err)
+		}
+		if !opts.equal(*got, msg) {
+			t.Errorf("%s: Next() = %+v, want %+v", describe(msg), *got, msg)
+		}
+	}
+	if _, err := dec.Next(); !errors.Is(err, io.EOF) {
+		t.Errorf("Next() at end of stream error = %v, want io.EOF", err)
+	}
+}
+
+// checkAppend makes sure AppendEncode keeps what dst already holds and
+// that EncodeTo writes the same bytes in a single Write.
+func checkAppend(t *testing.T, p portrelay.MessageProtocol, messages []portrelay.Message) {
+	for _, msg := range messages {
+		frame := encode(t, p, msg)
+
+		prefix := []byte("prefix")
+		got, err := portrelay.AppendEncode(p, prefix, msg)
+		if err != nil {
+			t.Fatalf("%s: AppendEncode() error = %v", describe(msg), err)
+		}
+		if !bytes.HasPrefix(got, prefix) || !bytes.Equal(got[len(prefix):], frame) {
+			t.Errorf("%s: AppendEncode(%q) = %q, want the prefix followed by %q", describe(msg), prefix, got, frame)
+		}
+
+		w := &countingWriter{}
+		if err := portrelay.EncodeTo(p, w, msg); err != nil {
+			t.Fatalf("%s: EncodeTo() error = %v", describe(msg), err)
+		}
+		if !bytes.Equal(w.buf.Bytes(), frame) {
+			t.Errorf("%s: EncodeTo() wrote %q, want %q", describe(msg), w.buf.Bytes(), frame)
+		}
+		if w.writes != 1 {
+			t.Errorf("%s: EncodeTo() made %d writes, want 1", describe(msg), w.writes)
+		}
+	}
+}
+
+type countingWriter struct {
+	buf    bytes.Buffer
+	writes int
+}
+
+func (w *countingWriter) Write(p []byte) (int, error) {
+	w.writes++
+	return w.buf.Write(p)
+}
+
+// checkTruncation makes sure that every proper prefix of a frame is
+// rejected with a *DecodeError instead of being decoded or panicking.
+func checkTruncation(t *testing.T, p portrelay.MessageProtocol, messages []portrelay.Message) {
+	for _, msg := range messages {
+		frame := encode(t, p, msg)
+		if len(frame) > 4096 {
+			continue
+		}
+		for n := 0; n < len(frame); n++ {
+			got, err := decode(p, frame[:n])
+			if err == nil {
+				t.Errorf("%s: Decode() of first %d of %d bytes = %+v, want error", describe(msg), n, len(frame), *got)
+				break
+			}
+			if !isDecodeError(err) {
+				t.Errorf("%s: Decode() of first %d bytes error = %v, want *DecodeError", describe(msg), n, err)
+				break
+			}
+		}
+	}
+}
+
+// checkGarbage feeds random and hostile input to Decode. It may decode
+// something, but it must not panic and must only fail with *DecodeError.
+func checkGarbage(t *testing.T, p portrelay.MessageProtocol) {
+	inputs := []string{
+		"Invalid Input",
+		"\n\n\n",
+		"*-1\n",
+		"*0\n",
+		"*99999999999999999999\n",
+		"*1\n$-1\n",
+		"*1\n$99999999999\n",
+		"{\"command\":",
+		"~5\nabcde\n",
+		"~9223372036854775807\n",
+		"\x00\x00\x00\x00",
+	}
+	rng := rand.New(rand.NewSource(1))
+	for i := 0; i < 200; i++ {
+		data := make([]byte, rng.Intn(64))
+		rng.Read(data)
+		inputs = append(inputs, string(data))
+	}
+
+	for _, input := range inputs {
+		if _, err := decode(p, []byte(input)); err != nil && !isDecodeError(err) {
+			t.Errorf("Decode(%q) error = %v, want *DecodeError", input, err)
+		}
+	}
+}
+
+func checkIdentity(t *testing.T, p portrelay.MessageProtocol) {
+	v, ok := p.(portrelay.VersionedProtocol)
+	if !ok {
+		return
+	}
+	if v.Name() == "" || strings.ContainsAny(v.Name(), " \n") {
+		t.Errorf("Name() = %q, want a single word", v.Name())
+	}
+	if v.Version() < 1 {
+		t.Errorf("Version() = %d, want at least 1", v.Version())
+	}
+}
+
+// Fuzz fuzzes Decode of protocols made by newProtocol. Whatever it
+// manages to decode must survive another Encode/Decode round trip, or at
+// least encode to the same frame again afterwards: a protocol may normalise
+// what it decodes once, as RESPProtocol downgrades RESP3 types for RESP2.
+func Fuzz(f *testing.F, newProtocol func() portrelay.MessageProtocol) {
+	p := newProtocol()
+	for _, msg := range Messages() {
+		if frame, err := portrelay.AppendEncode(p, nil, msg); err == nil {
+			f.Add(frame)
+		}
+	}
+
+	f.Fuzz(func(t *testing.T, data []byte) {
+		p := newProtocol()
+		msg, err := decode(p, data)
+		if err != nil {
+			if !isDecodeError(err) {
+				t.Fatalf("Decode() error = %v, want *DecodeError", err)
+			}
+			return
+		}
+
+		frame, err := portrelay.AppendEncode(p, nil, *msg)
+		if err != nil {
+			t.Fatalf("AppendEncode(%+v) error = %v", *msg, err)
+		}
+		again, err := decode(p, frame)
+		if err != nil {
+			t.Fatalf("Decode(Encode(%+v)) error = %v", *msg, err)
+		}
+		if Equal(*again, *msg) {
+			return
+		}
+		frameAgain, err := portrelay.AppendEncode(p, nil, *again)
+		if err != nil {
+			t.Fatalf("AppendEncode(%+v) error = %v", *again, err)
+		}
+		if !bytes.Equal(frameAgain, frame) {
+			t.Fatalf("Decode(Encode(%+v)) = %+v, which encodes to %q instead of %q", *msg, *again, frameAgain, frame)
+		}
+	})
+}
+
+// Equal reports whether two messages carry the same content. Nil and empty
+// argument lists are equal, and so are nil and empty headers.
+func Equal(a, b portrelay.Message) bool {
+	if len(a.Arguments) == 0 && len(b.Arguments) == 0 {
+		a.Arguments, b.Arguments = nil, nil
+	}
+	if len(a.Headers) == 0 && len(b.Headers) == 0 {
+		a.Headers, b.Headers = nil, nil
+	}
+	if len(a.Values) != len(b.Values) || (a.Values == nil) != (b.Values == nil) {
+		return false
+	}
+	for i := range a.Values {
+		if !equalValue(a.Values[i], b.Values[i]) {
+			return false
+		}
+	}
+	a.Values, b.Values = nil, nil
+	return reflect.DeepEqual(a, b)
+}
+
+// equalValue is reflect.DeepEqual for values, except that NaN equals NaN.
+func equalValue(a, b portrelay.Value) bool {
+	if a.Kind == portrelay.KindFloat && b.Kind == portrelay.KindFloat && math.IsNaN(a.Float) && math.IsNaN(b.Float) {
+		return true
+	}
+	if a.Kind != b.Kind || len(a.Array) != len(b.Array) || len(a.Map) != len(b.Map) {
+		return false
+	}
+	for i := range a.Array {
+		if !equalValue(a.Array[i], b.Array[i]) {
+			return false
+		}
+	}
+	for i := range a.Map {
+		if !equalValue(a.Map[i].Key, b.Map[i].Key) || !equalValue(a.Map[i].Value, b.Map[i].Value) {
+			return false
+		}
+	}
+	a.Array, b.Array, a.Map, b.Map = nil, nil, nil, nil
+	return reflect.DeepEqual(a, b)
+}
+
+func encode(t *testing.T, p portrelay.MessageProtocol, msg portrelay.Message) []byte {
+	t.Helper()
+	frame, err := portrelay.AppendEncode(p, nil, msg)
+	if err != nil {
+		t.Fatalf("%s: AppendEncode() error = %v", describe(msg), err)
+	}
+	return frame
+}
+
+func decode(p portrelay.MessageProtocol, data []byte) (*portrelay.Message, error) {
+	return p.Decode(bytes.NewReader(data))
+}
+
+func isDecodeError(err error) bool {
+	var decodeErr *portrelay.DecodeError
+	return errors.As(err, &decodeErr)
+}
+
+func textOnly(messages []portrelay.Message) []portrelay.Message {
+	var text []portrelay.Message
+	for _, msg := range messages {
+		valid := utf8.ValidString(msg.Command)
+		for _, arg := range msg.Arguments {
+			valid = valid && utf8.ValidString(arg)
+		}
+		if valid {
+			text = append(text, msg)
+		}
+	}
+	return text
+}
+
+func without(messages []portrelay.Message, skip func(portrelay.Message) bool) []portrelay.Message {
+	var kept []portrelay.Message
+	for _, msg := range messages {
+		if !skip(msg) {
+			kept = append(kept, msg)
+		}
+	}
+	return kept
+}
+
+func describe(msg portrelay.Message) string {
+	if len(msg.Command) > 20 {
+		return msg.Command[:20]
+	}
+	if msg.Command == "" {
+		return "<empty command>"
+	}
+	return msg.Command
+}
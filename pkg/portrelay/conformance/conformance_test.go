@@ -0,0 +1,69 @@
+package conformance
+
+import (
+	"testing"
+
+	"github.com/tartancz/golangMyPackages/pkg/portrelay"
+)
+
+func newBinary() portrelay.MessageProtocol {
+	return portrelay.NewBinaryMessageProtocol()
+}
+
+func newJSONLines() portrelay.MessageProtocol {
+	return portrelay.NewJSONLinesProtocol()
+}
+
+func newRESP() portrelay.MessageProtocol {
+	return portrelay.NewRESPProtocol()
+}
+
+func newCompressed() portrelay.MessageProtocol {
+	return portrelay.NewCompressedProtocol(portrelay.NewBinaryMessageProtocol(), 64)
+}
+
+func TestBinaryMessageProtocol(t *testing.T) {
+	Run(t, newBinary, Options{})
+}
+
+func TestBinaryMessageProtocol_Vectors(t *testing.T) {
+	RunVectors(t, newBinary())
+}
+
+func TestJSONLinesProtocol(t *testing.T) {
+	Run(t, newJSONLines, Options{})
+}
+
+func TestCompressedProtocol(t *testing.T) {
+	Run(t, newCompressed, Options{})
+}
+
+func TestVectors_Missing(t *testing.T) {
+	if _, err := Vectors("binary", 99); err == nil {
+		t.Errorf("Vectors() for an unknown version succeeded")
+	}
+}
+
+func TestRESPProtocol(t *testing.T) {
+	Run(t, newRESP, Options{NoIDs: true, NoHeaders: true, FoldCase: true})
+}
+
+func FuzzBinaryMessageProtocol(f *testing.F) {
+	Fuzz(f, newBinary)
+}
+
+func FuzzJSONLinesProtocol(f *testing.F) {
+	Fuzz(f, newJSONLines)
+}
+
+func FuzzCompressedProtocol(f *testing.F) {
+	Fuzz(f, newCompressed)
+}
+
+func FuzzRESPProtocol(f *testing.F) {
+	// RESP3 replies, which RESP2 encodes differently.
+	for _, seed := range []string{"%0\r\n", "%1\r\n+a\r\n#t\r\n", ",1.5\r\n", "_\r\n", "~1\r\n(12\r\n", "=7\r\ntxt:a b\r\n", "!3\r\na\nb\r\n", "+\r\r\n"} {
+		f.Add([]byte(seed))
+	}
+	Fuzz(f, newRESP)
+}
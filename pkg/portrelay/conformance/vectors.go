@@ -0,0 +1,186 @@
+package conformance
+
+import (
+	"bytes"
+	"embed"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"testing"
+
+	"github.com/tartancz/golangMyPackages/pkg/portrelay"
+)
+
+// Test vector files live in vectors/<protocol>-v<version>.json. They are
+// plain JSON so that implementations in other languages can use them too.
+//
+//go:embed vectors/*.json
+var vectorFiles embed.FS
+
+// VectorFile is the content of one test vector file.
+type VectorFile struct {
+	Protocol string   `json:"protocol"`
+	Version  int      `json:"version"`
+	Vectors  []Vector `json:"vectors"`
+}
+
+// Vector pins down the wire form of one frame. A valid vector's Message
+// must encode to exactly Wire and Wire must decode to Message; an invalid
+// vector's Wire must be rejected.
+//
+// Byte strings that are not valid UTF-8 are given hex encoded in WireHex
+// and ArgsHex instead of Wire and Args.
+type Vector struct {
+	Name    string         `json:"name"`
+	Wire    string         `json:"wire,omitempty"`
+	WireHex string         `json:"wire_hex,omitempty"`
+	Message *VectorMessage `json:"message,omitempty"`
+	Invalid bool           `json:"invalid,omitempty"`
+}
+
+// VectorMessage is the message of a vector. Typed arguments are given in
+// Values instead of Args.
+type VectorMessage struct {
+	Command string            `json:"command"`
+	Args    []string          `json:"args,omitempty"`
+	ArgsHex []string          `json:"args_hex,omitempty"`
+	Values  []VectorValue     `json:"values,omitempty"`
+	ID      uint64            `json:"id,omitempty"`
+	ReplyTo uint64            `json:"reply_to,omitempty"`
+	Headers map[string]string `json:"headers,omitempty"`
+}
+
+// VectorValue is a typed value with exactly one field set. Map entries are
+// [key, value] pairs.
+type VectorValue struct {
+	Bulk  *string          `json:"bulk,omitempty"`
+	Int   *int64           `json:"int,omitempty"`
+	Float *float64         `json:"float,omitempty"`
+	Bool  *bool            `json:"bool,omitempty"`
+	Null  bool             `json:"null,omitempty"`
+	Array []VectorValue    `json:"array,omitempty"`
+	Map   [][2]VectorValue `json:"map,omitempty"`
+}
+
+// Vectors loads the test vectors for version of the named protocol.
+func Vectors(protocol string, version int) (*VectorFile, error) {
+	data, err := vectorFiles.ReadFile(fmt.Sprintf("vectors/%s-v%d.json", protocol, version))
+	if err != nil {
+		return nil, err
+	}
+
+	var file VectorFile
+	if err := json.Unmarshal(data, &file); err != nil {
+		return nil, err
+	}
+	return &file, nil
+}
+
+// Bytes returns the wire bytes of the vector.
+func (v Vector) Bytes() ([]byte, error) {
+	if v.WireHex != "" {
+		return hex.DecodeString(v.WireHex)
+	}
+	return []byte(v.Wire), nil
+}
+
+// ToMessage returns the message of the vector.
+func (m VectorMessage) ToMessage() (portrelay.Message, error) {
+	msg := portrelay.Message{Command: m.Command, Arguments: m.Args, ID: m.ID, ReplyTo: m.ReplyTo, Headers: m.Headers}
+	for _, arg := range m.ArgsHex {
+		b, err := hex.DecodeString(arg)
+		if err != nil {
+			return msg, err
+		}
+		msg.Arguments = append(msg.Arguments, string(b))
+	}
+	for _, v := range m.Values {
+		value, err := v.ToValue()
+		if err != nil {
+			return msg, err
+		}
+		msg.AddValue(value)
+	}
+	return msg, nil
+}
+
+// ToValue returns the value the vector describes.
+func (v VectorValue) ToValue() (portrelay.Value, error) {
+	switch {
+	case v.Bulk != nil:
+		return portrelay.BulkValue(*v.Bulk), nil
+	case v.Int != nil:
+		return portrelay.IntValue(*v.Int), nil
+	case v.Float != nil:
+		return portrelay.FloatValue(*v.Float), nil
+	case v.Bool != nil:
+		return portrelay.BoolValue(*v.Bool), nil
+	case v.Null:
+		return portrelay.NullValue(), nil
+	case v.Array != nil:
+		var values []portrelay.Value
+		for _, elem := range v.Array {
+			value, err := elem.ToValue()
+			if err != nil {
+				return value, err
+			}
+			values = append(values, value)
+		}
+		return portrelay.ArrayValue(values...), nil
+	case v.Map != nil:
+		var pairs []portrelay.Pair
+		for _, entry := range v.Map {
+			key, err := entry[0].ToValue()
+			if err != nil {
+				return key, err
+			}
+			value, err := entry[1].ToValue()
+			if err != nil {
+				return value, err
+			}
+			pairs = append(pairs, portrelay.Pair{Key: key, Value: value})
+		}
+		return portrelay.MapValue(pairs...), nil
+	}
+	return portrelay.Value{}, fmt.Errorf("value without a type")
+}
+
+// RunVectors checks p against the vectors of its own name and version.
+func RunVectors(t *testing.T, p portrelay.MessageProtocol) {
+	name, version := portrelay.ProtocolName(p), portrelay.ProtocolVersion(p)
+	file, err := Vectors(name, version)
+	if err != nil {
+		t.Fatalf("no test vectors for %s v%d: %v", name, version, err)
+	}
+
+	for _, v := range file.Vectors {
+		t.Run(v.Name, func(t *testing.T) {
+			wire, err := v.Bytes()
+			if err != nil {
+				t.Fatalf("invalid vector: %v", err)
+			}
+
+			got, err := decode(p, wire)
+			if v.Invalid {
+				if err == nil {
+					t.Errorf("Decode(%q) = %+v, want error", wire, *got)
+				}
+				return
+			}
+
+			want, err2 := v.Message.ToMessage()
+			if err2 != nil {
+				t.Fatalf("invalid vector: %v", err2)
+			}
+			if err != nil {
+				t.Fatalf("Decode(%q) error = %v", wire, err)
+			}
+			if !Equal(*got, want) {
+				t.Errorf("Decode(%q) = %+v, want %+v", wire, *got, want)
+			}
+			if encoded := encode(t, p, want); !bytes.Equal(encoded, wire) {
+				t.Errorf("AppendEncode(%+v) = %q, want %q", want, encoded, wire)
+			}
+		})
+	}
+}
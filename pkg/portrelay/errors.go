@@ -17,6 +17,22 @@ func (e *DecodeError) Unwrap() error {
 	return e.Err
 }
 
+// EncodeError is returned when a message cannot be turned into a frame.
+type EncodeError struct {
+	Stage   string // e.g. "limit exceeded", "validate argument"
+	Index   int    // argument index (or -1 if not applicable)
+	Details string // optional extra context
+	Err     error  // wrapped error
+}
+
+func (e *EncodeError) Error() string {
+	return fmt.Sprintf("encode error at stage %q (arg %d): %s: %v", e.Stage, e.Index, e.Details, e.Err)
+}
+
+func (e *EncodeError) Unwrap() error {
+	return e.Err
+}
+
 // throws whenever the server cannot connect to the specified host and port
 // this is used to distinguish between connection errors and other types of errors
 type ConnError struct {
@@ -30,3 +46,20 @@ func (e *ConnError) Error() string {
 func (e *ConnError) Unwrap() error {
 	return e.Err
 }
+
+// NetError is returned when reading from or writing to an established
+// connection fails, or its peer stops answering heartbeats, as opposed to
+// ConnError for a connection that could not be made. A read failure in the
+// middle of a frame also wraps the *DecodeError of that frame.
+type NetError struct {
+	Op  string // "read", "write" or "heartbeat"
+	Err error
+}
+
+func (e *NetError) Error() string {
+	return fmt.Sprintf("connection %s failed: %v", e.Op, e.Err)
+}
+
+func (e *NetError) Unwrap() error {
+	return e.Err
+}
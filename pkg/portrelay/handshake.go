@@ -0,0 +1,204 @@
+package portrelay
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"net"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Capability names an optional feature a peer can advertise in the handshake.
+type Capability string
+
+const (
+	// CapMessageIDs allows frames to carry message IDs, as used by Client.Call.
+	CapMessageIDs Capability = "ids"
+)
+
+// Capabilities is a set of capabilities, in the order they were advertised.
+type Capabilities []Capability
+
+func (cs Capabilities) Has(c Capability) bool {
+	return slices.Contains(cs, c)
+}
+
+// Intersect returns the capabilities present in both cs and other.
+func (cs Capabilities) Intersect(other Capabilities) Capabilities {
+	var common Capabilities
+	for _, c := range cs {
+		if other.Has(c) && !common.Has(c) {
+			common = append(common, c)
+		}
+	}
+	return common
+}
+
+// SupportedCapabilities returns every capability this package implements.
+func SupportedCapabilities() Capabilities {
+	return Capabilities{CapMessageIDs, CapCompression, CapStreams, CapHeartbeat}
+}
+
+// VersionedProtocol is implemented by protocols that name their wire format.
+// Name and Version identify it in the opening handshake; peers only talk to
+// each other when both match.
+type VersionedProtocol interface {
+	Name() string
+	Version() int
+}
+
+// ProtocolName returns the Name of p, or its Go type when p does not
+// implement VersionedProtocol, which only matches the same type on the peer.
+func ProtocolName(p MessageProtocol) string {
+	if v, ok := p.(VersionedProtocol); ok {
+		return v.Name()
+	}
+	return fmt.Sprintf("%T", p)
+}
+
+// ProtocolVersion returns the Version of p, or 1 when p does not implement
+// VersionedProtocol.
+func ProtocolVersion(p MessageProtocol) int {
+	if v, ok := p.(VersionedProtocol); ok {
+		return v.Version()
+	}
+	return 1
+}
+
+// DefaultHandshakeTimeout is used when a Client or Server has no HandshakeTimeout set.
+const DefaultHandshakeTimeout = 10 * time.Second
+
+// ErrNotNegotiated is returned when a feature is used that the peer did not
+// agree to in the handshake.
+var ErrNotNegotiated = errors.New("portrelay: capability not negotiated with peer")
+
+// Hello is what each peer announces in the opening handshake.
+type Hello struct {
+	Protocol     string
+	Version      int
+	Capabilities Capabilities
+}
+
+// HandshakeError reports a handshake that failed, either because the peer's
+// hello could not be exchanged or because the peers are incompatible.
+type HandshakeError struct {
+	Local  Hello
+	Remote Hello
+	Reason string
+	Err    error // wrapped error, nil when the peers are simply incompatible
+}
+
+func (e *HandshakeError) Error() string {
+	if e.Err != nil {
+		return fmt.Sprintf("handshake failed: %s: %v", e.Reason, e.Err)
+	}
+	return fmt.Sprintf("handshake failed: %s", e.Reason)
+}
+
+func (e *HandshakeError) Unwrap() error {
+	return e.Err
+}
+
+// FORMAT
+// Handshake: "PORTRELAY/1 <protocol name> <protocol version> <capability>,<capability>...\n"
+// sent by both peers before their first frame; "-" stands for an empty capability list.
+const helloPrefix = "PORTRELAY/1"
+
+func (h Hello) line() string {
+	caps := "-"
+	if len(h.Capabilities) > 0 {
+		names := make([]string, len(h.Capabilities))
+		for i, c := range h.Capabilities {
+			names[i] = string(c)
+		}
+		caps = strings.Join(names, ",")
+	}
+	return fmt.Sprintf("%s %s %d %s\n", helloPrefix, h.Protocol, h.Version, caps)
+}
+
+func parseHello(line string) (Hello, error) {
+	fields := strings.Fields(line)
+	if len(fields) != 4 || fields[0] != helloPrefix {
+		return Hello{}, fmt.Errorf("invalid hello line: %q", strings.TrimSpace(line))
+	}
+
+	version, err := strconv.Atoi(fields[2])
+	if err != nil {
+		return Hello{}, fmt.Errorf("invalid protocol version %q: %w", fields[2], err)
+	}
+
+	hello := Hello{Protocol: fields[1], Version: version}
+	if fields[3] != "-" {
+		for _, c := range strings.Split(fields[3], ",") {
+			hello.Capabilities = append(hello.Capabilities, Capability(c))
+		}
+	}
+	return hello, nil
+}
+
+// handshake exchanges hellos over conn and returns the capabilities both
+// sides agreed on. The peer's hello is read through buf, which must be the
+// buffer frames are decoded from afterwards.
+func handshake(conn net.Conn, buf *bufio.Reader, local Hello, timeout time.Duration) (Capabilities, error) {
+	if timeout <= 0 {
+		timeout = DefaultHandshakeTimeout
+	}
+	conn.SetDeadline(time.Now().Add(timeout))
+	defer conn.SetDeadline(time.Time{})
+
+	// Both peers write first, so the write must not wait for the read on
+	// unbuffered connections such as net.Pipe.
+	written := make(chan error, 1)
+	go func() {
+		_, err := conn.Write([]byte(local.line()))
+		written <- err
+	}()
+
+	r := &frameReader{buf: buf, limits: DecodeLimits{MaxLineLength: DefaultDecodeLimits.MaxLineLength}}
+	line, err := r.readLine("read hello", -1, "could not read handshake line")
+	if err != nil {
+		return nil, &HandshakeError{Local: local, Reason: "reading peer hello", Err: err}
+	}
+	if err := <-written; err != nil {
+		return nil, &HandshakeError{Local: local, Reason: "sending hello", Err: err}
+	}
+
+	remote, err := parseHello(line)
+	if err != nil {
+		return nil, &HandshakeError{Local: local, Reason: "parsing peer hello", Err: err}
+	}
+
+	if remote.Protocol != local.Protocol {
+		return nil, &HandshakeError{
+			Local:  local,
+			Remote: remote,
+			Reason: fmt.Sprintf("protocol mismatch: local %q, peer %q", local.Protocol, remote.Protocol),
+		}
+	}
+	if remote.Version != local.Version {
+		return nil, &HandshakeError{
+			Local:  local,
+			Remote: remote,
+			Reason: fmt.Sprintf("%s version mismatch: local %d, peer %d", local.Protocol, local.Version, remote.Version),
+		}
+	}
+
+	return local.Capabilities.Intersect(remote.Capabilities), nil
+}
+
+func localHello(protocol MessageProtocol, caps Capabilities) Hello {
+	if caps == nil {
+		caps = SupportedCapabilities()
+	}
+	// Only a CompressedProtocol can read compressed frames, so anything
+	// else must not invite the peer to send them.
+	if _, ok := protocol.(*CompressedProtocol); !ok && caps.Has(CapCompression) {
+		caps = slices.DeleteFunc(slices.Clone(caps), func(c Capability) bool {
+			return c == CapCompression
+		})
+	}
+	return Hello{Protocol: ProtocolName(protocol), Version: ProtocolVersion(protocol), Capabilities: caps}
+}
@@ -0,0 +1,192 @@
+package portrelay
+
+import (
+	"context"
+	"errors"
+	"io"
+	"net"
+	"reflect"
+	"testing"
+)
+
+// versionedProtocol reports a different version than the protocol it wraps.
+type versionedProtocol struct {
+	*BinaryMessageProtocol
+	version int
+}
+
+func (p versionedProtocol) Version() int {
+	return p.version
+}
+
+// legacyProtocol implements no more than MessageProtocol requires.
+type legacyProtocol struct {
+	inner *BinaryMessageProtocol
+}
+
+func (p legacyProtocol) Encode(message Message) []byte {
+	return p.inner.Encode(message)
+}
+
+func (p legacyProtocol) Decode(reader io.Reader) (*Message, error) {
+	return p.inner.Decode(reader)
+}
+
+func startHandshakeServer(t *testing.T, p MessageProtocol, caps Capabilities) (host, port string, disconnects chan error) {
+	t.Helper()
+
+	router := NewRouter()
+	router.Register("echo", FuncHandler{
+		Func: func(msg Message, out io.Writer) {
+			Reply(out, msg, Message{Command: "echo", Arguments: msg.Arguments})
+		},
+	})
+	s := NewServer(p, router)
+	s.Handshake = true
+	s.Capabilities = caps
+	disconnects = make(chan error, 1)
+	s.OnDisconnect = func(c *ServerConn, err error) {
+		disconnects <- err
+	}
+
+	host, port, _ = net.SplitHostPort(startTestServer(t, s))
+	return host, port, disconnects
+}
+
+func TestHandshake_Negotiates(t *testing.T) {
+	host, port, _ := startHandshakeServer(t, NewBinaryMessageProtocol(), nil)
+
+	client := NewClient(NewBinaryMessageProtocol())
+	client.Handshake = true
+	if err := client.Start(context.Background(), host, port); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	defer client.Close()
+
+	expected := Capabilities{CapMessageIDs, CapStreams, CapHeartbeat}
+	if !reflect.DeepEqual(client.Negotiated(), expected) {
+		t.Errorf("Negotiated() = %v, want %v", client.Negotiated(), expected)
+	}
+
+	resp, err := client.Call(context.Background(), Message{Command: "echo", Arguments: []string{"hi"}})
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if !reflect.DeepEqual(resp.Arguments, []string{"hi"}) {
+		t.Errorf("Call() got arguments %v", resp.Arguments)
+	}
+}
+
+func TestHandshake_ProtocolMismatch(t *testing.T) {
+	host, port, disconnects := startHandshakeServer(t, NewJSONLinesProtocol(), nil)
+
+	client := NewClient(NewBinaryMessageProtocol())
+	client.Handshake = true
+	err := client.Start(context.Background(), host, port)
+
+	var handshakeErr *HandshakeError
+	if !errors.As(err, &handshakeErr) {
+		t.Fatalf("Start() error = %v, want *HandshakeError", err)
+	}
+	if handshakeErr.Remote.Protocol != "json" {
+		t.Errorf("HandshakeError.Remote.Protocol = %q, want json", handshakeErr.Remote.Protocol)
+	}
+	if !errors.As(<-disconnects, &handshakeErr) {
+		t.Errorf("server did not report a *HandshakeError")
+	}
+}
+
+func TestHandshake_VersionMismatch(t *testing.T) {
+	host, port, _ := startHandshakeServer(t, versionedProtocol{NewBinaryMessageProtocol(), 2}, nil)
+
+	client := NewClient(NewBinaryMessageProtocol())
+	client.Handshake = true
+	err := client.Start(context.Background(), host, port)
+
+	var handshakeErr *HandshakeError
+	if !errors.As(err, &handshakeErr) {
+		t.Fatalf("Start() error = %v, want *HandshakeError", err)
+	}
+	if handshakeErr.Local.Version != 1 || handshakeErr.Remote.Version != 2 {
+		t.Errorf("HandshakeError versions = %d/%d, want 1/2", handshakeErr.Local.Version, handshakeErr.Remote.Version)
+	}
+
+	// A failed handshake leaves the client ready to try again.
+	if client.State() != StateIdle {
+		t.Errorf("client kept the connection after a failed handshake")
+	}
+}
+
+func TestHandshake_FeatureNeedsBothPeers(t *testing.T) {
+	host, port, _ := startHandshakeServer(t, NewBinaryMessageProtocol(), Capabilities{})
+
+	client := NewClient(NewBinaryMessageProtocol())
+	client.Handshake = true
+	if err := client.Start(context.Background(), host, port); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	defer client.Close()
+
+	if len(client.Negotiated()) != 0 {
+		t.Errorf("Negotiated() = %v, want none", client.Negotiated())
+	}
+	if _, err := client.Call(context.Background(), Message{Command: "echo"}); !errors.Is(err, ErrNotNegotiated) {
+		t.Errorf("Call() error = %v, want %v", err, ErrNotNegotiated)
+	}
+}
+
+func TestHelloLine(t *testing.T) {
+	tests := []struct {
+		name  string
+		hello Hello
+		line  string
+	}{
+		{name: "With capabilities", hello: Hello{Protocol: "binary", Version: 1, Capabilities: Capabilities{"ids", "heartbeat"}}, line: "PORTRELAY/1 binary 1 ids,heartbeat\n"},
+		{name: "Without capabilities", hello: Hello{Protocol: "json", Version: 3}, line: "PORTRELAY/1 json 3 -\n"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := tt.hello.line(); got != tt.line {
+				t.Errorf("line() = %q, want %q", got, tt.line)
+			}
+			got, err := parseHello(tt.line)
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			if !reflect.DeepEqual(got, tt.hello) {
+				t.Errorf("parseHello() = %v, want %v", got, tt.hello)
+			}
+		})
+	}
+
+	for _, line := range []string{"", "HELLO binary 1 -\n", "PORTRELAY/1 binary one -\n", "PORTRELAY/1 binary 1\n"} {
+		if _, err := parseHello(line); err == nil {
+			t.Errorf("parseHello(%q) succeeded, want error", line)
+		}
+	}
+}
+
+func TestHandshake_UnversionedProtocol(t *testing.T) {
+	p := legacyProtocol{NewBinaryMessageProtocol()}
+	if got := ProtocolName(p); got != "portrelay.legacyProtocol" || ProtocolVersion(p) != 1 {
+		t.Errorf("ProtocolName(), ProtocolVersion() = %s, %d, want the Go type and 1", got, ProtocolVersion(p))
+	}
+	host, port, _ := startHandshakeServer(t, p, nil)
+
+	client := NewClient(NewBinaryMessageProtocol())
+	client.Handshake = true
+	var handshakeErr *HandshakeError
+	if err := client.Start(context.Background(), host, port); !errors.As(err, &handshakeErr) {
+		t.Fatalf("Start() with another protocol error = %v, want *HandshakeError", err)
+	}
+
+	client = NewClient(p)
+	client.Handshake = true
+	if err := client.Start(context.Background(), host, port); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	defer client.Close()
+	if _, err := client.Call(context.Background(), Message{Command: "echo"}); err != nil {
+		t.Errorf("Call() unexpected error: %v", err)
+	}
+}
@@ -0,0 +1,140 @@
+package portrelay
+
+import (
+	"fmt"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Well-known header names. Header names are lower case; Message.Header and
+// Message.SetHeader lowercase the names they are given, and so do decoders
+// for the names they receive.
+const (
+	HeaderRequestID   = "request-id"
+	HeaderTraceID     = "trace-id"
+	HeaderSender      = "sender"
+	HeaderContentType = "content-type"
+	// HeaderDeadline is the time by which the sender stops waiting for a
+	// reply, in time.RFC3339Nano. Client.Call sets it from its context.
+	HeaderDeadline = "deadline"
+)
+
+// FORMAT
+// Headers are sent before the "*<n>" line of a BinaryMessageProtocol frame as
+// "|<number of headers>\n" followed by a "$<length>\n<data>\n" name and value
+// for each header, in name order. Frames without headers are unchanged.
+
+// Header returns the value of the header name, or "" when it is not set.
+func (m Message) Header(name string) string {
+	return m.Headers[strings.ToLower(name)]
+}
+
+// SetHeader sets the header name to value.
+func (m *Message) SetHeader(name, value string) {
+	if m.Headers == nil {
+		m.Headers = make(map[string]string)
+	}
+	m.Headers[strings.ToLower(name)] = value
+}
+
+// Deadline returns the time in the HeaderDeadline header.
+func (m Message) Deadline() (time.Time, bool) {
+	deadline, err := time.Parse(time.RFC3339Nano, m.Header(HeaderDeadline))
+	if err != nil {
+		return time.Time{}, false
+	}
+	return deadline, true
+}
+
+// stampHeaders sets every header in headers that msg does not have yet.
+func stampHeaders(msg *Message, headers map[string]string) {
+	for name, value := range headers {
+		if _, ok := msg.Headers[strings.ToLower(name)]; !ok {
+			msg.SetHeader(name, value)
+		}
+	}
+}
+
+// lowerHeaders returns headers with lower case names.
+func lowerHeaders(headers map[string]string) map[string]string {
+	for name := range headers {
+		if name != strings.ToLower(name) {
+			lower := make(map[string]string, len(headers))
+			for name, value := range headers {
+				lower[strings.ToLower(name)] = value
+			}
+			return lower
+		}
+	}
+	return headers
+}
+
+func checkHeaders(headers map[string]string, limits DecodeLimits) error {
+	if limits.MaxArgs > 0 && len(headers) > limits.MaxArgs {
+		return encodeExceeded(-1, "%d headers exceed %d", len(headers), limits.MaxArgs)
+	}
+	for name, value := range headers {
+		if limits.MaxArgSize > 0 && max(len(name), len(value)) > limits.MaxArgSize {
+			return encodeExceeded(-1, "header %q exceeds %d bytes", name, limits.MaxArgSize)
+		}
+	}
+	return nil
+}
+
+func appendHeaders(dst []byte, headers map[string]string) []byte {
+	if len(headers) == 0 {
+		return dst
+	}
+	headers = lowerHeaders(headers)
+	dst = append(dst, '|')
+	dst = strconv.AppendInt(dst, int64(len(headers)), 10)
+	dst = append(dst, '\n')
+
+	names := make([]string, 0, len(headers))
+	for name := range headers {
+		names = append(names, name)
+	}
+	slices.Sort(names)
+	for _, name := range names {
+		dst = appendArgument(dst, name)
+		dst = appendArgument(dst, headers[name])
+	}
+	return dst
+}
+
+// readHeaders reads the headers announced by line, a "|<n>\n" line.
+func (r *frameReader) readHeaders(line string) (map[string]string, error) {
+	var n int
+	if _, err := fmt.Sscanf(line, "|%d\n", &n); err != nil || n < 0 {
+		if err == nil {
+			err = fmt.Errorf("invalid format")
+		}
+		return nil, &DecodeError{
+			Stage:   "parse header count",
+			Index:   -1,
+			Details: fmt.Sprintf("invalid line: %q", strings.TrimSpace(line)),
+			Err:     err,
+		}
+	}
+	if r.limits.MaxArgs > 0 && n > r.limits.MaxArgs {
+		return nil, exceeded(-1, "%d headers exceed %d", n, r.limits.MaxArgs)
+	}
+
+	headers := make(map[string]string, n)
+	for i := 0; i < 2*n; i += 2 {
+		var pair [2]string
+		for j := range pair {
+			line, err := r.readLine("read header", -1, "could not read '$<length>' line of a header")
+			if err != nil {
+				return nil, err
+			}
+			if pair[j], err = r.readBulk(-1, line); err != nil {
+				return nil, err
+			}
+		}
+		headers[strings.ToLower(pair[0])] = pair[1]
+	}
+	return headers, nil
+}
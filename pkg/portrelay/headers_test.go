@@ -0,0 +1,134 @@
+package portrelay
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestMessage_Headers(t *testing.T) {
+	var msg Message
+	if msg.Header(HeaderTraceID) != "" {
+		t.Errorf("Header() on a message without headers = %q", msg.Header(HeaderTraceID))
+	}
+
+	msg.SetHeader("Trace-ID", "abc")
+	if got := msg.Header(HeaderTraceID); got != "abc" {
+		t.Errorf("Header() = %q, want abc", got)
+	}
+	if !reflect.DeepEqual(msg.Headers, map[string]string{"trace-id": "abc"}) {
+		t.Errorf("Headers = %v", msg.Headers)
+	}
+
+	if _, ok := msg.Deadline(); ok {
+		t.Errorf("Deadline() ok without a deadline header")
+	}
+	deadline := time.Date(2026, 1, 2, 3, 4, 5, 6, time.UTC)
+	msg.SetHeader(HeaderDeadline, deadline.Format(time.RFC3339Nano))
+	if got, ok := msg.Deadline(); !ok || !got.Equal(deadline) {
+		t.Errorf("Deadline() = %v, %v, want %v", got, ok, deadline)
+	}
+}
+
+func TestHeaders_RoundTrip(t *testing.T) {
+	msg := Message{Command: "ping", Headers: map[string]string{HeaderSender: "svc-a", "x-bin": "\x00\n"}}
+
+	for _, p := range []MessageProtocol{
+		NewBinaryMessageProtocol(),
+		&BinaryMessageProtocol{Signer: newTestSigner(t, "k1", []byte("secret"))},
+		NewCompressedProtocol(NewBinaryMessageProtocol(), 0),
+	} {
+		frame, err := AppendEncode(p, nil, msg)
+		if err != nil {
+			t.Fatalf("%T: unexpected error: %v", p, err)
+		}
+		got, err := NewProtocolDecoder(p, bytes.NewReader(frame)).Next()
+		if err != nil {
+			t.Fatalf("%T: unexpected error: %v", p, err)
+		}
+		if !reflect.DeepEqual(got.Headers, msg.Headers) {
+			t.Errorf("%T: Headers got = %v, want %v", p, got.Headers, msg.Headers)
+		}
+	}
+}
+
+func TestHeaders_MixedCaseNames(t *testing.T) {
+	want := map[string]string{"trace-id": "abc", "x-b": "1"}
+	for _, tt := range []struct {
+		p     MessageProtocol
+		frame string
+	}{
+		{p: NewBinaryMessageProtocol(), frame: "|2\n$8\nTrace-ID\n$3\nabc\n$3\nX-B\n$1\n1\n*1\n$4\nping\n"},
+		{p: NewJSONLinesProtocol(), frame: `{"command":"ping","headers":{"Trace-ID":"abc","X-B":"1"}}` + "\n"},
+	} {
+		got, err := tt.p.Decode(strings.NewReader(tt.frame))
+		if err != nil {
+			t.Fatalf("%T: unexpected error: %v", tt.p, err)
+		}
+		if !reflect.DeepEqual(got.Headers, want) {
+			t.Errorf("%T: Headers got = %v, want %v", tt.p, got.Headers, want)
+		}
+		if got.Header(HeaderTraceID) != "abc" {
+			t.Errorf("%T: Header(%q) = %q, want abc", tt.p, HeaderTraceID, got.Header(HeaderTraceID))
+		}
+	}
+
+	// Encoders send lower case names too, which signatures rely on.
+	p := &BinaryMessageProtocol{Signer: newTestSigner(t, "k1", []byte("secret"))}
+	got, err := p.DecodeBytes(p.Encode(Message{Command: "ping", Headers: map[string]string{"Trace-ID": "abc", "X-B": "1"}}))
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if !reflect.DeepEqual(got.Headers, want) {
+		t.Errorf("signed: Headers got = %v, want %v", got.Headers, want)
+	}
+}
+
+func TestHeaders_Limits(t *testing.T) {
+	p := &BinaryMessageProtocol{Limits: DecodeLimits{MaxArgs: 1, MaxArgSize: 4}}
+	if _, err := p.AppendEncode(nil, Message{Command: "x", Headers: map[string]string{"a": "12345"}}); err == nil {
+		t.Errorf("AppendEncode() with a header value over MaxArgSize succeeded")
+	}
+	if _, err := p.DecodeString("|2\n"); err == nil {
+		t.Errorf("Decode() with more headers than MaxArgs succeeded")
+	}
+}
+
+func TestClient_StampsHeaders(t *testing.T) {
+	received := make(chan Message, 1)
+	router := NewRouter()
+	router.Register("echo", FuncHandler{
+		Func: func(msg Message, out io.Writer) {
+			received <- msg
+			Reply(out, msg, Message{Command: "echo"})
+		},
+	})
+	client := startCallClient(t, router)
+	client.Headers = map[string]string{HeaderSender: "svc-a", HeaderTraceID: "default"}
+
+	msg := Message{Command: "echo", Headers: map[string]string{HeaderTraceID: "abc"}}
+	ctx, cancel := context.WithTimeout(context.Background(), time.Minute)
+	defer cancel()
+	resp, err := client.Call(ctx, msg)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	req := <-received
+	if req.Header(HeaderSender) != "svc-a" || req.Header(HeaderTraceID) != "abc" {
+		t.Errorf("request headers = %v, want the sender stamped and the trace id kept", req.Headers)
+	}
+	if deadline, ok := req.Deadline(); !ok || time.Until(deadline) <= 0 {
+		t.Errorf("request deadline = %v, %v, want the context's deadline", deadline, ok)
+	}
+	if resp.Header(HeaderTraceID) != "abc" {
+		t.Errorf("reply headers = %v, want the trace id carried over", resp.Headers)
+	}
+	if len(msg.Headers) != 1 {
+		t.Errorf("Call() changed the caller's headers: %v", msg.Headers)
+	}
+}
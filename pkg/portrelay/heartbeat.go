@@ -0,0 +1,205 @@
+package portrelay
+
+import (
+	"errors"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// CapHeartbeat means the peer answers heartbeat pings.
+const CapHeartbeat Capability = "heartbeat"
+
+// Heartbeat commands. Client and Server consume them; they never reach handlers.
+const (
+	// HeartbeatPingCommand carries a sequence number the peer sends back.
+	HeartbeatPingCommand = "portrelay:ping"
+	// HeartbeatPongCommand answers a ping with its arguments.
+	HeartbeatPongCommand = "portrelay:pong"
+)
+
+// ErrHeartbeatTimeout is wrapped in the *NetError of a connection whose
+// peer stopped answering heartbeats.
+var ErrHeartbeatTimeout = errors.New("portrelay: peer stopped answering heartbeats")
+
+// HeartbeatPolicy makes a Client or Server ping its peer regularly and drop
+// the connection once the peer stops answering, which notices a crashed
+// peer or a connection a NAT forgot about without waiting for TCP to.
+//
+// Pings are only answered while the peer reads the connection. A Server
+// stops reading once its handlers fall a few messages behind, so a client's
+// Interval times MaxMissed must be longer than the slowest handler on the
+// server.
+type HeartbeatPolicy struct {
+	// Interval is the time between pings. Zero means 5s.
+	Interval time.Duration
+	// MaxMissed is how many pings in a row may go unanswered for an
+	// Interval each before the connection is declared dead. Zero means 3.
+	MaxMissed int
+}
+
+func (p HeartbeatPolicy) interval() time.Duration {
+	if p.Interval <= 0 {
+		return 5 * time.Second
+	}
+	return p.Interval
+}
+
+func (p HeartbeatPolicy) maxMissed() int {
+	if p.MaxMissed <= 0 {
+		return 3
+	}
+	return p.MaxMissed
+}
+
+// FORMAT
+// Heartbeat: "portrelay:ping <seq>", answered by "portrelay:pong <seq>".
+// Every peer answers pings, whether it sends any itself or not.
+
+// heartbeat pings the peer of one connection and keeps track of its answers.
+// A nil *heartbeat sends no pings but still answers the peer's.
+type heartbeat struct {
+	policy HeartbeatPolicy
+
+	mu      sync.Mutex
+	seq     uint64
+	sentAt  time.Time
+	waiting bool // for the pong to ping seq
+	missed  int
+	paused  bool
+	rtt     time.Duration
+	err     error
+}
+
+func newHeartbeat(policy *HeartbeatPolicy) *heartbeat {
+	if policy == nil {
+		return nil
+	}
+	return &heartbeat{policy: *policy}
+}
+
+// run pings the peer with send every interval until done is closed, or
+// calls dead and returns once the peer missed too many pings. send must not
+// block.
+func (h *heartbeat) run(done <-chan struct{}, send func(Message), dead func(error)) {
+	ticker := time.NewTicker(h.policy.interval())
+	defer ticker.Stop()
+	for {
+		select {
+		case <-done:
+			return
+		case <-ticker.C:
+		}
+
+		ping, err := h.tick()
+		if err != nil {
+			dead(err)
+			return
+		}
+		// A ping that cannot be sent because the peer does not read
+		// counts as missed.
+		send(ping)
+	}
+}
+
+// tick counts the last ping as missed if it is still unanswered and
+// returns the next one.
+func (h *heartbeat) tick() (Message, error) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if h.waiting && !h.paused {
+		h.missed++
+		if h.missed >= h.policy.maxMissed() {
+			h.err = &NetError{Op: "heartbeat", Err: ErrHeartbeatTimeout}
+			return Message{}, h.err
+		}
+	}
+	h.seq++
+	h.sentAt = time.Now()
+	h.waiting = true
+	return Message{Command: HeartbeatPingCommand, Arguments: []string{strconv.FormatUint(h.seq, 10)}}, nil
+}
+
+// handle consumes msg if it is a heartbeat and reports whether it was one.
+// Pings are answered with reply, which must not block.
+func (h *heartbeat) handle(msg Message, reply func(Message)) bool {
+	switch msg.Command {
+	case HeartbeatPingCommand:
+		reply(Message{Command: HeartbeatPongCommand, Arguments: msg.Arguments})
+	case HeartbeatPongCommand:
+		if h != nil {
+			h.pong(argument(msg, 0))
+		}
+	default:
+		return false
+	}
+	return true
+}
+
+// pong records an answer to ping seq. Any answer shows the peer is alive,
+// but only one to the latest ping is timed, as the others are late.
+func (h *heartbeat) pong(seq string) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.missed = 0
+	if h.waiting && seq == strconv.FormatUint(h.seq, 10) {
+		h.rtt = time.Since(h.sentAt)
+		h.waiting = false
+	}
+}
+
+// pause stops counting missed pings while the connection is not read, as
+// the answers could not arrive anyway; resume starts again.
+func (h *heartbeat) pause() {
+	h.setPaused(true)
+}
+
+func (h *heartbeat) resume() {
+	h.setPaused(false)
+}
+
+func (h *heartbeat) setPaused(paused bool) {
+	if h == nil {
+		return
+	}
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.paused = paused
+}
+
+// roundTrip returns the round-trip time of the latest answered ping.
+func (h *heartbeat) roundTrip() time.Duration {
+	if h == nil {
+		return 0
+	}
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	return h.rtt
+}
+
+// failure returns the error the connection was declared dead with, or nil.
+func (h *heartbeat) failure() error {
+	if h == nil {
+		return nil
+	}
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	return h.err
+}
+
+// RTT returns the round-trip time of the latest heartbeat the server
+// answered on the current connection, or zero before the first one or when
+// Heartbeat is nil.
+func (c *Client) RTT() time.Duration {
+	l, _, err := c.current()
+	if l == nil || err != nil {
+		return 0
+	}
+	return l.heartbeat.roundTrip()
+}
+
+// RTT returns the round-trip time of the latest heartbeat the client
+// answered, or zero before the first one or when Server.Heartbeat is nil.
+func (c *ServerConn) RTT() time.Duration {
+	return c.heartbeat.roundTrip()
+}
@@ -0,0 +1,192 @@
+package portrelay
+
+import (
+	"context"
+	"errors"
+	"io"
+	"net"
+	"runtime"
+	"strconv"
+	"testing"
+	"time"
+)
+
+func TestHeartbeat_MeasuresRTT(t *testing.T) {
+	unhandled := make(chan Message, 1)
+	router := NewRouter()
+	router.NotFound = FuncHandler{Func: func(msg Message, out io.Writer) { unhandled <- msg }}
+	addr := startTestServer(t, NewServer(NewBinaryMessageProtocol(), router))
+	host, port, _ := net.SplitHostPort(addr)
+
+	client := NewClient(NewBinaryMessageProtocol())
+	client.Heartbeat = &HeartbeatPolicy{Interval: 10 * time.Millisecond}
+	client.OnUnhandled = func(msg Message, out io.Writer) { unhandled <- msg }
+	if err := client.Start(context.Background(), host, port); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	defer client.Close()
+
+	deadline := time.Now().Add(5 * time.Second)
+	for client.RTT() == 0 {
+		if time.Now().After(deadline) {
+			t.Fatal("RTT() still zero, no ping was answered")
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+	select {
+	case msg := <-unhandled:
+		t.Errorf("heartbeat reached a handler: %+v", msg)
+	default:
+	}
+}
+
+func TestHeartbeat_ClientDetectsDeadServer(t *testing.T) {
+	client := NewClient(NewBinaryMessageProtocol())
+	client.Heartbeat = &HeartbeatPolicy{Interval: 10 * time.Millisecond, MaxMissed: 2}
+	disconnected := make(chan error, 1)
+	client.OnDisconnect = func(c *Client, err error) { disconnected <- err }
+	peer := pipeClient(t, client)
+	defer client.Close()
+
+	// The peer reads the pings but never answers them.
+	go io.Copy(io.Discard, peer)
+
+	select {
+	case err := <-disconnected:
+		var netErr *NetError
+		if !errors.As(err, &netErr) || netErr.Op != "heartbeat" || !errors.Is(err, ErrHeartbeatTimeout) {
+			t.Errorf("OnDisconnect() error = %v, want a heartbeat *NetError", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("the dead peer was not noticed")
+	}
+	if client.State() != StateClosed {
+		t.Errorf("State() = %v, want %v", client.State(), StateClosed)
+	}
+}
+
+func TestHeartbeat_ServerDetectsDeadClient(t *testing.T) {
+	p := NewBinaryMessageProtocol()
+	s := NewServer(p, nil)
+	s.Heartbeat = &HeartbeatPolicy{Interval: 10 * time.Millisecond, MaxMissed: 2}
+	disconnects := make(chan error, 2)
+	rtts := make(chan time.Duration, 2)
+	s.OnDisconnect = func(c *ServerConn, err error) {
+		rtts <- c.RTT()
+		disconnects <- err
+	}
+	addr := startTestServer(t, s)
+	host, port, _ := net.SplitHostPort(addr)
+
+	// A Client answers the server's pings without a policy of its own.
+	client := NewClient(p)
+	if err := client.Start(context.Background(), host, port); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	time.Sleep(50 * time.Millisecond)
+	client.Close()
+	if err := <-disconnects; errors.Is(err, ErrHeartbeatTimeout) {
+		t.Errorf("OnDisconnect() error = %v for a client that answered", err)
+	}
+	if rtt := <-rtts; rtt == 0 {
+		t.Errorf("RTT() = 0, want the client's answers timed")
+	}
+
+	conn, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	defer conn.Close()
+	go io.Copy(io.Discard, conn)
+
+	select {
+	case err := <-disconnects:
+		if !errors.Is(err, ErrHeartbeatTimeout) {
+			t.Errorf("OnDisconnect() error = %v, want %v", err, ErrHeartbeatTimeout)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("the dead client was not noticed")
+	}
+}
+
+func TestHeartbeat_PausedWhileBusy(t *testing.T) {
+	h := newHeartbeat(&HeartbeatPolicy{MaxMissed: 1})
+	if _, err := h.tick(); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	h.pause()
+	if _, err := h.tick(); err != nil {
+		t.Errorf("tick() while paused error = %v, want nil", err)
+	}
+	h.resume()
+	if _, err := h.tick(); !errors.Is(err, ErrHeartbeatTimeout) {
+		t.Errorf("tick() error = %v, want %v", err, ErrHeartbeatTimeout)
+	}
+
+	var none *heartbeat
+	var pong Message
+	if !none.handle(Message{Command: HeartbeatPingCommand, Arguments: []string{"7"}}, func(m Message) { pong = m }) {
+		t.Fatal("handle() did not consume a ping")
+	}
+	if pong.Command != HeartbeatPongCommand || argument(pong, 0) != "7" {
+		t.Errorf("ping answered with %+v", pong)
+	}
+}
+
+func TestHeartbeat_PingFloodWithoutReader(t *testing.T) {
+	p := NewBinaryMessageProtocol()
+	var flood []byte
+	for i := range 10000 {
+		flood = append(flood, p.Encode(Message{Command: HeartbeatPingCommand, Arguments: []string{strconv.Itoa(i)}})...)
+	}
+	flood = append(flood, p.Encode(Message{Command: "done"})...)
+
+	// The peers never read the pongs, which must neither stop the reading
+	// nor pile up goroutines.
+	t.Run("Server", func(t *testing.T) {
+		handled := make(chan struct{}, 1)
+		router := NewRouter()
+		router.Register("done", FuncHandler{Func: func(msg Message, out io.Writer) { handled <- struct{}{} }})
+		conn, err := net.Dial("tcp", startTestServer(t, NewServer(p, router)))
+		if err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		defer conn.Close()
+
+		before := runtime.NumGoroutine()
+		conn.SetWriteDeadline(time.Now().Add(5 * time.Second))
+		if _, err := conn.Write(flood); err != nil {
+			t.Fatalf("the server stopped reading: %v", err)
+		}
+		select {
+		case <-handled:
+		case <-time.After(5 * time.Second):
+			t.Fatal("the message after the pings was not handled")
+		}
+		if n := runtime.NumGoroutine(); n > before+10 {
+			t.Errorf("%d goroutines after the pings, %d before", n, before)
+		}
+	})
+
+	t.Run("Client", func(t *testing.T) {
+		handled := make(chan struct{}, 1)
+		client := NewClient(p)
+		client.RegisterHandler("done", FuncHandler{Func: func(msg Message, out io.Writer) { handled <- struct{}{} }})
+		peer := pipeClient(t, client)
+		defer client.Close()
+
+		before := runtime.NumGoroutine()
+		peer.SetWriteDeadline(time.Now().Add(5 * time.Second))
+		if _, err := peer.Write(flood); err != nil {
+			t.Fatalf("the client stopped reading: %v", err)
+		}
+		select {
+		case <-handled:
+		case <-time.After(5 * time.Second):
+			t.Fatal("the message after the pings was not handled")
+		}
+		if n := runtime.NumGoroutine(); n > before+10 {
+			t.Errorf("%d goroutines after the pings, %d before", n, before)
+		}
+	})
+}
@@ -0,0 +1,207 @@
+package portrelay
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"strings"
+	"unicode/utf8"
+)
+
+// FORMAT
+// JSONLinesProtocol: one JSON object per line,
+// {"command":"<command>","args":["<argument 1>",...],"id":<id>,"reply_to":<id>,"headers":{"<name>":"<value>",...}}
+// "args", "id", "reply_to" and "headers" are optional; "headers" holds the
+// message's metadata as string pairs. Blank lines between messages are ignored.
+// When an argument is not valid UTF-8, all arguments are sent base64 encoded
+// (standard alphabet, padded) in "args_base64" instead of "args".
+type JSONLinesProtocol struct {
+	// MaxLineLength bounds a single line, newline included. Zero means no limit.
+	MaxLineLength int
+}
+
+type jsonMessage struct {
+	Command *string           `json:"command"`
+	Args    []string          `json:"args,omitempty"`
+	Args64  []string          `json:"args_base64,omitempty"`
+	ID      uint64            `json:"id,omitempty"`
+	ReplyTo uint64            `json:"reply_to,omitempty"`
+	Headers map[string]string `json:"headers,omitempty"`
+}
+
+func NewJSONLinesProtocol() *JSONLinesProtocol {
+	return &JSONLinesProtocol{MaxLineLength: DefaultDecodeLimits.MaxFrameSize}
+}
+
+func (p *JSONLinesProtocol) Name() string {
+	return "json"
+}
+
+func (p *JSONLinesProtocol) Version() int {
+	return 1
+}
+
+// Encode returns the line of message, or nil when it cannot be encoded.
+// AppendEncode and EncodeTo report why.
+func (p *JSONLinesProtocol) Encode(message Message) []byte {
+	line, err := p.AppendEncode(nil, message)
+	if err != nil {
+		return nil
+	}
+	return line
+}
+
+// AppendEncode appends the line of message to dst. JSON strings cannot hold
+// arbitrary bytes, so binary arguments are base64 encoded and a command that
+// is not valid UTF-8 is refused rather than silently mangled.
+func (p *JSONLinesProtocol) AppendEncode(dst []byte, message Message) ([]byte, error) {
+	if !utf8.ValidString(message.Command) {
+		return dst, &EncodeError{
+			Stage:   "validate argument",
+			Index:   0,
+			Details: "the command must be valid UTF-8",
+			Err:     errors.New("invalid UTF-8"),
+		}
+	}
+	for name, value := range message.Headers {
+		if !utf8.ValidString(name) || !utf8.ValidString(value) {
+			return dst, &EncodeError{
+				Stage:   "validate header",
+				Index:   -1,
+				Details: fmt.Sprintf("header %q must be valid UTF-8", name),
+				Err:     errors.New("invalid UTF-8"),
+			}
+		}
+	}
+	if message.Values != nil {
+		return dst, &EncodeError{
+			Stage:   "validate value",
+			Index:   -1,
+			Details: "typed values are not supported by the json codec",
+			Err:     ErrValueType,
+		}
+	}
+
+	raw := jsonMessage{
+		Command: &message.Command,
+		Args:    message.Arguments,
+		ID:      message.ID,
+		ReplyTo: message.ReplyTo,
+		Headers: lowerHeaders(message.Headers),
+	}
+	for _, arg := range message.Arguments {
+		if !utf8.ValidString(arg) {
+			raw.Args, raw.Args64 = nil, base64Arguments(message.Arguments)
+			break
+		}
+	}
+
+	buf := bytes.NewBuffer(dst)
+	start := buf.Len()
+
+	enc := json.NewEncoder(buf)
+	enc.SetEscapeHTML(false)
+	// Encoding a struct of valid strings and integers cannot fail.
+	enc.Encode(raw)
+
+	if size := buf.Len() - start; p.MaxLineLength > 0 && size > p.MaxLineLength {
+		return buf.Bytes()[:start], encodeExceeded(-1, "line of %d bytes exceeds %d", size, p.MaxLineLength)
+	}
+	return buf.Bytes(), nil
+}
+
+func base64Arguments(args []string) []string {
+	encoded := make([]string, len(args))
+	for i, arg := range args {
+		encoded[i] = base64.StdEncoding.EncodeToString([]byte(arg))
+	}
+	return encoded
+}
+
+// EncodeTo writes the line of message to w in a single Write.
+func (p *JSONLinesProtocol) EncodeTo(w io.Writer, message Message) error {
+	return writeFrame(w, p, message)
+}
+
+func (p *JSONLinesProtocol) DecodeString(s string) (*Message, error) {
+	return p.Decode(strings.NewReader(s))
+}
+
+func (p *JSONLinesProtocol) DecodeBytes(b []byte) (*Message, error) {
+	return p.Decode(bytes.NewReader(b))
+}
+
+func (p *JSONLinesProtocol) Decode(reader io.Reader) (*Message, error) {
+	buf, ok := reader.(*bufio.Reader)
+	if !ok {
+		buf = bufio.NewReader(reader)
+	}
+	r := &frameReader{buf: buf, limits: DecodeLimits{MaxLineLength: p.MaxLineLength}}
+
+	var line string
+	for strings.TrimSpace(line) == "" {
+		var err error
+		line, err = r.readLine("read line", -1, "could not read a JSON line")
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	var raw jsonMessage
+	if err := json.Unmarshal([]byte(line), &raw); err != nil {
+		return nil, &DecodeError{
+			Stage:   "parse json",
+			Index:   -1,
+			Details: fmt.Sprintf("invalid line: %q", strings.TrimSpace(line)),
+			Err:     err,
+		}
+	}
+	if raw.Command == nil {
+		return nil, &DecodeError{
+			Stage:   "validate message",
+			Index:   -1,
+			Details: "missing \"command\" field",
+			Err:     errors.New("invalid format"),
+		}
+	}
+
+	if raw.Args != nil && raw.Args64 != nil {
+		return nil, &DecodeError{
+			Stage:   "validate message",
+			Index:   -1,
+			Details: "both \"args\" and \"args_base64\" fields",
+			Err:     errors.New("invalid format"),
+		}
+	}
+
+	msg := &Message{
+		Command:   *raw.Command,
+		Arguments: raw.Args,
+		ID:        raw.ID,
+		ReplyTo:   raw.ReplyTo,
+		Headers:   lowerHeaders(raw.Headers),
+	}
+	if raw.Args64 != nil {
+		msg.Arguments = make([]string, len(raw.Args64))
+		for i, arg := range raw.Args64 {
+			data, err := base64.StdEncoding.DecodeString(arg)
+			if err != nil {
+				return nil, &DecodeError{
+					Stage:   "decode base64 argument",
+					Index:   i + 1,
+					Details: fmt.Sprintf("invalid base64: %q", arg),
+					Err:     err,
+				}
+			}
+			msg.Arguments[i] = string(data)
+		}
+	}
+	if msg.Arguments == nil {
+		msg.Arguments = []string{}
+	}
+	return msg, nil
+}
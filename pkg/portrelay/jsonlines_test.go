@@ -0,0 +1,165 @@
+package portrelay
+
+import (
+	"errors"
+	"io"
+	"net"
+	"reflect"
+	"strconv"
+	"strings"
+	"testing"
+)
+
+func TestJSONLinesDecode(t *testing.T) {
+	tests := []struct {
+		name      string
+		input     string
+		expected  *Message
+		wantStage string
+	}{
+		{name: "Command without arguments", input: `{"command":"TestCommand"}` + "\n", expected: &Message{Command: "TestCommand", Arguments: []string{}}},
+		{name: "Command with arguments", input: `{"command":"TestCommand","args":["-t","TestArgument"]}` + "\n", expected: &Message{Command: "TestCommand", Arguments: []string{"-t", "TestArgument"}}},
+		{name: "Command with metadata", input: `{"command":"TestCommand","id":43,"reply_to":42}` + "\n", expected: &Message{Command: "TestCommand", Arguments: []string{}, ID: 43, ReplyTo: 42}},
+		{name: "Command with headers", input: `{"command":"TestCommand","headers":{"trace-id":"abc"}}` + "\n", expected: &Message{Command: "TestCommand", Arguments: []string{}, Headers: map[string]string{"trace-id": "abc"}}},
+		{name: "Wrong header type", input: `{"command":"TestCommand","headers":{"trace-id":1}}` + "\n", wantStage: "parse json"},
+		{name: "Leading blank lines", input: "\n  \n" + `{"command":"TestCommand"}` + "\n", expected: &Message{Command: "TestCommand", Arguments: []string{}}},
+		{name: "Last line without newline", input: `{"command":"TestCommand"}`, wantStage: "read line"},
+		{name: "Empty Input", input: "", wantStage: "read line"},
+		{name: "Invalid JSON", input: "Invalid Input\n", wantStage: "parse json"},
+		{name: "Wrong argument type", input: `{"command":"TestCommand","args":[1]}` + "\n", wantStage: "parse json"},
+		{name: "Missing command", input: `{"args":["-t"]}` + "\n", wantStage: "validate message"},
+		{name: "Base64 arguments", input: `{"command":"TestCommand","args_base64":["b2s=","AP8="]}` + "\n", expected: &Message{Command: "TestCommand", Arguments: []string{"ok", "\x00\xff"}}},
+		{name: "Invalid base64", input: `{"command":"TestCommand","args_base64":["b2s=","!"]}` + "\n", wantStage: "decode base64 argument"},
+		{name: "Both argument fields", input: `{"command":"TestCommand","args":["a"],"args_base64":["YQ=="]}` + "\n", wantStage: "validate message"},
+	}
+
+	p := NewJSONLinesProtocol()
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := p.DecodeString(tt.input)
+			if tt.wantStage != "" {
+				var decodeErr *DecodeError
+				if !errors.As(err, &decodeErr) || decodeErr.Stage != tt.wantStage {
+					t.Fatalf("Decode() error = %v, want stage %q", err, tt.wantStage)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			if !reflect.DeepEqual(got, tt.expected) {
+				t.Errorf("Decode() got = %v, want %v", got, tt.expected)
+			}
+		})
+	}
+}
+
+func TestJSONLinesEncode(t *testing.T) {
+	tests := []struct {
+		name     string
+		message  Message
+		expected string
+	}{
+		{name: "Command without arguments", message: Message{Command: "TestCommand"}, expected: `{"command":"TestCommand"}` + "\n"},
+		{name: "Command with arguments", message: Message{Command: "TestCommand", Arguments: []string{"-t", "<b>&"}}, expected: `{"command":"TestCommand","args":["-t","<b>&"]}` + "\n"},
+		{name: "Reply", message: Message{Command: "TestCommand", ID: 43, ReplyTo: 42}, expected: `{"command":"TestCommand","id":43,"reply_to":42}` + "\n"},
+		{name: "Headers", message: Message{Command: "TestCommand", Headers: map[string]string{"trace-id": "abc"}}, expected: `{"command":"TestCommand","headers":{"trace-id":"abc"}}` + "\n"},
+		{name: "Binary arguments", message: Message{Command: "TestCommand", Arguments: []string{"ok", "\x00\xff"}}, expected: `{"command":"TestCommand","args_base64":["b2s=","AP8="]}` + "\n"},
+	}
+
+	p := NewJSONLinesProtocol()
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := string(p.Encode(tt.message))
+			if got != tt.expected {
+				t.Errorf("Encode() got = %q, want %q", got, tt.expected)
+			}
+		})
+	}
+}
+
+func TestJSONLinesEncode_InvalidUTF8Command(t *testing.T) {
+	p := NewJSONLinesProtocol()
+	_, err := p.AppendEncode(nil, Message{Command: "\xff", Arguments: []string{"ok"}})
+	var encodeErr *EncodeError
+	if !errors.As(err, &encodeErr) {
+		t.Fatalf("AppendEncode() error = %v, want *EncodeError", err)
+	}
+	if encodeErr.Index != 0 {
+		t.Errorf("AppendEncode() error index = %d, want 0", encodeErr.Index)
+	}
+	if got := p.Encode(Message{Command: "\xff"}); got != nil {
+		t.Errorf("Encode() = %q, want nil", got)
+	}
+}
+
+func TestJSONLinesEncode_InvalidUTF8Header(t *testing.T) {
+	p := NewJSONLinesProtocol()
+	_, err := p.AppendEncode(nil, Message{Command: "TestCommand", Headers: map[string]string{"trace-id": "\xff"}})
+	var encodeErr *EncodeError
+	if !errors.As(err, &encodeErr) || encodeErr.Stage != "validate header" {
+		t.Fatalf("AppendEncode() error = %v, want stage %q", err, "validate header")
+	}
+}
+
+func TestJSONLinesEncode_LineLimit(t *testing.T) {
+	p := &JSONLinesProtocol{MaxLineLength: 16}
+	if _, err := p.AppendEncode(nil, Message{Command: "TestCommand"}); !errors.Is(err, ErrLimitExceeded) {
+		t.Errorf("AppendEncode() error = %v, want %v", err, ErrLimitExceeded)
+	}
+}
+
+func TestJSONLinesLineLimit(t *testing.T) {
+	p := &JSONLinesProtocol{MaxLineLength: 16}
+	_, err := p.DecodeString(`{"command":"TestCommand"}` + "\n")
+	if !errors.Is(err, ErrLimitExceeded) {
+		t.Errorf("Decode() error = %v, want %v", err, ErrLimitExceeded)
+	}
+}
+
+func TestJSONLinesServer(t *testing.T) {
+	p := NewJSONLinesProtocol()
+	router := NewRouter()
+	router.Register("add", FuncHandler{
+		Func: func(msg Message, out io.Writer) {
+			sum := 0
+			for _, arg := range msg.Arguments {
+				n, _ := strconv.Atoi(arg)
+				sum += n
+			}
+			Reply(out, msg, Message{Command: "sum", Arguments: []string{strconv.Itoa(sum)}})
+		},
+	})
+	addr := startTestServer(t, NewServer(p, router))
+
+	conn, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	defer conn.Close()
+
+	// What a shell script piping through nc would send.
+	io.WriteString(conn, `{"command":"add","args":["1","2","3"],"id":7}`+"\n")
+
+	got, err := p.Decode(conn)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	expected := &Message{Command: "sum", Arguments: []string{"6"}, ReplyTo: 7}
+	if !reflect.DeepEqual(got, expected) {
+		t.Errorf("reply got = %v, want %v", got, expected)
+	}
+}
+
+func TestJSONLinesDecoder_BackToBack(t *testing.T) {
+	dec := NewProtocolDecoder(NewJSONLinesProtocol(), strings.NewReader(`{"command":"a"}`+"\n"+`{"command":"b"}`+"\n"))
+	for _, want := range []string{"a", "b"} {
+		got, err := dec.Next()
+		if err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		if got.Command != want {
+			t.Errorf("Next() command = %q, want %q", got.Command, want)
+		}
+	}
+}
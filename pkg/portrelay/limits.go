@@ -0,0 +1,199 @@
+package portrelay
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"strings"
+)
+
+// StageLimitExceeded is the DecodeError and EncodeError stage reported when
+// a frame breaks one of its DecodeLimits.
+const StageLimitExceeded = "limit exceeded"
+
+// ErrLimitExceeded is wrapped by every DecodeError and EncodeError with stage StageLimitExceeded.
+var ErrLimitExceeded = errors.New("portrelay: limit exceeded")
+
+// DecodeLimits bounds how much a single frame may make the decoder read and
+// allocate. A zero field means no limit.
+//
+// A frame that breaks a limit is rejected as soon as the offending header is
+// read, before its payload is allocated or consumed. The stream is left
+// positioned right after that header and cannot be resynchronised, so Client
+// and Server close the connection when this happens.
+type DecodeLimits struct {
+	MaxArgs       int // arguments per frame, command included
+	MaxArgSize    int // bytes per argument
+	MaxFrameSize  int // bytes per frame, header lines included
+	MaxLineLength int // bytes per header line, newline included
+	MaxDepth      int // nesting of array and map values
+	MaxValues     int // elements of array and map values per frame, at any depth
+}
+
+// DefaultDecodeLimits are the limits used by NewBinaryMessageProtocol.
+var DefaultDecodeLimits = DecodeLimits{
+	MaxArgs:       1024,
+	MaxArgSize:    8 << 20,
+	MaxFrameSize:  16 << 20,
+	MaxLineLength: 1024,
+	MaxDepth:      32,
+	MaxValues:     1 << 16,
+}
+
+// frameReader reads the parts of a single frame while enforcing DecodeLimits.
+type frameReader struct {
+	buf    *bufio.Reader
+	limits DecodeLimits
+	size   int
+	values int
+}
+
+// readLine reads one header line. Every error it returns is a *DecodeError,
+// built from stage, index and details unless a limit was exceeded.
+func (r *frameReader) readLine(stage string, index int, details string) (string, error) {
+	var line []byte
+	for {
+		chunk, err := r.buf.ReadSlice('\n')
+		line = append(line, chunk...)
+		if r.limits.MaxLineLength > 0 && len(line) > r.limits.MaxLineLength {
+			return "", exceeded(index, "line longer than %d bytes", r.limits.MaxLineLength)
+		}
+		if err == bufio.ErrBufferFull {
+			continue
+		}
+		if err != nil {
+			return "", &DecodeError{Stage: stage, Index: index, Details: details, Err: err}
+		}
+		break
+	}
+
+	if err := r.grow(index, len(line)); err != nil {
+		return "", err
+	}
+	return string(line), nil
+}
+
+// readData reads n bytes of argument data.
+func (r *frameReader) readData(index int, n int) ([]byte, error) {
+	if r.limits.MaxArgSize > 0 && n > r.limits.MaxArgSize {
+		return nil, exceeded(index, "argument of %d bytes exceeds %d", n, r.limits.MaxArgSize)
+	}
+	if err := r.grow(index, n); err != nil {
+		return nil, err
+	}
+
+	data := make([]byte, n)
+	read, err := io.ReadFull(r.buf, data)
+	if err != nil {
+		return nil, &DecodeError{
+			Stage:   "read argument data",
+			Index:   index,
+			Details: fmt.Sprintf("expected %d bytes, got %d", n, read),
+			Err:     err,
+		}
+	}
+	return data, nil
+}
+
+// readBulk reads the data of the bulk argument whose "$<length>\n" line is
+// line, and the newline after it.
+func (r *frameReader) readBulk(index int, line string) (string, error) {
+	var argLen int
+	if _, err := fmt.Sscanf(line, "$%d\n", &argLen); err != nil {
+		return "", &DecodeError{
+			Stage:   "parse argument length",
+			Index:   index,
+			Details: fmt.Sprintf("invalid line: %q", strings.TrimSpace(line)),
+			Err:     err,
+		}
+	}
+	if argLen < 0 {
+		return "", &DecodeError{
+			Stage:   "parse argument length",
+			Index:   index,
+			Details: fmt.Sprintf("negative length %d", argLen),
+			Err:     fmt.Errorf("invalid format"),
+		}
+	}
+
+	// Read actual argument data
+	argData, err := r.readData(index, argLen)
+	if err != nil {
+		return "", err
+	}
+
+	// Expect newline after data
+	newline, err := r.readLine("read newline after data", index, "could not read expected newline after argument")
+	if err != nil {
+		return "", err
+	}
+	if newline != "\n" {
+		return "", &DecodeError{
+			Stage:   "validate newline after data",
+			Index:   index,
+			Details: fmt.Sprintf("expected newline, got %q", strings.TrimRight(newline, "\r\n")),
+			Err:     fmt.Errorf("invalid format"),
+		}
+	}
+	return string(argData), nil
+}
+
+func (r *frameReader) checkArgs(n int) error {
+	if r.limits.MaxArgs > 0 && n > r.limits.MaxArgs {
+		return exceeded(-1, "%d arguments exceed %d", n, r.limits.MaxArgs)
+	}
+	return nil
+}
+
+func (r *frameReader) grow(index int, n int) error {
+	r.size += n
+	if r.limits.MaxFrameSize > 0 && r.size > r.limits.MaxFrameSize {
+		return exceeded(index, "frame larger than %d bytes", r.limits.MaxFrameSize)
+	}
+	return nil
+}
+
+// addValues counts the n elements of an array or map value, before they are
+// read, against MaxValues.
+func (r *frameReader) addValues(index int, n int) error {
+	r.values += n
+	if r.limits.MaxValues > 0 && r.values > r.limits.MaxValues {
+		return exceeded(index, "more than %d nested values in the frame", r.limits.MaxValues)
+	}
+	return nil
+}
+
+// checkValueCount refuses to encode values with more elements, at any
+// depth, than limits allow.
+func checkValueCount(values []Value, limits DecodeLimits) error {
+	if limits.MaxValues <= 0 {
+		return nil
+	}
+	n := 0
+	for _, v := range values {
+		n += v.nested()
+	}
+	if n > limits.MaxValues {
+		return encodeExceeded(-1, "%d nested values exceed %d", n, limits.MaxValues)
+	}
+	return nil
+}
+
+func exceeded(index int, format string, args ...any) *DecodeError {
+	return &DecodeError{
+		Stage:   StageLimitExceeded,
+		Index:   index,
+		Details: fmt.Sprintf(format, args...),
+		Err:     ErrLimitExceeded,
+	}
+}
+
+func encodeExceeded(index int, format string, args ...any) *EncodeError {
+	return &EncodeError{
+		Stage:   StageLimitExceeded,
+		Index:   index,
+		Details: fmt.Sprintf(format, args...),
+		Err:     ErrLimitExceeded,
+	}
+}
@@ -0,0 +1,588 @@
+package portrelay
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// MuxWindow is how many bytes a stream may be sent before its reader has
+// consumed them. Every stream starts with this much credit in each direction.
+const MuxWindow = 256 << 10
+
+// muxMaxPayload is the largest data frame sent, so that a stream with a lot
+// of credit does not hold up the others for long.
+const muxMaxPayload = 16 << 10
+
+// muxBacklog is how many opened streams may wait for Accept, and how many
+// resets may wait to be sent.
+const muxBacklog = 256
+
+// muxCloseTimeout is how long Close waits to tell the peer the session is
+// over before it closes the connection anyway.
+const muxCloseTimeout = time.Second
+
+var (
+	// ErrMuxClosed is returned by a MuxSession and its streams once the
+	// session is closed.
+	ErrMuxClosed = fmt.Errorf("portrelay: mux session closed: %w", net.ErrClosed)
+	// ErrStreamReset is returned by a MuxStream the peer gave up on.
+	ErrStreamReset = errors.New("portrelay: mux stream reset by peer")
+)
+
+// FORMAT
+// Every mux frame starts with a 10 byte header:
+//
+//	type (1) | flags (1) | stream ID (4, big endian) | length (4, big endian)
+//
+// A data frame is followed by length bytes of payload. A window update grants
+// the stream length more bytes of credit and has no payload. A go away frame
+// ends the session. The flags are SYN on the first frame of a new stream, FIN
+// when its sender will not write any more and RST when it gave up on the
+// stream altogether. The dialing side opens odd stream IDs, the accepting side
+// even ones.
+
+const muxHeaderSize = 10
+
+const (
+	muxData byte = iota
+	muxWindowUpdate
+	muxGoAway
+)
+
+const (
+	muxSYN byte = 1 << iota
+	muxFIN
+	muxRST
+)
+
+// MuxSession carries numbered logical streams over a single connection,
+// each with its own flow control, so that a slow transfer on one stream does
+// not hold up the others. Either side may open streams and accept them.
+//
+// MuxSession is a net.Listener, so a Server can Serve the streams the peer
+// opens, and MuxSession.Dial can be given to Client.SetDialer to run a Client
+// on a stream of its own. Every stream then carries its own MessageProtocol
+// traffic.
+type MuxSession struct {
+	conn   net.Conn
+	nextID atomic.Uint32
+
+	writeMu sync.Mutex
+	resets  chan uint32 // streams to reset, sent by writeResets
+
+	mu      sync.Mutex
+	streams map[uint32]*MuxStream
+	accept  chan *MuxStream
+	done    chan struct{}
+	err     error
+}
+
+// NewMuxClient starts a session over conn on the side that dialed it.
+func NewMuxClient(conn net.Conn) *MuxSession {
+	return newMuxSession(conn, 1)
+}
+
+// NewMuxServer starts a session over conn on the side that accepted it.
+func NewMuxServer(conn net.Conn) *MuxSession {
+	return newMuxSession(conn, 2)
+}
+
+func newMuxSession(conn net.Conn, firstID uint32) *MuxSession {
+	s := &MuxSession{
+		conn:    conn,
+		streams: make(map[uint32]*MuxStream),
+		accept:  make(chan *MuxStream, muxBacklog),
+		resets:  make(chan uint32, muxBacklog),
+		done:    make(chan struct{}),
+	}
+	s.nextID.Store(firstID)
+	go s.readLoop()
+	go s.writeResets()
+	return s
+}
+
+// Open opens a new stream.
+func (s *MuxSession) Open() (*MuxStream, error) {
+	id := s.nextID.Add(2) - 2
+
+	stream := newMuxStream(s, id)
+	s.mu.Lock()
+	if s.err != nil {
+		s.mu.Unlock()
+		return nil, s.err
+	}
+	s.streams[id] = stream
+	s.mu.Unlock()
+
+	if err := s.writeFrame(muxWindowUpdate, muxSYN, id, 0, nil); err != nil {
+		return nil, err
+	}
+	return stream, nil
+}
+
+// Dial opens a new stream. It ignores network and address and has the
+// signature of a Dialer.
+func (s *MuxSession) Dial(ctx context.Context, network, address string) (net.Conn, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	return s.Open()
+}
+
+// Accept waits for the peer to open a stream.
+func (s *MuxSession) Accept() (net.Conn, error) {
+	return s.AcceptStream()
+}
+
+// AcceptStream waits for the peer to open a stream.
+func (s *MuxSession) AcceptStream() (*MuxStream, error) {
+	select {
+	case stream := <-s.accept:
+		return stream, nil
+	case <-s.done:
+		return nil, s.err
+	}
+}
+
+// Addr returns the local address of the underlying connection.
+func (s *MuxSession) Addr() net.Addr {
+	return s.conn.LocalAddr()
+}
+
+// Close tells the peer the session is over, closes the underlying
+// connection and fails every stream with ErrMuxClosed. A peer that does not
+// read is not told.
+func (s *MuxSession) Close() error {
+	// The deadline also fails a write that holds up the go away frame.
+	s.conn.SetWriteDeadline(time.Now().Add(muxCloseTimeout))
+	s.writeFrame(muxGoAway, 0, 0, 0, nil)
+	s.shutdown(ErrMuxClosed)
+	return nil
+}
+
+// Done is closed once the session is closed, by either side or because the
+// connection failed.
+func (s *MuxSession) Done() <-chan struct{} {
+	return s.done
+}
+
+// NumStreams returns the number of streams currently open.
+func (s *MuxSession) NumStreams() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return len(s.streams)
+}
+
+func (s *MuxSession) shutdown(err error) {
+	s.mu.Lock()
+	if s.err != nil {
+		s.mu.Unlock()
+		return
+	}
+	s.err = err
+	streams := s.streams
+	s.streams = make(map[uint32]*MuxStream)
+	close(s.done)
+	s.mu.Unlock()
+
+	s.conn.Close()
+	for _, stream := range streams {
+		stream.fail(err)
+	}
+}
+
+func (s *MuxSession) writeFrame(typ, flags byte, id, length uint32, payload []byte) error {
+	var hdr [muxHeaderSize]byte
+	hdr[0] = typ
+	hdr[1] = flags
+	binary.BigEndian.PutUint32(hdr[2:], id)
+	binary.BigEndian.PutUint32(hdr[6:], length)
+
+	s.writeMu.Lock()
+	defer s.writeMu.Unlock()
+	select {
+	case <-s.done:
+		return s.closedErr()
+	default:
+	}
+	bufs := net.Buffers{hdr[:], payload}
+	if _, err := bufs.WriteTo(s.conn); err != nil {
+		s.shutdown(fmt.Errorf("%w: %w", ErrMuxClosed, err))
+		return s.closedErr()
+	}
+	return nil
+}
+
+// reset queues a RST for stream id, so that the read loop never waits to
+// send one. Resets that find the queue full are dropped; the peer is not
+// reading then, and frames for the stream are ignored anyway.
+func (s *MuxSession) reset(id uint32) {
+	select {
+	case s.resets <- id:
+	default:
+	}
+}
+
+func (s *MuxSession) writeResets() {
+	for {
+		select {
+		case id := <-s.resets:
+			s.writeFrame(muxWindowUpdate, muxRST, id, 0, nil)
+		case <-s.done:
+			return
+		}
+	}
+}
+
+func (s *MuxSession) closedErr() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.err
+}
+
+func (s *MuxSession) readLoop() {
+	err := s.readFrames()
+	if errors.Is(err, io.EOF) || errors.Is(err, net.ErrClosed) {
+		err = ErrMuxClosed
+	} else {
+		err = fmt.Errorf("%w: %w", ErrMuxClosed, err)
+	}
+	s.shutdown(err)
+}
+
+func (s *MuxSession) readFrames() error {
+	var hdr [muxHeaderSize]byte
+	for {
+		if _, err := io.ReadFull(s.conn, hdr[:]); err != nil {
+			return err
+		}
+		typ, flags := hdr[0], hdr[1]
+		id := binary.BigEndian.Uint32(hdr[2:])
+		length := binary.BigEndian.Uint32(hdr[6:])
+
+		if typ == muxGoAway {
+			return io.EOF
+		}
+		if typ != muxData && typ != muxWindowUpdate {
+			return &DecodeError{Stage: "read mux frame", Index: -1, Details: fmt.Sprintf("stream %d", id), Err: fmt.Errorf("unknown frame type %d", typ)}
+		}
+
+		stream, err := s.streamFor(id, flags)
+		if err != nil {
+			return err
+		}
+
+		if typ == muxData {
+			if length > MuxWindow {
+				return &DecodeError{Stage: "read mux frame", Index: -1, Details: fmt.Sprintf("stream %d", id), Err: fmt.Errorf("%w: %d byte frame exceeds the window", ErrLimitExceeded, length)}
+			}
+			payload := make([]byte, length)
+			if _, err := io.ReadFull(s.conn, payload); err != nil {
+				return err
+			}
+			if stream != nil {
+				closed, err := stream.receive(payload)
+				if err != nil {
+					return &DecodeError{Stage: "read mux frame", Index: -1, Details: fmt.Sprintf("stream %d", id), Err: err}
+				}
+				if closed {
+					// Nobody reads the stream any more; stop the peer writing to it.
+					s.remove(id)
+					s.reset(id)
+					continue
+				}
+			}
+		} else if stream != nil {
+			stream.grant(length)
+		}
+
+		if stream != nil && flags&(muxFIN|muxRST) != 0 {
+			stream.remoteClose(flags&muxRST != 0)
+		}
+	}
+}
+
+// streamFor returns the stream a frame is for, opening it when the frame
+// carries SYN. It returns nil for frames of streams that are already gone.
+func (s *MuxSession) streamFor(id uint32, flags byte) (*MuxStream, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	stream := s.streams[id]
+	if flags&muxSYN == 0 {
+		return stream, nil
+	}
+	if stream != nil || id%2 == s.nextID.Load()%2 {
+		return nil, &DecodeError{Stage: "open mux stream", Index: -1, Details: fmt.Sprintf("stream %d", id), Err: errors.New("invalid stream id")}
+	}
+
+	stream = newMuxStream(s, id)
+	select {
+	case s.accept <- stream:
+		s.streams[id] = stream
+	default:
+		// Nobody is accepting; turn the stream down rather than hold it.
+		s.reset(id)
+		return nil, nil
+	}
+	return stream, nil
+}
+
+func (s *MuxSession) remove(id uint32) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	delete(s.streams, id)
+}
+
+// MuxStream is one logical stream of a MuxSession. It is a net.Conn.
+type MuxStream struct {
+	id      uint32
+	session *MuxSession
+
+	mu         sync.Mutex
+	buf        bytes.Buffer
+	recvWindow uint32 // bytes the peer may still send
+	unacked    uint32 // bytes read but not yet granted back to the peer
+	sendWindow uint32 // bytes we may still send
+	readDone   bool   // the peer sent FIN
+	writeDone  bool   // we sent FIN
+	err        error  // reset by the peer or the session closed
+
+	readDeadline  time.Time
+	writeDeadline time.Time
+	readReady     chan struct{}
+	writeReady    chan struct{}
+}
+
+func newMuxStream(session *MuxSession, id uint32) *MuxStream {
+	return &MuxStream{
+		id:         id,
+		session:    session,
+		recvWindow: MuxWindow,
+		sendWindow: MuxWindow,
+		readReady:  make(chan struct{}, 1),
+		writeReady: make(chan struct{}, 1),
+	}
+}
+
+// ID returns the stream's number within its session.
+func (s *MuxStream) ID() uint32 {
+	return s.id
+}
+
+func (s *MuxStream) Read(p []byte) (int, error) {
+	for {
+		s.mu.Lock()
+		if s.buf.Len() > 0 {
+			n, _ := s.buf.Read(p)
+			s.unacked += uint32(n)
+			var grant uint32
+			if s.unacked >= MuxWindow/2 && !s.readDone {
+				grant, s.unacked = s.unacked, 0
+				s.recvWindow += grant
+			}
+			s.mu.Unlock()
+			if grant > 0 {
+				s.session.writeFrame(muxWindowUpdate, 0, s.id, grant, nil)
+			}
+			return n, nil
+		}
+		err := s.err
+		if err == nil && s.readDone {
+			err = io.EOF
+		}
+		deadline := s.readDeadline
+		s.mu.Unlock()
+
+		if err != nil {
+			return 0, err
+		}
+		if err := wait(s.readReady, deadline); err != nil {
+			return 0, err
+		}
+	}
+}
+
+func (s *MuxStream) Write(p []byte) (int, error) {
+	var written int
+	for len(p) > 0 {
+		s.mu.Lock()
+		err := s.err
+		if err == nil && s.writeDone {
+			err = net.ErrClosed
+		}
+		n := min(uint32(len(p)), s.sendWindow, muxMaxPayload)
+		s.sendWindow -= n
+		deadline := s.writeDeadline
+		s.mu.Unlock()
+
+		if err != nil {
+			return written, err
+		}
+		if n == 0 {
+			if err := wait(s.writeReady, deadline); err != nil {
+				return written, err
+			}
+			continue
+		}
+		if err := s.session.writeFrame(muxData, 0, s.id, n, p[:n]); err != nil {
+			return written, err
+		}
+		written += int(n)
+		p = p[n:]
+	}
+	return written, nil
+}
+
+// Close tells the peer nothing more will be written, like CloseWrite, and
+// stops reading: data the peer sends afterwards is discarded.
+func (s *MuxStream) Close() error {
+	s.CloseWrite()
+	s.mu.Lock()
+	if s.err == nil {
+		s.err = net.ErrClosed
+	}
+	s.buf.Reset()
+	done := s.readDone
+	s.mu.Unlock()
+	notify(s.readReady)
+	notify(s.writeReady)
+	if done {
+		s.session.remove(s.id)
+	}
+	return nil
+}
+
+// CloseWrite tells the peer nothing more will be written; its reads return
+// io.EOF once it has read everything before that. The stream can still be read.
+func (s *MuxStream) CloseWrite() error {
+	s.mu.Lock()
+	if s.writeDone || s.err != nil {
+		s.mu.Unlock()
+		return nil
+	}
+	s.writeDone = true
+	done := s.readDone
+	s.mu.Unlock()
+
+	err := s.session.writeFrame(muxWindowUpdate, muxFIN, s.id, 0, nil)
+	if done {
+		s.session.remove(s.id)
+	}
+	return err
+}
+
+func (s *MuxStream) LocalAddr() net.Addr {
+	return s.session.conn.LocalAddr()
+}
+
+func (s *MuxStream) RemoteAddr() net.Addr {
+	return s.session.conn.RemoteAddr()
+}
+
+func (s *MuxStream) SetDeadline(t time.Time) error {
+	s.SetReadDeadline(t)
+	return s.SetWriteDeadline(t)
+}
+
+func (s *MuxStream) SetReadDeadline(t time.Time) error {
+	s.mu.Lock()
+	s.readDeadline = t
+	s.mu.Unlock()
+	notify(s.readReady)
+	return nil
+}
+
+func (s *MuxStream) SetWriteDeadline(t time.Time) error {
+	s.mu.Lock()
+	s.writeDeadline = t
+	s.mu.Unlock()
+	notify(s.writeReady)
+	return nil
+}
+
+// receive buffers data from the peer, which must not exceed its credit. It
+// reports whether the stream was closed, in which case data is dropped.
+func (s *MuxStream) receive(data []byte) (bool, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if uint32(len(data)) > s.recvWindow {
+		return false, fmt.Errorf("%w: %d bytes sent with %d bytes of credit", ErrLimitExceeded, len(data), s.recvWindow)
+	}
+	if s.err != nil {
+		return true, nil
+	}
+	s.recvWindow -= uint32(len(data))
+	s.buf.Write(data)
+	notify(s.readReady)
+	return false, nil
+}
+
+func (s *MuxStream) grant(n uint32) {
+	s.mu.Lock()
+	s.sendWindow += n
+	s.mu.Unlock()
+	notify(s.writeReady)
+}
+
+func (s *MuxStream) remoteClose(reset bool) {
+	s.mu.Lock()
+	s.readDone = true
+	if reset && s.err == nil {
+		s.err = ErrStreamReset
+	}
+	done := s.writeDone || reset
+	s.mu.Unlock()
+	notify(s.readReady)
+	notify(s.writeReady)
+	if done {
+		s.session.remove(s.id)
+	}
+}
+
+func (s *MuxStream) fail(err error) {
+	s.mu.Lock()
+	if s.err == nil {
+		s.err = err
+	}
+	s.mu.Unlock()
+	notify(s.readReady)
+	notify(s.writeReady)
+}
+
+// notify wakes up whoever waits on ready, without blocking.
+func notify(ready chan struct{}) {
+	select {
+	case ready <- struct{}{}:
+	default:
+	}
+}
+
+// wait blocks until ready is notified or deadline passes.
+func wait(ready chan struct{}, deadline time.Time) error {
+	if deadline.IsZero() {
+		<-ready
+		return nil
+	}
+	d := time.Until(deadline)
+	if d <= 0 {
+		return os.ErrDeadlineExceeded
+	}
+	timer := time.NewTimer(d)
+	defer timer.Stop()
+	select {
+	case <-ready:
+		return nil
+	case <-timer.C:
+		return os.ErrDeadlineExceeded
+	}
+}
@@ -0,0 +1,276 @@
+package portrelay
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"errors"
+	"io"
+	"net"
+	"os"
+	"runtime"
+	"sync"
+	"testing"
+	"time"
+)
+
+func newMuxPair(t *testing.T) (client, server *MuxSession) {
+	t.Helper()
+	a, b := net.Pipe()
+	client, server = NewMuxClient(a), NewMuxServer(b)
+	t.Cleanup(func() {
+		client.Close()
+		server.Close()
+	})
+	return client, server
+}
+
+func TestMux_OpenAccept(t *testing.T) {
+	client, server := newMuxPair(t)
+
+	// Streams can be opened from either side.
+	for _, pair := range []struct {
+		name         string
+		open, accept *MuxSession
+	}{
+		{"client opens", client, server},
+		{"server opens", server, client},
+	} {
+		t.Run(pair.name, func(t *testing.T) {
+			opened, err := pair.open.Open()
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			accepted, err := pair.accept.AcceptStream()
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			if opened.ID() != accepted.ID() {
+				t.Errorf("accepted stream %d, want %d", accepted.ID(), opened.ID())
+			}
+
+			go func() {
+				opened.Write([]byte("hello"))
+				opened.CloseWrite()
+			}()
+			got, err := io.ReadAll(accepted)
+			if err != nil || string(got) != "hello" {
+				t.Errorf("ReadAll() = %q, %v, want hello", got, err)
+			}
+
+			accepted.Write([]byte("bye"))
+			accepted.Close()
+			got, err = io.ReadAll(opened)
+			if err != nil || string(got) != "bye" {
+				t.Errorf("ReadAll() = %q, %v, want bye", got, err)
+			}
+			opened.Close()
+		})
+	}
+
+	deadline := time.Now().Add(5 * time.Second)
+	for client.NumStreams()+server.NumStreams() > 0 && time.Now().Before(deadline) {
+		time.Sleep(time.Millisecond)
+	}
+	if n := client.NumStreams() + server.NumStreams(); n != 0 {
+		t.Errorf("%d streams left open after both sides closed them", n)
+	}
+}
+
+// TestMux_FlowControl checks that a stream nobody reads does not hold up
+// the others.
+func TestMux_FlowControl(t *testing.T) {
+	client, server := newMuxPair(t)
+
+	bulk, _ := client.Open()
+	bulkPeer, _ := server.AcceptStream()
+	body := bytes.Repeat([]byte("x"), 4*MuxWindow)
+	written := make(chan error, 1)
+	go func() {
+		_, err := bulk.Write(body)
+		bulk.Close()
+		written <- err
+	}()
+
+	control, _ := client.Open()
+	controlPeer, _ := server.AcceptStream()
+	control.SetDeadline(time.Now().Add(5 * time.Second))
+	controlPeer.SetDeadline(time.Now().Add(5 * time.Second))
+	if _, err := control.Write([]byte("ping")); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	buf := make([]byte, 4)
+	if _, err := io.ReadFull(controlPeer, buf); err != nil || string(buf) != "ping" {
+		t.Fatalf("ReadFull() = %q, %v, want ping", buf, err)
+	}
+
+	select {
+	case <-written:
+		t.Fatal("Write() went past the window of a stream nobody reads")
+	default:
+	}
+
+	got, err := io.ReadAll(bulkPeer)
+	if err != nil || !bytes.Equal(got, body) {
+		t.Errorf("ReadAll() got %d bytes, %v, want %d", len(got), err, len(body))
+	}
+	if err := <-written; err != nil {
+		t.Errorf("Write() error = %v", err)
+	}
+}
+
+func TestMux_ReadDeadline(t *testing.T) {
+	client, server := newMuxPair(t)
+
+	stream, _ := client.Open()
+	server.AcceptStream()
+	stream.SetReadDeadline(time.Now().Add(10 * time.Millisecond))
+	if _, err := stream.Read(make([]byte, 1)); !errors.Is(err, os.ErrDeadlineExceeded) {
+		t.Errorf("Read() error = %v, want %v", err, os.ErrDeadlineExceeded)
+	}
+}
+
+func TestMux_WriteAfterPeerClosed(t *testing.T) {
+	client, server := newMuxPair(t)
+
+	stream, _ := client.Open()
+	peer, _ := server.AcceptStream()
+	peer.Close()
+
+	stream.SetWriteDeadline(time.Now().Add(5 * time.Second))
+	var err error
+	for err == nil {
+		_, err = stream.Write(make([]byte, 1024))
+	}
+	if !errors.Is(err, ErrStreamReset) {
+		t.Errorf("Write() error = %v, want %v", err, ErrStreamReset)
+	}
+}
+
+func TestMux_Close(t *testing.T) {
+	client, server := newMuxPair(t)
+
+	stream, _ := client.Open()
+	peer, _ := server.AcceptStream()
+	client.Close()
+
+	if _, err := peer.Read(make([]byte, 1)); !errors.Is(err, ErrMuxClosed) {
+		t.Errorf("Read() on the peer's stream error = %v, want %v", err, ErrMuxClosed)
+	}
+	if _, err := stream.Write([]byte("x")); !errors.Is(err, net.ErrClosed) {
+		t.Errorf("Write() error = %v, want %v", err, net.ErrClosed)
+	}
+	if _, err := server.Accept(); !errors.Is(err, ErrMuxClosed) {
+		t.Errorf("Accept() error = %v, want %v", err, ErrMuxClosed)
+	}
+	if _, err := client.Open(); !errors.Is(err, ErrMuxClosed) {
+		t.Errorf("Open() error = %v, want %v", err, ErrMuxClosed)
+	}
+}
+
+func TestMux_CloseWithoutReader(t *testing.T) {
+	a, b := net.Pipe()
+	defer b.Close()
+	session := NewMuxClient(a)
+
+	// Nobody reads b, so the SYN holds up every other write.
+	go session.Open()
+	time.Sleep(10 * time.Millisecond)
+
+	closed := make(chan struct{})
+	go func() {
+		session.Close()
+		close(closed)
+	}()
+	select {
+	case <-closed:
+	case <-time.After(5 * time.Second):
+		t.Fatal("Close() blocked on a peer that does not read")
+	}
+}
+
+func TestMux_ResetsWithoutReader(t *testing.T) {
+	a, b := net.Pipe()
+	defer b.Close()
+	session := NewMuxServer(a)
+	defer session.Close()
+
+	// Streams nobody accepts are reset, but b never reads the resets.
+	before := runtime.NumGoroutine()
+	var hdr [muxHeaderSize]byte
+	hdr[0], hdr[1] = muxWindowUpdate, muxSYN
+	for id := uint32(1); id < 8*muxBacklog; id += 2 {
+		binary.BigEndian.PutUint32(hdr[2:], id)
+		b.SetWriteDeadline(time.Now().Add(5 * time.Second))
+		if _, err := b.Write(hdr[:]); err != nil {
+			t.Fatalf("the session stopped reading: %v", err)
+		}
+	}
+	if n := runtime.NumGoroutine(); n > before+10 {
+		t.Errorf("%d goroutines after the resets, %d before", n, before)
+	}
+}
+
+func TestMux_ClientsOverOneConnection(t *testing.T) {
+	router := NewRouter()
+	router.Register("echo", FuncHandler{
+		Func: func(msg Message, out io.Writer) {
+			Reply(out, msg, Message{Command: "echo", Arguments: msg.Arguments})
+		},
+	})
+
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	defer l.Close()
+	sessions := make(chan *MuxSession, 1)
+	go func() {
+		conn, err := l.Accept()
+		if err != nil {
+			return
+		}
+		sessions <- NewMuxServer(conn)
+	}()
+
+	conn, err := net.Dial("tcp", l.Addr().String())
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	session := NewMuxClient(conn)
+	defer session.Close()
+
+	// Every stream is served with its own protocol.
+	server := NewServer(nil, router)
+	server.Sniff = true
+	go server.Serve(<-sessions)
+	defer server.Close()
+
+	var wg sync.WaitGroup
+	for _, p := range []MessageProtocol{NewBinaryMessageProtocol(), NewJSONLinesProtocol(), NewBinaryMessageProtocol()} {
+		client := NewClient(p)
+		client.SetDialer(session.Dial)
+		if err := client.Start(context.Background(), "mux", "0"); err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+			defer cancel()
+			resp, err := client.Call(ctx, Message{Command: "echo", Arguments: []string{ProtocolName(p)}})
+			if err != nil {
+				t.Errorf("%s: unexpected error: %v", ProtocolName(p), err)
+				return
+			}
+			if len(resp.Arguments) != 1 || resp.Arguments[0] != ProtocolName(p) {
+				t.Errorf("%s: reply got = %+v", ProtocolName(p), resp)
+			}
+		}()
+	}
+	wg.Wait()
+
+	if n := server.ConnCount(); n != 3 {
+		t.Errorf("ConnCount() = %d, want 3", n)
+	}
+}
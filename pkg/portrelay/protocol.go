@@ -3,43 +3,252 @@ package portrelay
 import (
 	"bufio"
 	"bytes"
+	"errors"
 	"fmt"
 	"io"
+	"strconv"
 	"strings"
 )
 
+// MessageProtocol turns messages into frames and back.
+//
+// Decode reads exactly one frame. When reader is a *bufio.Reader it must read
+// through it directly instead of wrapping it again, so that a Decoder can call
+// Decode repeatedly on the same stream without losing buffered bytes.
+//
+// Encode returns nil for a message it cannot encode. Protocols may implement
+// FrameEncoder to say why, and VersionedProtocol to name their wire format
+// in the opening handshake.
 type MessageProtocol interface {
 	Encode(message Message) []byte
 	Decode(reader io.Reader) (*Message, error)
 }
 
+// FrameEncoder is implemented by protocols that report messages they cannot
+// encode with an *EncodeError. Neither method writes anything in that case,
+// so the stream stays usable.
+type FrameEncoder interface {
+	AppendEncode(dst []byte, message Message) ([]byte, error)
+	EncodeTo(w io.Writer, message Message) error
+}
+
+// ErrNotEncodable is wrapped by the EncodeError of a message that a protocol
+// without FrameEncoder could not encode.
+var ErrNotEncodable = errors.New("portrelay: message cannot be encoded")
+
+// AppendEncode appends the frame of message to dst with p's AppendEncode,
+// or with Encode when p does not implement FrameEncoder.
+func AppendEncode(p MessageProtocol, dst []byte, message Message) ([]byte, error) {
+	if e, ok := p.(FrameEncoder); ok {
+		return e.AppendEncode(dst, message)
+	}
+	frame := p.Encode(message)
+	if frame == nil {
+		return dst, &EncodeError{
+			Stage:   "encode",
+			Index:   -1,
+			Details: fmt.Sprintf("%s returned no frame", ProtocolName(p)),
+			Err:     ErrNotEncodable,
+		}
+	}
+	return append(dst, frame...), nil
+}
+
+// EncodeTo writes the frame of message to w in a single Write, with p's
+// EncodeTo when it implements FrameEncoder.
+func EncodeTo(p MessageProtocol, w io.Writer, message Message) error {
+	if e, ok := p.(FrameEncoder); ok {
+		return e.EncodeTo(w, message)
+	}
+	return writeFrame(w, p, message)
+}
+
+// Message is a command and its arguments. Arguments are Go strings, which
+// hold arbitrary bytes: NUL bytes and binary payloads are carried unchanged
+// by BinaryMessageProtocol. The ArgBytes accessors work with them as []byte.
 type Message struct {
 	Command   string
 	Arguments []string
+	// ID identifies a request so that its reply can be matched to it. Zero means no ID.
+	ID uint64
+	// ReplyTo is the ID of the request this message answers. Zero means it is not a reply.
+	ReplyTo uint64
+	// Headers carry metadata such as HeaderTraceID next to the arguments.
+	// Nil means no headers.
+	Headers map[string]string
+	// Values are the typed arguments. It is nil when every argument is a
+	// plain string; otherwise it has an entry for every argument, takes
+	// precedence over Arguments when encoding, and Arguments hold the text
+	// form of each value.
+	Values []Value
+	// Stream reads the body of a message sent with SendStream, on the
+	// receiving side. It is never encoded.
+	Stream io.Reader
+}
+
+// NewBytesMessage returns a message with the byte slices in args as its arguments.
+func NewBytesMessage(command string, args ...[]byte) Message {
+	msg := Message{Command: command, Arguments: make([]string, 0, len(args))}
+	for _, arg := range args {
+		msg.AddArgBytes(arg)
+	}
+	return msg
+}
+
+// ArgBytes returns a copy of argument i, or nil when there is no such argument.
+func (m Message) ArgBytes(i int) []byte {
+	if i < 0 || i >= len(m.Arguments) {
+		return nil
+	}
+	return []byte(m.Arguments[i])
+}
+
+// ArgsBytes returns copies of all arguments.
+func (m Message) ArgsBytes() [][]byte {
+	args := make([][]byte, len(m.Arguments))
+	for i, arg := range m.Arguments {
+		args[i] = []byte(arg)
+	}
+	return args
+}
+
+// AddArgBytes appends a copy of b to the arguments.
+func (m *Message) AddArgBytes(b []byte) {
+	m.Arguments = append(m.Arguments, string(b))
 }
 
 // FORMAT
 // BasicMessageProtocol: "*<number of arguments>\n$<number of bytes of argument 1>\n<argument data>\n..."
-type BinaryMessageProtocol struct{}
+// The frame may be preceded by "@<id>\n" and "^<reply to id>\n" lines when ID or ReplyTo is set,
+// by headers when Headers is set, and by a "!..." signature line when a Signer is set.
+type BinaryMessageProtocol struct {
+	// Limits bounds the frames Decode accepts. The zero value means no limits.
+	Limits DecodeLimits
+	// Signer, when set, signs every encoded frame and makes Decode reject
+	// frames without a valid signature. A frame rejected this way has been
+	// read completely, so the next one can still be decoded.
+	Signer *Signer
+}
 
 func NewBinaryMessageProtocol() *BinaryMessageProtocol {
-	return &BinaryMessageProtocol{}
+	return &BinaryMessageProtocol{Limits: DefaultDecodeLimits}
 }
 
+func (p *BinaryMessageProtocol) Name() string {
+	return "binary"
+}
+
+func (p *BinaryMessageProtocol) Version() int {
+	return 1
+}
+
+// Encode returns the frame of message, or nil when it cannot be encoded.
+// AppendEncode and EncodeTo report why.
 func (p *BinaryMessageProtocol) Encode(message Message) []byte {
+	frame, err := p.AppendEncode(nil, message)
+	if err != nil {
+		return nil
+	}
+	return frame
+}
 
-	var builder strings.Builder
+// AppendEncode appends the frame of message to dst. Frames that break
+// Limits are refused, since a peer with the same limits would reject them.
+func (p *BinaryMessageProtocol) AppendEncode(dst []byte, message Message) ([]byte, error) {
+	if n := message.argCount() + 1; p.Limits.MaxArgs > 0 && n > p.Limits.MaxArgs {
+		return dst, encodeExceeded(-1, "%d arguments exceed %d", n, p.Limits.MaxArgs)
+	}
+	if err := checkHeaders(message.Headers, p.Limits); err != nil {
+		return dst, err
+	}
+	if message.Values != nil {
+		if err := checkValue(BulkValue(message.Command), 0, 0, p.Limits); err != nil {
+			return dst, err
+		}
+		for i, v := range message.Values {
+			if err := checkValue(v, i+1, 1, p.Limits); err != nil {
+				return dst, err
+			}
+		}
+		if err := checkValueCount(message.Values, p.Limits); err != nil {
+			return dst, err
+		}
+	} else if p.Limits.MaxArgSize > 0 {
+		if i := indexArgument(message, func(arg string) bool { return len(arg) > p.Limits.MaxArgSize }); i >= 0 {
+			return dst, encodeExceeded(i, "argument exceeds %d bytes", p.Limits.MaxArgSize)
+		}
+	}
 
-	builder.WriteString(fmt.Sprintf("*%d\n", len(message.Arguments)+1))
+	start := len(dst)
+	if p.Signer != nil {
+		frame := p.appendFrame(nil, message)
+		dst = append(dst, p.Signer.signatureLine(string(frame))...)
+		dst = append(dst, frame...)
+	} else {
+		dst = p.appendFrame(dst, message)
+	}
 
-	args := append([]string{message.Command}, message.Arguments...)
-	for _, arg := range args {
-		builder.WriteString(fmt.Sprintf("$%d\n", len(arg)))
-		builder.WriteString(arg)
-		builder.WriteString("\n")
+	if size := len(dst) - start; p.Limits.MaxFrameSize > 0 && size > p.Limits.MaxFrameSize {
+		return dst[:start], encodeExceeded(-1, "frame of %d bytes exceeds %d", size, p.Limits.MaxFrameSize)
 	}
+	return dst, nil
+}
 
-	return []byte(builder.String())
+// EncodeTo writes the frame of message to w in a single Write.
+func (p *BinaryMessageProtocol) EncodeTo(w io.Writer, message Message) error {
+	return writeFrame(w, p, message)
+}
+
+func (p *BinaryMessageProtocol) appendFrame(dst []byte, message Message) []byte {
+	if message.ID != 0 {
+		dst = append(dst, '@')
+		dst = strconv.AppendUint(dst, message.ID, 10)
+		dst = append(dst, '\n')
+	}
+	if message.ReplyTo != 0 {
+		dst = append(dst, '^')
+		dst = strconv.AppendUint(dst, message.ReplyTo, 10)
+		dst = append(dst, '\n')
+	}
+	dst = appendHeaders(dst, message.Headers)
+	dst = append(dst, '*')
+	dst = strconv.AppendInt(dst, int64(message.argCount()+1), 10)
+	dst = append(dst, '\n')
+
+	dst = appendArgument(dst, message.Command)
+	if message.Values != nil {
+		for _, v := range message.Values {
+			dst = appendValue(dst, v)
+		}
+		return dst
+	}
+	for _, arg := range message.Arguments {
+		dst = appendArgument(dst, arg)
+	}
+
+	return dst
+}
+
+// indexArgument returns the index of the first argument, counting the
+// command as 0, for which match is true, or -1.
+func indexArgument(message Message, match func(string) bool) int {
+	if match(message.Command) {
+		return 0
+	}
+	for i, arg := range message.Arguments {
+		if match(arg) {
+			return i + 1
+		}
+	}
+	return -1
+}
+
+func appendArgument(dst []byte, arg string) []byte {
+	dst = append(dst, '$')
+	dst = strconv.AppendInt(dst, int64(len(arg)), 10)
+	dst = append(dst, '\n')
+	dst = append(dst, arg...)
+	return append(dst, '\n')
 }
 
 func (p *BinaryMessageProtocol) DecodeString(s string) (*Message, error) {
@@ -53,17 +262,55 @@ func (p *BinaryMessageProtocol) DecodeBytes(b []byte) (*Message, error) {
 func (p *BinaryMessageProtocol) Decode(reader io.Reader) (*Message, error) {
 	var msg Message
 
-	buf := bufio.NewReader(reader)
+	buf, ok := reader.(*bufio.Reader)
+	if !ok {
+		buf = bufio.NewReader(reader)
+	}
+	r := &frameReader{buf: buf, limits: p.Limits}
 
-	// Read the first line: "*<number of args>\n"
-	line, err := buf.ReadString('\n')
-	if err != nil {
-		return nil, &DecodeError{
-			Stage:   "read argument count line",
-			Index:   -1,
-			Details: "could not read '*<n>' line",
-			Err:     err,
+	// Read the first line: "*<number of args>\n", optionally preceded by
+	// "!<signature>\n", "@<id>\n", "^<reply to id>\n" and headers
+	var line, signature string
+	for {
+		var err error
+		line, err = r.readLine("read argument count line", -1, "could not read '*<n>' line")
+		if err != nil {
+			return nil, err
 		}
+
+		if strings.HasPrefix(line, "!") {
+			signature = line
+			continue
+		}
+		if strings.HasPrefix(line, "@") {
+			if _, err := fmt.Sscanf(line, "@%d\n", &msg.ID); err != nil {
+				return nil, &DecodeError{
+					Stage:   "parse message id",
+					Index:   -1,
+					Details: fmt.Sprintf("invalid line: %q", strings.TrimSpace(line)),
+					Err:     err,
+				}
+			}
+			continue
+		}
+		if strings.HasPrefix(line, "|") {
+			if msg.Headers, err = r.readHeaders(line); err != nil {
+				return nil, err
+			}
+			continue
+		}
+		if strings.HasPrefix(line, "^") {
+			if _, err := fmt.Sscanf(line, "^%d\n", &msg.ReplyTo); err != nil {
+				return nil, &DecodeError{
+					Stage:   "parse reply id",
+					Index:   -1,
+					Details: fmt.Sprintf("invalid line: %q", strings.TrimSpace(line)),
+					Err:     err,
+				}
+			}
+			continue
+		}
+		break
 	}
 
 	var lenArgs int
@@ -75,66 +322,64 @@ func (p *BinaryMessageProtocol) Decode(reader io.Reader) (*Message, error) {
 			Err:     err,
 		}
 	}
+	if lenArgs < 1 {
+		return nil, &DecodeError{
+			Stage:   "parse argument count",
+			Index:   -1,
+			Details: fmt.Sprintf("argument count %d, need at least 1 for the command", lenArgs),
+			Err:     fmt.Errorf("invalid format"),
+		}
+	}
+	if err := r.checkArgs(lenArgs); err != nil {
+		return nil, err
+	}
 
 	args := make([]string, lenArgs)
+	var values []Value
 
 	for i := 0; i < lenArgs; i++ {
-		// Read: "$<length>\n"
-		line, err := buf.ReadString('\n')
+		// Read: "$<length>\n", or the first line of a typed value
+		line, err := r.readLine("read argument length line", i, "could not read '$<length>' line")
 		if err != nil {
-			return nil, &DecodeError{
-				Stage:   "read argument length line",
-				Index:   i,
-				Details: "could not read '$<length>' line",
-				Err:     err,
-			}
+			return nil, err
 		}
 
-		var argLen int
-		if _, err := fmt.Sscanf(line, "$%d\n", &argLen); err != nil {
-			return nil, &DecodeError{
-				Stage:   "parse argument length",
-				Index:   i,
-				Details: fmt.Sprintf("invalid line: %q", strings.TrimSpace(line)),
-				Err:     err,
+		if i == 0 || line[0] == '$' {
+			if args[i], err = r.readBulk(i, line); err != nil {
+				return nil, err
 			}
-		}
-
-		// Read actual argument data
-		argData := make([]byte, argLen)
-		n, err := io.ReadFull(buf, argData)
-		if err != nil || n != argLen {
-			return nil, &DecodeError{
-				Stage:   "read argument data",
-				Index:   i,
-				Details: fmt.Sprintf("expected %d bytes, got %d", argLen, n),
-				Err:     err,
+			if values != nil {
+				values = append(values, BulkValue(args[i]))
 			}
+			continue
 		}
-		args[i] = string(argData)
 
-		// Expect newline after data
-		newline, err := buf.ReadString('\n')
+		v, err := r.readValue(i, line, 1)
 		if err != nil {
-			return nil, &DecodeError{
-				Stage:   "read newline after data",
-				Index:   i,
-				Details: "could not read expected newline after argument",
-				Err:     err,
-			}
+			return nil, err
 		}
-		if newline != "\n" {
-			return nil, &DecodeError{
-				Stage:   "validate newline after data",
-				Index:   i,
-				Details: fmt.Sprintf("expected newline, got %q", strings.TrimRight(newline, "\r\n")),
-				Err:     fmt.Errorf("invalid format"),
+		if values == nil {
+			values = make([]Value, i-1, lenArgs-1)
+			for j := 1; j < i; j++ {
+				values[j-1] = BulkValue(args[j])
 			}
 		}
+		values = append(values, v)
+		args[i] = v.String()
 	}
 
 	msg.Command = args[0]
 	msg.Arguments = args[1:]
+	msg.Values = values
+
+	if p.Signer != nil {
+		if signature == "" {
+			return nil, signatureError("frame is not signed", errors.New("missing signature"))
+		}
+		if err := p.Signer.verify(signature, string(p.appendFrame(nil, msg))); err != nil {
+			return nil, err
+		}
+	}
 
 	return &msg, nil
 }
@@ -2,8 +2,11 @@ package portrelay
 
 import (
 	"bytes"
+	"errors"
+	"io"
 	"reflect"
 	"strconv"
+	"strings"
 	"testing"
 )
 
@@ -23,6 +26,9 @@ func TestDecode(t *testing.T) {
 		{name: "Empty Command", input: []byte("*1\n$0\n\n"), expected: &Message{Command: "", Arguments: []string{}}, wantErr: false},
 		{name: "Command with empty argument", input: []byte("*2\n$11\nTestCommand\n$0\n\n"), expected: &Message{Command: "TestCommand", Arguments: []string{""}}, wantErr: false},
 		{name: "Command with spaces", input: []byte("*3\n$12\nTest Command\n$5\narg 1\n$5\narg 2\n"), expected: &Message{Command: "Test Command", Arguments: []string{"arg 1", "arg 2"}}, wantErr: false},
+		{name: "Command with id", input: []byte("@42\n*1\n$11\nTestCommand\n"), expected: &Message{Command: "TestCommand", Arguments: []string{}, ID: 42}, wantErr: false},
+		{name: "Reply", input: []byte("@43\n^42\n*1\n$11\nTestCommand\n"), expected: &Message{Command: "TestCommand", Arguments: []string{}, ID: 43, ReplyTo: 42}, wantErr: false},
+		{name: "Invalid id", input: []byte("@abc\n*1\n$11\nTestCommand\n"), expected: nil, wantErr: true},
 	}
 	
 	p := NewBinaryMessageProtocol()
@@ -79,6 +85,8 @@ func TestEncode(t *testing.T) {
 		{name: "Command with arguments", message: &Message{Command: "TestCommand", Arguments: []string{"-t", "TestArgument"}}, expected: []byte("*3\n$11\nTestCommand\n$2\n-t\n$12\nTestArgument\n")},
 		{name: "Command With spaces", message: &Message{Command: "Test Command", Arguments: []string{"arg 1", "arg 2"}}, expected: []byte("*3\n$12\nTest Command\n$5\narg 1\n$5\narg 2\n")},
 		{name: "Empty string", message: &Message{}, expected: []byte("*1\n$0\n\n")},
+		{name: "Command with id", message: &Message{Command: "TestCommand", ID: 42}, expected: []byte("@42\n*1\n$11\nTestCommand\n")},
+		{name: "Reply", message: &Message{Command: "TestCommand", ID: 43, ReplyTo: 42}, expected: []byte("@43\n^42\n*1\n$11\nTestCommand\n")},
 	}
 	for _, tt := range tests {
 		t.Run(tt.name, func(t *testing.T) {
@@ -92,3 +100,133 @@ func TestEncode(t *testing.T) {
 	}
 
 }
+
+func TestDecode_Limits(t *testing.T) {
+	limits := DecodeLimits{MaxArgs: 3, MaxArgSize: 8, MaxFrameSize: 30, MaxLineLength: 8}
+
+	tests := []struct {
+		name      string
+		input     string
+		wantStage string
+		wantIndex int
+	}{
+		{name: "Too many arguments", input: "*4\n$1\na\n$1\nb\n$1\nc\n$1\nd\n", wantStage: StageLimitExceeded, wantIndex: -1},
+		{name: "Huge argument count", input: "*999999999999\n", wantStage: StageLimitExceeded, wantIndex: -1},
+		{name: "Argument too large", input: "*1\n$9\n123456789\n", wantStage: StageLimitExceeded, wantIndex: 0},
+		{name: "Huge argument size", input: "*1\n$9999999\n", wantStage: StageLimitExceeded, wantIndex: 0},
+		{name: "Frame too large", input: "*3\n$8\n12345678\n$8\n12345678\n$8\n12345678\n", wantStage: StageLimitExceeded, wantIndex: 2},
+		{name: "Line too long", input: "*1\n$00000000001\na\n", wantStage: StageLimitExceeded, wantIndex: 0},
+		{name: "Negative argument count", input: "*-1\n", wantStage: "parse argument count", wantIndex: -1},
+		{name: "Zero argument count", input: "*0\n", wantStage: "parse argument count", wantIndex: -1},
+		{name: "Negative argument size", input: "*1\n$-5\n", wantStage: "parse argument length", wantIndex: 0},
+	}
+
+	p := &BinaryMessageProtocol{Limits: limits}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := p.DecodeString(tt.input)
+			var decodeErr *DecodeError
+			if !errors.As(err, &decodeErr) {
+				t.Fatalf("Decode() error = %v, want *DecodeError", err)
+			}
+			if decodeErr.Stage != tt.wantStage || decodeErr.Index != tt.wantIndex {
+				t.Errorf("Decode() error at stage %q index %d, want stage %q index %d", decodeErr.Stage, decodeErr.Index, tt.wantStage, tt.wantIndex)
+			}
+			if tt.wantStage == StageLimitExceeded && !errors.Is(err, ErrLimitExceeded) {
+				t.Errorf("Decode() error = %v, want it to wrap %v", err, ErrLimitExceeded)
+			}
+		})
+	}
+}
+
+func TestAppendEncode_Limits(t *testing.T) {
+	limits := DecodeLimits{MaxArgs: 3, MaxArgSize: 8, MaxFrameSize: 30}
+
+	tests := []struct {
+		name      string
+		message   Message
+		wantIndex int
+	}{
+		{name: "Too many arguments", message: Message{Command: "a", Arguments: []string{"b", "c", "d"}}, wantIndex: -1},
+		{name: "Command too large", message: Message{Command: "123456789"}, wantIndex: 0},
+		{name: "Argument too large", message: Message{Command: "a", Arguments: []string{"b", "123456789"}}, wantIndex: 2},
+		{name: "Frame too large", message: Message{Command: "12345678", Arguments: []string{"12345678", "12345678"}}, wantIndex: -1},
+	}
+
+	p := &BinaryMessageProtocol{Limits: limits}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			dst := []byte("prefix")
+			got, err := p.AppendEncode(dst, tt.message)
+			var encodeErr *EncodeError
+			if !errors.As(err, &encodeErr) {
+				t.Fatalf("AppendEncode() error = %v, want *EncodeError", err)
+			}
+			if encodeErr.Stage != StageLimitExceeded || encodeErr.Index != tt.wantIndex {
+				t.Errorf("AppendEncode() error at stage %q index %d, want stage %q index %d", encodeErr.Stage, encodeErr.Index, StageLimitExceeded, tt.wantIndex)
+			}
+			if !errors.Is(err, ErrLimitExceeded) {
+				t.Errorf("AppendEncode() error = %v, want it to wrap %v", err, ErrLimitExceeded)
+			}
+			if string(got) != "prefix" {
+				t.Errorf("AppendEncode() = %q, want dst unchanged", got)
+			}
+			if err := p.EncodeTo(io.Discard, tt.message); !errors.As(err, &encodeErr) {
+				t.Errorf("EncodeTo() error = %v, want *EncodeError", err)
+			}
+		})
+	}
+}
+
+func TestDecode_LimitLeavesPayloadUnread(t *testing.T) {
+	p := &BinaryMessageProtocol{Limits: DecodeLimits{MaxArgSize: 4}}
+	r := strings.NewReader("*1\n$10\n0123456789\n")
+	dec := NewProtocolDecoder(p, r)
+
+	if _, err := dec.Next(); !errors.Is(err, ErrLimitExceeded) {
+		t.Fatalf("Next() error = %v, want %v", err, ErrLimitExceeded)
+	}
+	if dec.Buffered() != len("0123456789\n") {
+		t.Errorf("Buffered() = %d, want the unread payload of %d bytes", dec.Buffered(), len("0123456789\n"))
+	}
+}
+
+func TestDecode_ZeroLimitsMeansUnlimited(t *testing.T) {
+	p := &BinaryMessageProtocol{}
+	arg := strings.Repeat("x", DefaultDecodeLimits.MaxArgSize+1)
+	got, err := p.DecodeBytes(p.Encode(Message{Command: "big", Arguments: []string{arg}}))
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if len(got.Arguments[0]) != len(arg) {
+		t.Errorf("argument length = %d, want %d", len(got.Arguments[0]), len(arg))
+	}
+}
+
+func TestMessage_ArgBytes(t *testing.T) {
+	payload := []byte{0x00, 0xff, '\n', 0x00}
+	msg := NewBytesMessage("blob", payload, nil)
+	msg.AddArgBytes([]byte("tail"))
+
+	p := NewBinaryMessageProtocol()
+	got, err := p.DecodeBytes(p.Encode(msg))
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if !bytes.Equal(got.ArgBytes(0), payload) {
+		t.Errorf("ArgBytes(0) = %q, want %q", got.ArgBytes(0), payload)
+	}
+	want := [][]byte{payload, {}, []byte("tail")}
+	if !reflect.DeepEqual(got.ArgsBytes(), want) {
+		t.Errorf("ArgsBytes() = %q, want %q", got.ArgsBytes(), want)
+	}
+	if got.ArgBytes(3) != nil || got.ArgBytes(-1) != nil {
+		t.Errorf("ArgBytes() out of range should be nil")
+	}
+
+	// The returned slice is a copy.
+	got.ArgBytes(0)[0] = 'x'
+	if got.Arguments[0][0] != 0x00 {
+		t.Errorf("ArgBytes() result aliases the message")
+	}
+}
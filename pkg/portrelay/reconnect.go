@@ -0,0 +1,154 @@
+package portrelay
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"math/rand/v2"
+	"time"
+)
+
+// ReconnectPolicy says how a Client connects again after its connection
+// drops, and how StartWithRetry spaces its attempts. Handlers, Headers and
+// the other settings of the client carry over to the new connection; calls
+// waiting for a reply on the old one fail with ErrConnectionClosed.
+type ReconnectPolicy struct {
+	// InitialDelay is the wait before the first attempt. Zero means 100ms.
+	InitialDelay time.Duration
+	// MaxDelay caps the wait between attempts. Zero means 30s.
+	MaxDelay time.Duration
+	// Multiplier grows the wait after every failed attempt. Zero means 2.
+	Multiplier float64
+	// Jitter spreads every wait randomly by up to this fraction of it, so
+	// that clients dropped together do not come back together. Zero means none.
+	Jitter float64
+	// MaxAttempts is how many attempts are made before the client gives up
+	// and is closed. Zero means no limit.
+	MaxAttempts int
+	// Queue makes Send and Call wait for the connection to come back
+	// instead of failing with ErrNotConnected while the client reconnects.
+	// Their contexts still bound the wait.
+	Queue bool
+}
+
+// Delay returns the wait before the given attempt, counted from 1.
+func (p ReconnectPolicy) Delay(attempt int) time.Duration {
+	delay, maxDelay, multiplier := p.InitialDelay, p.MaxDelay, p.Multiplier
+	if delay <= 0 {
+		delay = 100 * time.Millisecond
+	}
+	if maxDelay <= 0 {
+		maxDelay = 30 * time.Second
+	}
+	if multiplier <= 0 {
+		multiplier = 2
+	}
+
+	d := float64(delay)
+	for i := 1; i < attempt && d < float64(maxDelay); i++ {
+		d *= multiplier
+	}
+	d = min(d, float64(maxDelay))
+	if p.Jitter > 0 {
+		d += d * p.Jitter * (2*rand.Float64() - 1)
+	}
+	return time.Duration(d)
+}
+
+// StartWithRetry calls Start until it succeeds, up to retries times, waiting
+// between attempts as c.Reconnect says, or as the zero ReconnectPolicy does
+// when it is nil. Only failures to connect are retried: a failed handshake
+// or a done ctx is returned at once. retries must be at least 1.
+func (s *Client) StartWithRetry(ctx context.Context, host, port string, retries int) error {
+	if retries < 1 {
+		return fmt.Errorf("invalid number of retries %d: at least one attempt is needed", retries)
+	}
+	var policy ReconnectPolicy
+	if s.Reconnect != nil {
+		policy = *s.Reconnect
+	}
+
+	var err error
+	for attempt := 1; attempt <= retries; attempt++ {
+		if attempt > 1 {
+			if err := sleep(ctx, policy.Delay(attempt-1)); err != nil {
+				return err
+			}
+		}
+
+		err = s.Start(ctx, host, port)
+		var connErr *ConnError
+		if !errors.As(err, &connErr) || ctx.Err() != nil {
+			return err
+		}
+	}
+
+	return fmt.Errorf("failed to start client after %d attempts: %w", retries, err)
+}
+
+// lost is called when the connection dropped. It starts reconnecting if
+// the client has a ReconnectPolicy and closes the client otherwise.
+func (c *Client) lost() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.Reconnect == nil || c.shut {
+		c.state = StateClosed
+		c.failPending(true)
+		return
+	}
+	c.failPending(false)
+	c.state = StateConnecting
+	c.reconnected = make(chan struct{})
+	c.loops.Add(1)
+	go c.reconnect(*c.Reconnect)
+}
+
+// reconnect connects again until it succeeds, runs out of attempts or the
+// client is shut down.
+func (c *Client) reconnect(policy ReconnectPolicy) {
+	defer c.loops.Done()
+	timeout := c.HandshakeTimeout
+	if timeout <= 0 {
+		timeout = DefaultHandshakeTimeout
+	}
+
+	for attempt := 1; policy.MaxAttempts == 0 || attempt <= policy.MaxAttempts; attempt++ {
+		if sleep(c.stop, policy.Delay(attempt)) != nil {
+			break
+		}
+
+		ctx, cancel := context.WithTimeout(c.stop, timeout)
+		conn, dec, caps, err := c.connect(ctx, c.host, c.port)
+		cancel()
+		if err == nil {
+			c.mu.Lock()
+			if c.shut {
+				c.mu.Unlock()
+				conn.Close()
+				break
+			}
+			c.establish(conn, dec, caps)
+			c.mu.Unlock()
+			return
+		}
+	}
+
+	c.mu.Lock()
+	c.state = StateClosed
+	close(c.reconnected)
+	c.reconnected = nil
+	c.mu.Unlock()
+	c.failPending(true)
+}
+
+// sleep waits for d or until ctx is done.
+func sleep(ctx context.Context, d time.Duration) error {
+	timer := time.NewTimer(d)
+	defer timer.Stop()
+	select {
+	case <-timer.C:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
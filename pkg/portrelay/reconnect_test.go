@@ -0,0 +1,205 @@
+package portrelay
+
+import (
+	"context"
+	"errors"
+	"io"
+	"net"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestReconnectPolicy_Delay(t *testing.T) {
+	p := ReconnectPolicy{InitialDelay: 10 * time.Millisecond, MaxDelay: 50 * time.Millisecond}
+	for attempt, want := range []time.Duration{10, 20, 40, 50, 50} {
+		if got := p.Delay(attempt + 1); got != want*time.Millisecond {
+			t.Errorf("Delay(%d) = %v, want %v", attempt+1, got, want*time.Millisecond)
+		}
+	}
+
+	if got := (ReconnectPolicy{}).Delay(1); got != 100*time.Millisecond {
+		t.Errorf("zero policy Delay(1) = %v, want 100ms", got)
+	}
+
+	p.Jitter = 0.5
+	for range 100 {
+		if got := p.Delay(2); got < 10*time.Millisecond || got > 30*time.Millisecond {
+			t.Fatalf("Delay(2) with jitter = %v, want within 10ms..30ms", got)
+		}
+	}
+}
+
+// startReconnectServer starts a server that greets every connection with a
+// "hello" message and hands it to conns.
+func startReconnectServer(t *testing.T) (host, port string, conns chan *ServerConn) {
+	t.Helper()
+	router := NewRouter()
+	router.Register("echo", FuncHandler{
+		Func: func(msg Message, out io.Writer) {
+			Reply(out, msg, Message{Command: "echo", Arguments: msg.Arguments})
+		},
+	})
+	server := NewServer(NewBinaryMessageProtocol(), router)
+	conns = make(chan *ServerConn, 10)
+	server.OnConnect = func(c *ServerConn) {
+		c.Send(Message{Command: "hello"})
+		conns <- c
+	}
+	host, port, _ = net.SplitHostPort(startTestServer(t, server))
+	return host, port, conns
+}
+
+func TestClient_Reconnects(t *testing.T) {
+	host, port, conns := startReconnectServer(t)
+
+	hellos := make(chan struct{}, 10)
+	client := NewClient(NewBinaryMessageProtocol())
+	client.Reconnect = &ReconnectPolicy{InitialDelay: time.Millisecond, MaxAttempts: 100}
+	client.RegisterHandler("hello", FuncHandler{
+		Func: func(msg Message, out io.Writer) {
+			hellos <- struct{}{}
+		},
+	})
+	if err := client.Start(context.Background(), host, port); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	defer client.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	for i := range 2 {
+		select {
+		case <-hellos:
+		case <-ctx.Done():
+			t.Fatalf("connection %d: the handler was not called", i+1)
+		}
+		if _, err := client.Call(ctx, Message{Command: "echo"}); err != nil {
+			t.Fatalf("connection %d: unexpected error: %v", i+1, err)
+		}
+		(<-conns).Close()
+	}
+}
+
+func TestClient_ReconnectQueue(t *testing.T) {
+	host, port, conns := startReconnectServer(t)
+
+	var dials atomic.Int32
+	allow := make(chan struct{})
+	for _, queue := range []bool{false, true} {
+		client := NewClient(NewBinaryMessageProtocol())
+		client.Reconnect = &ReconnectPolicy{InitialDelay: time.Millisecond, Queue: queue}
+		client.SetDialer(func(ctx context.Context, network, address string) (net.Conn, error) {
+			if dials.Add(1)%2 == 0 {
+				// Hold the reconnect until the test is ready.
+				<-allow
+			}
+			return new(net.Dialer).DialContext(ctx, network, address)
+		})
+		if err := client.Start(context.Background(), host, port); err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		(<-conns).Close()
+		for client.State() != StateConnecting {
+			time.Sleep(time.Millisecond)
+		}
+
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		if !queue {
+			if err := client.Send(ctx, Message{Command: "echo"}); !errors.Is(err, ErrNotConnected) {
+				t.Errorf("Send() while reconnecting error = %v, want %v", err, ErrNotConnected)
+			}
+			allow <- struct{}{}
+		} else {
+			go func() {
+				time.Sleep(10 * time.Millisecond)
+				allow <- struct{}{}
+			}()
+			if _, err := client.Call(ctx, Message{Command: "echo"}); err != nil {
+				t.Errorf("Call() while reconnecting with Queue: unexpected error: %v", err)
+			}
+		}
+		cancel()
+		<-conns
+		client.Close()
+	}
+}
+
+func TestClient_ReconnectGivesUp(t *testing.T) {
+	host, port, conns := startReconnectServer(t)
+
+	var fail atomic.Bool
+	client := NewClient(NewBinaryMessageProtocol())
+	client.Reconnect = &ReconnectPolicy{InitialDelay: time.Millisecond, MaxAttempts: 3}
+	client.SetDialer(func(ctx context.Context, network, address string) (net.Conn, error) {
+		if fail.Load() {
+			return nil, errors.New("unreachable")
+		}
+		return new(net.Dialer).DialContext(ctx, network, address)
+	})
+	if err := client.Start(context.Background(), host, port); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	fail.Store(true)
+	(<-conns).Close()
+
+	deadline := time.Now().Add(5 * time.Second)
+	for client.State() != StateClosed && time.Now().Before(deadline) {
+		time.Sleep(time.Millisecond)
+	}
+	if client.State() != StateClosed {
+		t.Fatalf("State() = %v, want %v", client.State(), StateClosed)
+	}
+	if err := client.SendMessage(Message{Command: "echo"}); !errors.Is(err, ErrConnectionClosed) {
+		t.Errorf("SendMessage() error = %v, want %v", err, ErrConnectionClosed)
+	}
+}
+
+func TestClient_StartWithRetry(t *testing.T) {
+	host, port, _ := startReconnectServer(t)
+
+	var dials atomic.Int32
+	client := NewClient(NewBinaryMessageProtocol())
+	client.Reconnect = &ReconnectPolicy{InitialDelay: time.Millisecond}
+	client.SetDialer(func(ctx context.Context, network, address string) (net.Conn, error) {
+		if dials.Add(1) < 3 {
+			return nil, errors.New("not yet")
+		}
+		return new(net.Dialer).DialContext(ctx, network, address)
+	})
+	if err := client.StartWithRetry(context.Background(), host, port, 3); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	defer client.Close()
+	if dials.Load() != 3 {
+		t.Errorf("dialed %d times, want 3", dials.Load())
+	}
+
+	other := NewClient(NewBinaryMessageProtocol())
+	other.SetDialer(func(ctx context.Context, network, address string) (net.Conn, error) {
+		return nil, errors.New("down")
+	})
+	var connErr *ConnError
+	if err := other.StartWithRetry(context.Background(), host, port, 2); !errors.As(err, &connErr) {
+		t.Errorf("StartWithRetry() error = %v, want *ConnError", err)
+	}
+}
+
+func TestClient_StartWithRetry_NoAttempts(t *testing.T) {
+	var dials atomic.Int32
+	client := NewClient(NewBinaryMessageProtocol())
+	client.SetDialer(func(ctx context.Context, network, address string) (net.Conn, error) {
+		dials.Add(1)
+		return nil, errors.New("down")
+	})
+	for _, retries := range []int{0, -1} {
+		err := client.StartWithRetry(context.Background(), "127.0.0.1", "1", retries)
+		if err == nil || !strings.Contains(err.Error(), "invalid number of retries") {
+			t.Errorf("StartWithRetry(%d) error = %v, want a clear error", retries, err)
+		}
+	}
+	if dials.Load() != 0 {
+		t.Errorf("dialed %d times, want 0", dials.Load())
+	}
+}
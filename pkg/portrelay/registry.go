@@ -0,0 +1,166 @@
+package portrelay
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"fmt"
+	"net"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+)
+
+// ErrUnknownProtocol is returned when no registered codec matches a name or a connection.
+var ErrUnknownProtocol = errors.New("portrelay: unknown protocol")
+
+// Codec describes a MessageProtocol that can be selected by name, for
+// example from configuration, with NewProtocol.
+type Codec struct {
+	Name string
+	New  func() MessageProtocol
+	// Detect reports whether prefix, the first bytes a client sent, starts
+	// a frame of this protocol. Nil means the codec is never sniffed.
+	Detect func(prefix []byte) bool
+}
+
+var codecs = struct {
+	sync.RWMutex
+	byName map[string]Codec
+}{byName: make(map[string]Codec)}
+
+func init() {
+	RegisterCodec(Codec{
+		Name: "binary",
+		New:  func() MessageProtocol { return NewBinaryMessageProtocol() },
+		Detect: func(prefix []byte) bool {
+			return bytes.IndexByte([]byte("*@^|!"), prefix[0]) >= 0 && !isRESP(prefix)
+		},
+	})
+	RegisterCodec(Codec{
+		Name: "json",
+		New:  func() MessageProtocol { return NewJSONLinesProtocol() },
+		Detect: func(prefix []byte) bool {
+			return prefix[0] == '{'
+		},
+	})
+	RegisterCodec(Codec{
+		Name: "binary+deflate",
+		New: func() MessageProtocol {
+			return NewCompressedProtocol(NewBinaryMessageProtocol(), 1024)
+		},
+		Detect: func(prefix []byte) bool {
+			return prefix[0] == '~'
+		},
+	})
+	RegisterCodec(Codec{
+		Name: "resp",
+		New:  func() MessageProtocol { return NewRESPProtocol() },
+		// Inline commands are not detected, as they cannot be told apart
+		// from other text protocols. A server whose fallback protocol is
+		// RESP still accepts them.
+		Detect: isRESP,
+	})
+}
+
+// isRESP reports whether prefix starts with a RESP command array, whose
+// lines end with CRLF where the binary protocol's end with LF.
+func isRESP(prefix []byte) bool {
+	line, _, found := bytes.Cut(prefix, []byte("\n"))
+	return prefix[0] == '*' && found && bytes.HasSuffix(line, []byte("\r"))
+}
+
+// RegisterCodec makes a codec available under its name, replacing any
+// codec registered under the same name.
+func RegisterCodec(c Codec) {
+	codecs.Lock()
+	defer codecs.Unlock()
+	codecs.byName[c.Name] = c
+}
+
+// NewProtocol returns a new instance of the protocol registered under name.
+func NewProtocol(name string) (MessageProtocol, error) {
+	codecs.RLock()
+	c, ok := codecs.byName[name]
+	codecs.RUnlock()
+	if !ok {
+		return nil, fmt.Errorf("%w: %q", ErrUnknownProtocol, name)
+	}
+	return c.New(), nil
+}
+
+// Codecs returns the names of all registered codecs in sorted order.
+func Codecs() []string {
+	codecs.RLock()
+	defer codecs.RUnlock()
+	names := make([]string, 0, len(codecs.byName))
+	for name := range codecs.byName {
+		names = append(names, name)
+	}
+	slices.Sort(names)
+	return names
+}
+
+// DetectProtocol picks a protocol for a connection from the first bytes
+// the client sent. A handshake line names its protocol directly; otherwise
+// every registered codec's Detect is asked in name order.
+func DetectProtocol(prefix []byte) (MessageProtocol, error) {
+	if len(prefix) == 0 {
+		return nil, fmt.Errorf("%w: no data", ErrUnknownProtocol)
+	}
+
+	if line, ok := bytes.CutPrefix(prefix, []byte(helloPrefix+" ")); ok {
+		name, _, _ := strings.Cut(string(line), " ")
+		return NewProtocol(name)
+	}
+
+	for _, name := range Codecs() {
+		codecs.RLock()
+		c := codecs.byName[name]
+		codecs.RUnlock()
+		if c.Detect != nil && c.Detect(prefix) {
+			return c.New(), nil
+		}
+	}
+	return nil, fmt.Errorf("%w: unrecognised data %q", ErrUnknownProtocol, prefix)
+}
+
+// sniffProtocol peeks at the first bytes of conn through buf, without
+// consuming them, and detects the protocol they belong to. For a handshake
+// or an array it waits for the whole first line, which tells binary frames
+// from RESP ones; otherwise one byte is enough.
+func sniffProtocol(conn net.Conn, buf *bufio.Reader, timeout time.Duration) (MessageProtocol, error) {
+	if timeout <= 0 {
+		timeout = DefaultHandshakeTimeout
+	}
+	conn.SetReadDeadline(time.Now().Add(timeout))
+	defer conn.SetReadDeadline(time.Time{})
+
+	prefix, err := buf.Peek(1)
+	if err != nil {
+		return nil, err
+	}
+	if prefix[0] == helloPrefix[0] || prefix[0] == '*' {
+		prefix, _ = buf.Peek(buf.Buffered())
+		for !bytes.Contains(prefix, []byte("\n")) && len(prefix) < DefaultDecodeLimits.MaxLineLength {
+			if prefix, err = buf.Peek(len(prefix) + 1); err != nil {
+				return nil, err
+			}
+			prefix, _ = buf.Peek(buf.Buffered())
+		}
+	}
+	return DetectProtocol(prefix)
+}
+
+// acceptCompressed returns the protocol to decode a sniffed connection with.
+// A binary+deflate client only marks the frames it compresses, so as long as
+// its frames are small it looks like a binary one. Connections sniffed as
+// binary therefore accept compressed frames as well, while replies stay
+// uncompressed, which both kinds of clients read.
+func acceptCompressed(p MessageProtocol) MessageProtocol {
+	if bp, ok := p.(*BinaryMessageProtocol); ok {
+		return &CompressedProtocol{Inner: bp, MaxFrameSize: DefaultDecodeLimits.MaxFrameSize}
+	}
+	return p
+}
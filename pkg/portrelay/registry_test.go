@@ -0,0 +1,210 @@
+package portrelay
+
+import (
+	"context"
+	"errors"
+	"io"
+	"net"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestNewProtocol(t *testing.T) {
+	tests := []struct {
+		name     string
+		expected MessageProtocol
+	}{
+		{name: "binary", expected: NewBinaryMessageProtocol()},
+		{name: "json", expected: NewJSONLinesProtocol()},
+		{name: "binary+deflate", expected: NewCompressedProtocol(NewBinaryMessageProtocol(), 1024)},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := NewProtocol(tt.name)
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			if !reflect.DeepEqual(got, tt.expected) {
+				t.Errorf("NewProtocol(%q) = %#v, want %#v", tt.name, got, tt.expected)
+			}
+		})
+	}
+
+	if _, err := NewProtocol("carrier-pigeon"); !errors.Is(err, ErrUnknownProtocol) {
+		t.Errorf("NewProtocol() error = %v, want %v", err, ErrUnknownProtocol)
+	}
+}
+
+func TestRegisterCodec(t *testing.T) {
+	RegisterCodec(Codec{
+		Name: "test-codec",
+		New:  func() MessageProtocol { return versionedProtocol{NewBinaryMessageProtocol(), 9} },
+	})
+	t.Cleanup(func() {
+		codecs.Lock()
+		delete(codecs.byName, "test-codec")
+		codecs.Unlock()
+	})
+
+	p, err := NewProtocol("test-codec")
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if ProtocolVersion(p) != 9 {
+		t.Errorf("Version() = %d, want 9", ProtocolVersion(p))
+	}
+
+	found := false
+	for _, name := range Codecs() {
+		found = found || name == "test-codec"
+	}
+	if !found {
+		t.Errorf("Codecs() = %v, want it to include test-codec", Codecs())
+	}
+}
+
+func TestDetectProtocol(t *testing.T) {
+	tests := []struct {
+		name     string
+		prefix   string
+		wantName string
+		wantErr  bool
+	}{
+		{name: "Binary frame", prefix: "*1\n", wantName: "binary"},
+		{name: "Binary frame with id", prefix: "@1\n", wantName: "binary"},
+		{name: "Signed binary frame", prefix: "!k1 ", wantName: "binary"},
+		{name: "JSON line", prefix: `{"command"`, wantName: "json"},
+		{name: "Compressed frame", prefix: "~12\n", wantName: "binary"},
+		{name: "Handshake", prefix: "PORTRELAY/1 json 1 ids\n", wantName: "json"},
+		{name: "Handshake for unknown protocol", prefix: "PORTRELAY/1 xml 1 -\n", wantErr: true},
+		{name: "Garbage", prefix: "GET / HTTP/1.1\r\n", wantErr: true},
+		{name: "Nothing", prefix: "", wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			p, err := DetectProtocol([]byte(tt.prefix))
+			if tt.wantErr {
+				if !errors.Is(err, ErrUnknownProtocol) {
+					t.Errorf("DetectProtocol() error = %v, want %v", err, ErrUnknownProtocol)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			if ProtocolName(p) != tt.wantName {
+				t.Errorf("DetectProtocol() = %s, want %s", ProtocolName(p), tt.wantName)
+			}
+		})
+	}
+}
+
+func TestServer_SniffsMixedClients(t *testing.T) {
+	router := NewRouter()
+	router.Register("which", FuncHandler{
+		Func: func(msg Message, out io.Writer) {
+			Reply(out, msg, Message{Command: "which", Arguments: []string{ProtocolName(out.(*ServerConn).Protocol())}})
+		},
+	})
+	s := NewServer(nil, router)
+	s.Sniff = true
+	host, port, _ := net.SplitHostPort(startTestServer(t, s))
+
+	for _, name := range []string{"binary", "json", "binary+deflate"} {
+		t.Run(name, func(t *testing.T) {
+			p, _ := NewProtocol(name)
+			client := NewClient(p)
+			if err := client.Start(context.Background(), host, port); err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			defer client.Close()
+
+			resp, err := client.Call(context.Background(), Message{Command: "which"})
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			if resp.Arguments[0] != ProtocolName(p) {
+				t.Errorf("server spoke %s, want %s", resp.Arguments[0], ProtocolName(p))
+			}
+		})
+	}
+}
+
+func TestServer_SniffsSmallCompressedFrames(t *testing.T) {
+	router := NewRouter()
+	router.Register("echo", FuncHandler{
+		Func: func(msg Message, out io.Writer) {
+			Reply(out, msg, Message{Command: "echo", Arguments: msg.Arguments})
+		},
+	})
+	s := NewServer(nil, router)
+	s.Sniff = true
+	host, port, _ := net.SplitHostPort(startTestServer(t, s))
+
+	client := NewClient(NewCompressedProtocol(NewBinaryMessageProtocol(), 64))
+	if err := client.Start(context.Background(), host, port); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	defer client.Close()
+
+	// The first frame is below the threshold and goes out uncompressed.
+	for _, arg := range []string{"small", strings.Repeat("large ", 100)} {
+		resp, err := client.Call(context.Background(), Message{Command: "echo", Arguments: []string{arg}})
+		if err != nil {
+			t.Fatalf("Call(%d bytes): unexpected error: %v", len(arg), err)
+		}
+		if resp.Arguments[0] != arg {
+			t.Errorf("Call(%d bytes) got %d bytes back", len(arg), len(resp.Arguments[0]))
+		}
+	}
+}
+
+func TestServer_SniffsHandshake(t *testing.T) {
+	router := NewRouter()
+	router.Register("ping", FuncHandler{
+		Func: func(msg Message, out io.Writer) {
+			Reply(out, msg, Message{Command: "pong"})
+		},
+	})
+	s := NewServer(NewBinaryMessageProtocol(), router)
+	s.Sniff = true
+	s.Handshake = true
+	host, port, _ := net.SplitHostPort(startTestServer(t, s))
+
+	client := NewClient(NewJSONLinesProtocol())
+	client.Handshake = true
+	if err := client.Start(context.Background(), host, port); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	defer client.Close()
+
+	resp, err := client.Call(context.Background(), Message{Command: "ping"})
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if resp.Command != "pong" {
+		t.Errorf("reply command = %q, want pong", resp.Command)
+	}
+}
+
+func TestServer_SniffFallback(t *testing.T) {
+	disconnects := make(chan error, 1)
+	s := NewServer(nil, NewRouter())
+	s.Sniff = true
+	s.OnDisconnect = func(c *ServerConn, err error) {
+		disconnects <- err
+	}
+	addr := startTestServer(t, s)
+
+	conn, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	defer conn.Close()
+	io.WriteString(conn, "GET / HTTP/1.1\r\n\r\n")
+
+	if err := <-disconnects; !errors.Is(err, ErrUnknownProtocol) {
+		t.Errorf("OnDisconnect error = %v, want %v", err, ErrUnknownProtocol)
+	}
+}
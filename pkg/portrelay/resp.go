@@ -0,0 +1,489 @@
+package portrelay
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"slices"
+	"strconv"
+	"strings"
+)
+
+// ReplyCommand is the command of messages that carry a single reply value
+// rather than a command, as made by the reply constructors below. RESPProtocol
+// sends them as bare RESP values, the other protocols as ordinary messages.
+const ReplyCommand = "portrelay:reply"
+
+// FORMAT
+// RESPProtocol: the Redis serialization protocol. Commands are arrays of bulk
+// strings, "*<n>\r\n$<length>\r\n<data>\r\n...", or inline commands, a line of
+// space separated words as typed over telnet. Replies are single RESP values:
+// "+OK\r\n", "-ERR message\r\n", ":42\r\n", bulk strings, arrays and, with
+// RESP3, nulls, floats, booleans and maps.
+//
+// RESP has no room for message IDs or headers, so ID, ReplyTo and Headers
+// are not sent and Call cannot be used; the opening handshake must be disabled too, as Redis
+// clients do not send one. RESP cannot tell an array reply from a command
+// either: arrays whose first element is a bulk string decode as commands,
+// every other value as a ReplyCommand message. Redis commands are case
+// insensitive, so decoded commands are lowercased.
+type RESPProtocol struct {
+	// RESP3 sends replies with the RESP3 types. Without it typed values are
+	// downgraded the way Redis does for RESP2 clients: floats become bulk
+	// strings, booleans integers, nulls null bulk strings and maps arrays.
+	// Both versions are always accepted by Decode.
+	RESP3 bool
+	// Limits bounds the frames Decode accepts. The zero value means no limits.
+	Limits DecodeLimits
+}
+
+func NewRESPProtocol() *RESPProtocol {
+	return &RESPProtocol{Limits: DefaultDecodeLimits}
+}
+
+func (p *RESPProtocol) Name() string {
+	return "resp"
+}
+
+func (p *RESPProtocol) Version() int {
+	if p.RESP3 {
+		return 3
+	}
+	return 2
+}
+
+// Encode returns the RESP form of message, or nil when it cannot be encoded.
+// AppendEncode and EncodeTo report why.
+func (p *RESPProtocol) Encode(message Message) []byte {
+	frame, err := p.AppendEncode(nil, message)
+	if err != nil {
+		return nil
+	}
+	return frame
+}
+
+// AppendEncode appends the RESP form of message to dst: the bare value for
+// a ReplyCommand message, an array of the command and its arguments otherwise.
+func (p *RESPProtocol) AppendEncode(dst []byte, message Message) ([]byte, error) {
+	if message.Command == ReplyCommand && message.argCount() == 1 {
+		v := oneLineErrors(message.ArgValue(0))
+		if err := checkValue(v, 1, 1, p.Limits); err != nil {
+			return dst, err
+		}
+		if err := checkValueCount([]Value{v}, p.Limits); err != nil {
+			return dst, err
+		}
+		return p.appendValue(dst, v), nil
+	}
+
+	if n := message.argCount() + 1; p.Limits.MaxArgs > 0 && n > p.Limits.MaxArgs {
+		return dst, encodeExceeded(-1, "%d arguments exceed %d", n, p.Limits.MaxArgs)
+	}
+	values := make([]Value, 0, message.argCount()+1)
+	values = append(values, BulkValue(message.Command))
+	for i := 0; i < message.argCount(); i++ {
+		values = append(values, oneLineErrors(message.ArgValue(i)))
+	}
+	for i, v := range values {
+		if err := checkValue(v, i, 1, p.Limits); err != nil {
+			return dst, err
+		}
+	}
+	// The command array counts as well, as it does when decoding.
+	if err := checkValueCount([]Value{ArrayValue(values...)}, p.Limits); err != nil {
+		return dst, err
+	}
+
+	start := len(dst)
+	dst = p.appendValue(dst, ArrayValue(values...))
+	if size := len(dst) - start; p.Limits.MaxFrameSize > 0 && size > p.Limits.MaxFrameSize {
+		return dst[:start], encodeExceeded(-1, "frame of %d bytes exceeds %d", size, p.Limits.MaxFrameSize)
+	}
+	return dst, nil
+}
+
+// EncodeTo writes the RESP form of message to w in a single Write.
+func (p *RESPProtocol) EncodeTo(w io.Writer, message Message) error {
+	return writeFrame(w, p, message)
+}
+
+func (p *RESPProtocol) appendValue(dst []byte, v Value) []byte {
+	switch v.Kind {
+	case KindSimple:
+		return appendRESPLine(dst, '+', v.Str)
+	case KindError:
+		return appendRESPLine(dst, '-', v.Str)
+	case KindInt:
+		return appendRESPLine(dst, ':', strconv.FormatInt(v.Int, 10))
+	case KindFloat:
+		if !p.RESP3 {
+			return p.appendValue(dst, BulkValue(v.String()))
+		}
+		return appendRESPLine(dst, ',', strconv.FormatFloat(v.Float, 'g', -1, 64))
+	case KindBool:
+		switch {
+		case !p.RESP3 && v.Bool:
+			return append(dst, ":1\r\n"...)
+		case !p.RESP3:
+			return append(dst, ":0\r\n"...)
+		case v.Bool:
+			return append(dst, "#t\r\n"...)
+		}
+		return append(dst, "#f\r\n"...)
+	case KindNull:
+		if !p.RESP3 {
+			return append(dst, "$-1\r\n"...)
+		}
+		return append(dst, "_\r\n"...)
+	case KindArray:
+		dst = appendRESPLine(dst, '*', strconv.Itoa(len(v.Array)))
+		for _, elem := range v.Array {
+			dst = p.appendValue(dst, elem)
+		}
+		return dst
+	case KindMap:
+		if p.RESP3 {
+			dst = appendRESPLine(dst, '%', strconv.Itoa(len(v.Map)))
+		} else {
+			dst = appendRESPLine(dst, '*', strconv.Itoa(2*len(v.Map)))
+		}
+		for _, pair := range v.Map {
+			dst = p.appendValue(dst, pair.Key)
+			dst = p.appendValue(dst, pair.Value)
+		}
+		return dst
+	}
+	dst = appendRESPLine(dst, '$', strconv.Itoa(len(v.Str)))
+	dst = append(dst, v.Str...)
+	return append(dst, "\r\n"...)
+}
+
+// oneLineErrors replaces the line breaks in the errors in v with spaces, as
+// Redis does, since only RESP3 blob errors, which decode to errors too, have
+// room for them.
+func oneLineErrors(v Value) Value {
+	if !hasLineBreakError(v) {
+		return v
+	}
+	switch v.Kind {
+	case KindError:
+		v.Str = strings.NewReplacer("\r", " ", "\n", " ").Replace(v.Str)
+	case KindArray:
+		array := make([]Value, len(v.Array))
+		for i, elem := range v.Array {
+			array[i] = oneLineErrors(elem)
+		}
+		v.Array = array
+	case KindMap:
+		pairs := make([]Pair, len(v.Map))
+		for i, pair := range v.Map {
+			pairs[i] = Pair{Key: oneLineErrors(pair.Key), Value: oneLineErrors(pair.Value)}
+		}
+		v.Map = pairs
+	}
+	return v
+}
+
+func hasLineBreakError(v Value) bool {
+	switch v.Kind {
+	case KindError:
+		return strings.ContainsAny(v.Str, "\r\n")
+	case KindArray:
+		return slices.ContainsFunc(v.Array, hasLineBreakError)
+	case KindMap:
+		return slices.ContainsFunc(v.Map, func(pair Pair) bool {
+			return hasLineBreakError(pair.Key) || hasLineBreakError(pair.Value)
+		})
+	}
+	return false
+}
+
+func appendRESPLine(dst []byte, marker byte, text string) []byte {
+	dst = append(dst, marker)
+	dst = append(dst, text...)
+	return append(dst, "\r\n"...)
+}
+
+func (p *RESPProtocol) DecodeString(s string) (*Message, error) {
+	return p.Decode(strings.NewReader(s))
+}
+
+func (p *RESPProtocol) DecodeBytes(b []byte) (*Message, error) {
+	return p.Decode(bytes.NewReader(b))
+}
+
+func (p *RESPProtocol) Decode(reader io.Reader) (*Message, error) {
+	buf, ok := reader.(*bufio.Reader)
+	if !ok {
+		buf = bufio.NewReader(reader)
+	}
+	r := &frameReader{buf: buf, limits: p.Limits}
+
+	for {
+		line, err := r.readLine("read line", -1, "could not read a line")
+		if err != nil {
+			return nil, err
+		}
+		if strings.IndexByte("$+-:,#_*%~>=(!|", line[0]) < 0 {
+			// Inline commands are what redis-cli and telnet users type by
+			// hand; blank lines between them are skipped, as Redis does.
+			if words := strings.Fields(line); len(words) > 0 {
+				if err := r.checkArgs(len(words)); err != nil {
+					return nil, err
+				}
+				return &Message{Command: strings.ToLower(words[0]), Arguments: words[1:]}, nil
+			}
+			continue
+		}
+		if line, err = cutCRLF(line, -1); err != nil {
+			return nil, err
+		}
+
+		v, err := r.readRESPValue(0, line, 1)
+		if err != nil {
+			return nil, err
+		}
+		if v.Kind != KindArray || len(v.Array) == 0 || v.Array[0].Kind != KindBulk {
+			msg := NewValueMessage(ReplyCommand, v)
+			return &msg, nil
+		}
+
+		if err := r.checkArgs(len(v.Array)); err != nil {
+			return nil, err
+		}
+		msg := Message{Command: strings.ToLower(v.Array[0].Str), Arguments: make([]string, 0, len(v.Array)-1)}
+		for _, arg := range v.Array[1:] {
+			if arg.Kind != KindBulk || msg.Values != nil {
+				msg.AddValue(arg)
+				continue
+			}
+			msg.Arguments = append(msg.Arguments, arg.Str)
+		}
+		return &msg, nil
+	}
+}
+
+// readRESPLine reads a line terminated by "\r\n" and returns it without
+// the terminator.
+func (r *frameReader) readRESPLine(index int) (string, error) {
+	line, err := r.readLine("read line", index, "could not read a line")
+	if err != nil {
+		return "", err
+	}
+	return cutCRLF(line, index)
+}
+
+func cutCRLF(line string, index int) (string, error) {
+	text, ok := strings.CutSuffix(line, "\r\n")
+	if !ok {
+		return "", &DecodeError{
+			Stage:   "validate line ending",
+			Index:   index,
+			Details: fmt.Sprintf("line %q does not end with CRLF", strings.TrimSpace(line)),
+			Err:     errors.New("invalid format"),
+		}
+	}
+	return text, nil
+}
+
+// readRESPValue decodes the rest of the RESP value whose first line,
+// without its "\r\n", is line.
+func (r *frameReader) readRESPValue(index int, line string, depth int) (Value, error) {
+	// Attributes annotate the value that follows them and are dropped. They
+	// are skipped in a loop, as a long chain of them must not recurse.
+	for strings.HasPrefix(line, "|") {
+		if _, err := r.readRESPAggregate(index, line, depth); err != nil {
+			return Value{}, err
+		}
+		var err error
+		if line, err = r.readRESPLine(index); err != nil {
+			return Value{}, err
+		}
+	}
+
+	invalid := func(stage string, err error) error {
+		return &DecodeError{
+			Stage:   stage,
+			Index:   index,
+			Details: fmt.Sprintf("invalid line: %q", line),
+			Err:     err,
+		}
+	}
+	if line == "" {
+		return Value{}, invalid("parse value type", errors.New("empty line"))
+	}
+	text := line[1:]
+	length := func() (int, error) {
+		n, err := strconv.Atoi(text)
+		if err != nil || n < -1 {
+			if err == nil {
+				err = errors.New("invalid format")
+			}
+			return 0, invalid("parse length", err)
+		}
+		return n, nil
+	}
+
+	switch line[0] {
+	case '+', '-':
+		if strings.ContainsRune(text, '\r') {
+			return Value{}, invalid("parse simple string", errors.New("line break in a simple string"))
+		}
+		if line[0] == '-' {
+			return ErrorValue(text), nil
+		}
+		return SimpleValue(text), nil
+	case ':':
+		n, err := strconv.ParseInt(text, 10, 64)
+		if err != nil {
+			return Value{}, invalid("parse integer", err)
+		}
+		return IntValue(n), nil
+	case ',':
+		f, err := strconv.ParseFloat(text, 64)
+		if err != nil {
+			return Value{}, invalid("parse float", err)
+		}
+		return FloatValue(f), nil
+	case '#':
+		if text != "t" && text != "f" {
+			return Value{}, invalid("parse boolean", errors.New("invalid format"))
+		}
+		return BoolValue(text == "t"), nil
+	case '_':
+		return NullValue(), nil
+	case '(':
+		// Big numbers have no Go counterpart; they are kept as text.
+		return BulkValue(text), nil
+	case '$', '=', '!':
+		n, err := length()
+		if err != nil {
+			return Value{}, err
+		}
+		if n == -1 {
+			return NullValue(), nil
+		}
+		data, err := r.readData(index, n)
+		if err != nil {
+			return Value{}, err
+		}
+		if end, err := r.readRESPLine(index); err != nil || end != "" {
+			if err == nil {
+				err = invalid("validate line ending", fmt.Errorf("unexpected data %q after %d bytes", end, n))
+			}
+			return Value{}, err
+		}
+		switch line[0] {
+		case '=':
+			// Verbatim strings start with a three letter format and a colon.
+			if len(data) < 4 {
+				return Value{}, invalid("parse verbatim string", errors.New("missing format"))
+			}
+			return BytesValue(data[4:]), nil
+		case '!':
+			return ErrorValue(string(data)), nil
+		}
+		return BytesValue(data), nil
+	case '*', '~', '>', '%':
+		return r.readRESPAggregate(index, line, depth)
+	}
+	return Value{}, invalid("parse value type", errors.New("invalid format"))
+}
+
+// readRESPAggregate decodes the rest of the array, set, push, map or
+// attribute whose first line is line.
+func (r *frameReader) readRESPAggregate(index int, line string, depth int) (Value, error) {
+	n, err := strconv.Atoi(line[1:])
+	if err != nil || n < -1 {
+		if err == nil {
+			err = errors.New("invalid format")
+		}
+		return Value{}, &DecodeError{
+			Stage:   "parse length",
+			Index:   index,
+			Details: fmt.Sprintf("invalid line: %q", line),
+			Err:     err,
+		}
+	}
+	if n == -1 {
+		return NullValue(), nil
+	}
+	if r.limits.MaxDepth > 0 && depth > r.limits.MaxDepth {
+		return Value{}, exceeded(index, "values nested deeper than %d", r.limits.MaxDepth)
+	}
+	if r.limits.MaxArgs > 0 && n > r.limits.MaxArgs {
+		return Value{}, exceeded(index, "%d elements exceed %d", n, r.limits.MaxArgs)
+	}
+
+	paired := line[0] == '%' || line[0] == '|'
+	elems := n
+	if paired {
+		elems = 2 * n
+	}
+	if err := r.addValues(index, elems); err != nil {
+		return Value{}, err
+	}
+	var values []Value
+	for range elems {
+		next, err := r.readRESPLine(index)
+		if err != nil {
+			return Value{}, err
+		}
+		v, err := r.readRESPValue(index, next, depth+1)
+		if err != nil {
+			return Value{}, err
+		}
+		values = append(values, v)
+	}
+
+	if !paired {
+		return ArrayValue(values...), nil
+	}
+	var pairs []Pair
+	if n > 0 {
+		pairs = make([]Pair, n)
+	}
+	for i := range pairs {
+		pairs[i] = Pair{Key: values[2*i], Value: values[2*i+1]}
+	}
+	return MapValue(pairs...), nil
+}
+
+// SimpleStringReply returns a reply of the simple string s, such as "OK".
+func SimpleStringReply(s string) Message {
+	return NewValueMessage(ReplyCommand, SimpleValue(s))
+}
+
+// ErrorReply returns an error reply. By Redis convention text starts with
+// an upper case error code, as in "ERR unknown command".
+func ErrorReply(text string) Message {
+	return NewValueMessage(ReplyCommand, ErrorValue(text))
+}
+
+func IntegerReply(n int64) Message {
+	return NewValueMessage(ReplyCommand, IntValue(n))
+}
+
+func BulkReply(s string) Message {
+	return NewValueMessage(ReplyCommand, BulkValue(s))
+}
+
+func NullReply() Message {
+	return NewValueMessage(ReplyCommand, NullValue())
+}
+
+// ValueReply returns a reply of any value, for example an array.
+func ValueReply(v Value) Message {
+	return NewValueMessage(ReplyCommand, v)
+}
+
+// UnknownCommandHandler answers with a Redis style error reply. Set it as
+// CommandRouter.NotFound on servers that speak RESP.
+var UnknownCommandHandler Handler = FuncHandler{
+	Func: func(msg Message, out io.Writer) {
+		Reply(out, msg, ErrorReply(fmt.Sprintf("ERR unknown command '%s'", msg.Command)))
+	},
+	Help: "Replies with an error to commands that are not registered.",
+}
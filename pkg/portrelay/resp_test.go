@@ -0,0 +1,228 @@
+package portrelay
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"io"
+	"net"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestRESPDecode(t *testing.T) {
+	tests := []struct {
+		name      string
+		input     string
+		expected  *Message
+		wantStage string
+	}{
+		{name: "Command array", input: "*3\r\n$3\r\nSET\r\n$3\r\nkey\r\n$5\r\nva\r\nl\r\n", expected: &Message{Command: "set", Arguments: []string{"key", "va\r\nl"}}},
+		{name: "Inline command", input: "set key  value\r\n", expected: &Message{Command: "set", Arguments: []string{"key", "value"}}},
+		{name: "Inline command with LF", input: "PING\n", expected: &Message{Command: "ping", Arguments: []string{}}},
+		{name: "Blank lines before inline command", input: "\r\n\r\nPING\r\n", expected: &Message{Command: "ping", Arguments: []string{}}},
+		{name: "Simple string reply", input: "+OK\r\n", expected: ptr(SimpleStringReply("OK"))},
+		{name: "Error reply", input: "-ERR wrong\r\n", expected: ptr(ErrorReply("ERR wrong"))},
+		{name: "Integer reply", input: ":-3\r\n", expected: ptr(IntegerReply(-3))},
+		{name: "Null bulk reply", input: "$-1\r\n", expected: ptr(NullReply())},
+		{name: "RESP3 null", input: "_\r\n", expected: ptr(NullReply())},
+		{name: "RESP3 map", input: "%1\r\n+a\r\n#t\r\n", expected: ptr(ValueReply(MapValue(Pair{Key: SimpleValue("a"), Value: BoolValue(true)})))},
+		{name: "Verbatim string", input: "=8\r\ntxt:text\r\n", expected: ptr(BulkReply("text"))},
+		{name: "Attribute is dropped", input: "|1\r\n+key\r\n:1\r\n:5\r\n", expected: ptr(IntegerReply(5))},
+		{name: "Typed argument", input: "*2\r\n$4\r\nincr\r\n:5\r\n", expected: &Message{Command: "incr", Arguments: []string{"5"}, Values: []Value{IntValue(5)}}},
+		{name: "Array reply", input: "*2\r\n:1\r\n:2\r\n", expected: ptr(ValueReply(ArrayValue(IntValue(1), IntValue(2))))},
+		{name: "LF line ending", input: "*1\n$4\nPING\n", wantStage: "validate line ending"},
+		{name: "Data longer than length", input: "*1\r\n$2\r\nabc\r\n", wantStage: "validate line ending"},
+		{name: "Carriage return in simple string", input: "+a\rb\r\n", wantStage: "parse simple string"},
+		{name: "Invalid length", input: "*1\r\n$x\r\n", wantStage: "parse length"},
+		{name: "Truncated", input: "*2\r\n$4\r\nPING\r\n", wantStage: "read line"},
+		{name: "Empty input", input: "", wantStage: "read line"},
+	}
+
+	p := NewRESPProtocol()
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := p.DecodeString(tt.input)
+			if tt.wantStage != "" {
+				var decodeErr *DecodeError
+				if !errors.As(err, &decodeErr) || decodeErr.Stage != tt.wantStage {
+					t.Fatalf("Decode() error = %v, want stage %q", err, tt.wantStage)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			if !reflect.DeepEqual(got, tt.expected) {
+				t.Errorf("Decode() got = %+v, want %+v", got, tt.expected)
+			}
+		})
+	}
+}
+
+func TestRESPEncode(t *testing.T) {
+	tests := []struct {
+		name     string
+		message  Message
+		expected string
+		resp3    string
+	}{
+		{name: "Command", message: Message{Command: "GET", Arguments: []string{"key"}}, expected: "*2\r\n$3\r\nGET\r\n$3\r\nkey\r\n"},
+		{name: "Simple string", message: SimpleStringReply("OK"), expected: "+OK\r\n"},
+		{name: "Error", message: ErrorReply("ERR no"), expected: "-ERR no\r\n"},
+		{name: "Integer", message: IntegerReply(42), expected: ":42\r\n"},
+		{name: "Bulk", message: BulkReply("a\r\nb"), expected: "$4\r\na\r\nb\r\n"},
+		{name: "Null", message: NullReply(), expected: "$-1\r\n", resp3: "_\r\n"},
+		{name: "Float", message: ValueReply(FloatValue(1.5)), expected: "$3\r\n1.5\r\n", resp3: ",1.5\r\n"},
+		{name: "Boolean", message: ValueReply(BoolValue(true)), expected: ":1\r\n", resp3: "#t\r\n"},
+		{name: "Map", message: ValueReply(MapValue(Pair{Key: BulkValue("a"), Value: IntValue(1)})), expected: "*2\r\n$1\r\na\r\n:1\r\n", resp3: "%1\r\n$1\r\na\r\n:1\r\n"},
+		{name: "Error with line breaks", message: ErrorReply("ERR a\r\nb"), expected: "-ERR a  b\r\n"},
+		{name: "Id is not sent", message: Message{Command: "PING", ID: 7}, expected: "*1\r\n$4\r\nPING\r\n"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			p := NewRESPProtocol()
+			if got := string(p.Encode(tt.message)); got != tt.expected {
+				t.Errorf("Encode() got = %q, want %q", got, tt.expected)
+			}
+
+			p.RESP3 = true
+			want := tt.resp3
+			if want == "" {
+				want = tt.expected
+			}
+			if got := string(p.Encode(tt.message)); got != want {
+				t.Errorf("RESP3 Encode() got = %q, want %q", got, want)
+			}
+		})
+	}
+}
+
+func TestRESPEncode_LineBreakInSimpleString(t *testing.T) {
+	_, err := NewRESPProtocol().AppendEncode(nil, SimpleStringReply("a\r\nb"))
+	var encodeErr *EncodeError
+	if !errors.As(err, &encodeErr) {
+		t.Errorf("AppendEncode() error = %v, want *EncodeError", err)
+	}
+}
+
+func TestRESPDecode_MaxValues(t *testing.T) {
+	p := &RESPProtocol{Limits: DecodeLimits{MaxValues: 4}}
+	if _, err := p.DecodeString("*2\r\n$1\r\nx\r\n*4\r\n:1\r\n:2\r\n:3\r\n:4\r\n"); !errors.Is(err, ErrLimitExceeded) {
+		t.Errorf("Decode() error = %v, want %v", err, ErrLimitExceeded)
+	}
+	if _, err := p.AppendEncode(nil, NewValueMessage("x", ArrayValue(IntValue(1), IntValue(2), IntValue(3), IntValue(4)))); !errors.Is(err, ErrLimitExceeded) {
+		t.Errorf("AppendEncode() error = %v, want %v", err, ErrLimitExceeded)
+	}
+}
+
+func TestRESPDecode_AttributeChain(t *testing.T) {
+	// A million empty attributes fit in the default frame size and must not
+	// each take a stack frame.
+	got, err := NewRESPProtocol().DecodeString(strings.Repeat("|0\r\n", 1_000_000) + ":1\r\n")
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if !reflect.DeepEqual(got, ptr(IntegerReply(1))) {
+		t.Errorf("Decode() got = %+v, want %+v", got, ptr(IntegerReply(1)))
+	}
+}
+
+// TestRESPServer talks to a server the way redis-cli does.
+func TestRESPServer(t *testing.T) {
+	router := NewRouter()
+	router.NotFound = UnknownCommandHandler
+	router.Register("ping", FuncHandler{
+		Func: func(msg Message, out io.Writer) {
+			Reply(out, msg, SimpleStringReply("PONG"))
+		},
+	})
+	router.Register("strlen", FuncHandler{
+		Func: func(msg Message, out io.Writer) {
+			if len(msg.Arguments) != 1 {
+				Reply(out, msg, ErrorReply("ERR wrong number of arguments for 'strlen' command"))
+				return
+			}
+			Reply(out, msg, IntegerReply(int64(len(msg.Arguments[0]))))
+		},
+	})
+	addr := startTestServer(t, NewServer(NewRESPProtocol(), router))
+
+	conn, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(5 * time.Second))
+	r := bufio.NewReader(conn)
+
+	exchanges := []struct {
+		send string
+		want string
+	}{
+		{send: "*1\r\n$4\r\nPING\r\n", want: "+PONG\r\n"},
+		{send: "ping\r\n", want: "+PONG\r\n"},
+		{send: "*2\r\n$6\r\nSTRLEN\r\n$5\r\nhello\r\n", want: ":5\r\n"},
+		{send: "STRLEN\r\n", want: "-ERR wrong number of arguments for 'strlen' command\r\n"},
+		{send: "*1\r\n$4\r\nNOPE\r\n", want: "-ERR unknown command 'nope'\r\n"},
+	}
+	for _, ex := range exchanges {
+		conn.Write([]byte(ex.send))
+		got, err := r.ReadString('\n')
+		if err != nil {
+			t.Fatalf("%q: unexpected error: %v", ex.send, err)
+		}
+		if got != ex.want {
+			t.Errorf("%q: reply got = %q, want %q", ex.send, got, ex.want)
+		}
+	}
+}
+
+func TestRESPClient(t *testing.T) {
+	router := NewRouter()
+	router.Register("echo", FuncHandler{
+		Func: func(msg Message, out io.Writer) {
+			Reply(out, msg, BulkReply(strings.Join(msg.Arguments, " ")))
+		},
+	})
+	addr := startTestServer(t, NewServer(NewRESPProtocol(), router))
+	host, port, _ := net.SplitHostPort(addr)
+
+	replies := make(chan Message, 1)
+	client := NewClient(NewRESPProtocol())
+	client.OnUnhandled = func(msg Message, out io.Writer) {
+		replies <- msg
+	}
+	if err := client.Start(context.Background(), host, port); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	if err := client.SendMessage(Message{Command: "ECHO", Arguments: []string{"a", "b"}}); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	select {
+	case got := <-replies:
+		if got.Command != ReplyCommand || !reflect.DeepEqual(got.ArgValue(0), BulkValue("a b")) {
+			t.Errorf("reply got = %+v, want bulk \"a b\"", got)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("no reply")
+	}
+}
+
+func TestDetectProtocol_RESP(t *testing.T) {
+	p, err := DetectProtocol([]byte("*1\r\n$4\r\nPING\r\n"))
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if ProtocolName(p) != "resp" {
+		t.Errorf("DetectProtocol() = %s, want resp", ProtocolName(p))
+	}
+}
+
+func ptr(msg Message) *Message {
+	return &msg
+}
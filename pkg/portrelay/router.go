@@ -7,6 +7,10 @@ import (
 )
 
 type CommandRouter struct {
+	// NotFound handles commands that are not registered. Nil means the
+	// unknown command and the help text are written to the connection.
+	NotFound Handler
+
 	handlers map[string]Handler
 }
 
@@ -22,6 +26,10 @@ func (r *CommandRouter) Register(command string, handler Handler) {
 
 func (r *CommandRouter) Route(msg Message, out io.Writer) {
 	handler, ok := r.handlers[msg.Command]
+	if !ok && r.NotFound != nil {
+		r.NotFound.Handle(msg, out)
+		return
+	}
 	if !ok {
 		fmt.Fprintf(out, "Unknown command: %s\n\n", msg.Command)
 		r.Help(out)
@@ -2,6 +2,7 @@ package portrelay
 
 import (
 	"bytes"
+	"fmt"
 	"io"
 	"strings"
 	"testing"
@@ -100,3 +101,27 @@ func TestCommandRouter_CommandCaseInsensitive(t *testing.T) {
 		t.Errorf("Expected %q but got %q", expected, output.String())
 	}
 }
+
+func TestCommandRouter_NotFound(t *testing.T) {
+	var output bytes.Buffer
+
+	router := NewRouter()
+	router.NotFound = FuncHandler{
+		Func: func(msg Message, out io.Writer) {
+			fmt.Fprintf(out, "no %s\n", msg.Command)
+		},
+	}
+	router.Register("ping", FuncHandler{
+		Func: func(msg Message, out io.Writer) {
+			out.Write([]byte("pong\n"))
+		},
+	})
+
+	router.Route(Message{Command: "ping"}, &output)
+	router.Route(Message{Command: "unknown"}, &output)
+
+	expected := "pong\nno unknown\n"
+	if output.String() != expected {
+		t.Errorf("Expected %q but got %q", expected, output.String())
+	}
+}
@@ -0,0 +1,481 @@
+package portrelay
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"io"
+	"net"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// ErrServerClosed is returned by Serve and ListenAndServe after Shutdown or Close.
+var ErrServerClosed = errors.New("portrelay: server closed")
+
+// serverQueue is how many messages a connection reads ahead of its handlers.
+const serverQueue = 16
+
+// Server is the listening counterpart to Client. Every accepted connection is
+// served in its own goroutine: messages are decoded with the server's
+// MessageProtocol and routed, one at a time and in order, to its CommandRouter.
+// Messages that start a stream are the exception: their handlers run one at a
+// time and in order on a goroutine of the connection's own, while the
+// connection keeps delivering the streams' chunks. The connection is read a
+// few messages ahead of the handlers, so that heartbeats and stream control
+// messages are not held up by them.
+type Server struct {
+	// MaxConns limits the number of connections served at the same time.
+	// Connections accepted above the limit are closed immediately.
+	// Zero means no limit.
+	MaxConns int
+
+	// OnConnect is called before the first message of a connection is read.
+	// It is the place to initialise per-connection state with ServerConn.Set.
+	OnConnect func(*ServerConn)
+	// OnDisconnect is called after a connection is closed. err is nil when
+	// the peer closed the connection cleanly or the server was shut down,
+	// a *HandshakeError when the handshake failed, and a *NetError when the
+	// client stopped answering heartbeats.
+	OnDisconnect func(*ServerConn, error)
+
+	// Handshake makes every connection start with an exchange of Hellos.
+	// Clients must have it enabled too.
+	Handshake bool
+	// Capabilities are advertised in the handshake. Nil means SupportedCapabilities().
+	Capabilities Capabilities
+	// HandshakeTimeout bounds the handshake. Zero means DefaultHandshakeTimeout.
+	HandshakeTimeout time.Duration
+	// TLSConfig makes the server speak TLS on every accepted connection.
+	// Set ClientAuth to tls.RequireAndVerifyClientCert for mutual TLS;
+	// handlers then find the client's identity in ServerConn.PeerCertificate.
+	// A certificate rejected in the TLS handshake reaches OnDisconnect as
+	// a *TLSError.
+	TLSConfig *tls.Config
+	// Sniff makes the server pick each connection's protocol from the first
+	// bytes the client sends, using the registered codecs, so one listener
+	// can serve clients speaking different protocols. The protocol passed to
+	// NewServer, if any, is used when nothing matches.
+	Sniff bool
+	// Heartbeat makes the server ping every client and close connections
+	// whose client stops answering. With Handshake set, only clients that
+	// advertise CapHeartbeat are pinged. Nil means no pings are sent; the
+	// clients' pings are answered either way.
+	Heartbeat *HeartbeatPolicy
+
+	protocol MessageProtocol
+	router   *CommandRouter
+
+	mu        sync.Mutex
+	listeners map[net.Listener]struct{}
+	conns     map[*ServerConn]struct{}
+	closed    bool
+	wg        sync.WaitGroup
+}
+
+func NewServer(protocol MessageProtocol, router *CommandRouter) *Server {
+	if router == nil {
+		router = NewRouter()
+	}
+	return &Server{
+		protocol:  protocol,
+		router:    router,
+		listeners: make(map[net.Listener]struct{}),
+		conns:     make(map[*ServerConn]struct{}),
+	}
+}
+
+func (s *Server) ListenAndServe(host, port string) error {
+	l, err := net.Listen("tcp", net.JoinHostPort(host, port))
+	if err != nil {
+		return err
+	}
+	return s.Serve(l)
+}
+
+// Serve accepts connections on l until it fails or the server is shut down.
+// The listener is closed when Serve returns.
+func (s *Server) Serve(l net.Listener) error {
+	if !s.trackListener(l) {
+		l.Close()
+		return ErrServerClosed
+	}
+	defer s.untrackListener(l)
+
+	for {
+		conn, err := l.Accept()
+		if err != nil {
+			if s.isClosed() {
+				return ErrServerClosed
+			}
+			return err
+		}
+
+		if s.TLSConfig != nil {
+			conn = tls.Server(conn, s.TLSConfig)
+		}
+
+		c := &ServerConn{server: s, conn: conn, protocol: s.protocol}
+		if !s.trackConn(c) {
+			conn.Close()
+			continue
+		}
+		go s.serveConn(c)
+	}
+}
+
+func (s *Server) serveConn(c *ServerConn) {
+	defer s.wg.Done()
+
+	dec := NewProtocolDecoder(c.protocol, c.conn)
+	err := s.handleConn(c, dec)
+
+	c.conn.Close()
+	s.untrackConn(c)
+
+	var handshakeErr *HandshakeError
+	var tlsErr *TLSError
+	if errors.Is(err, ErrServerClosed) || !errors.As(err, &handshakeErr) && !errors.As(err, &tlsErr) && (errors.Is(err, io.EOF) || s.isClosed()) {
+		err = nil
+	}
+	if heartbeatErr := c.heartbeat.failure(); heartbeatErr != nil {
+		err = heartbeatErr
+	}
+	if s.OnDisconnect != nil {
+		s.OnDisconnect(c, err)
+	}
+}
+
+// handleConn runs the handshakes and then routes messages until decoding fails.
+func (s *Server) handleConn(c *ServerConn, dec *Decoder) error {
+	if err := s.setupConn(c, dec); err != nil {
+		if s.isClosed() {
+			return ErrServerClosed
+		}
+		return err
+	}
+	if !s.markReady(c) {
+		return ErrServerClosed
+	}
+
+	if s.OnConnect != nil {
+		s.OnConnect(c)
+	}
+
+	if !s.Handshake || c.negotiated.Has(CapHeartbeat) {
+		c.heartbeat = newHeartbeat(s.Heartbeat)
+	}
+	done := make(chan struct{})
+	defer close(done)
+	control := newControlWriter()
+	go control.run(done, func(msg Message) { c.Send(msg) })
+	if c.heartbeat != nil {
+		go c.heartbeat.run(done, func(ping Message) { control.push(ping) }, func(error) { c.conn.Close() })
+	}
+
+	// Stream handlers read their bodies while the connection is read on.
+	// No more than MaxStreams of them wait here, as that many are open.
+	starts := make(chan func(), MaxStreams)
+	streamsDone := make(chan struct{})
+	go func() {
+		defer close(streamsDone)
+		for start := range starts {
+			start()
+		}
+	}()
+
+	// The connection is read on a goroutine of its own, which answers
+	// heartbeats and stream control messages straight away, so that a
+	// handler waiting for stream credit does not wait for itself.
+	messages := make(chan *Message, serverQueue)
+	readErr := make(chan error, 1)
+	go func() {
+		defer close(messages)
+		readErr <- c.read(dec, control, messages, starts)
+	}()
+	for msg := range messages {
+		s.router.Route(*msg, c)
+	}
+
+	// Shutdown waits for the stream handlers too.
+	c.streams.closeAll(ErrConnectionClosed)
+	close(starts)
+	<-streamsDone
+	return <-readErr
+}
+
+// setupConn runs the TLS handshake, protocol sniffing and the hello
+// exchange that Server enables.
+func (s *Server) setupConn(c *ServerConn, dec *Decoder) error {
+	if tlsConn, ok := c.conn.(*tls.Conn); ok {
+		if err := tlsHandshake(tlsConn, s.TLSConfig.ClientAuth >= tls.RequireAnyClientCert, s.HandshakeTimeout); err != nil {
+			return err
+		}
+	}
+
+	if s.Sniff {
+		p, err := sniffProtocol(c.conn, dec.buf, s.HandshakeTimeout)
+		if err != nil && (s.protocol == nil || !errors.Is(err, ErrUnknownProtocol)) {
+			return err
+		}
+		if err == nil {
+			c.protocol = p
+			dec.protocol = acceptCompressed(p)
+		}
+	}
+	c.enc = NewProtocolEncoder(c.protocol, c.conn)
+
+	if s.Handshake {
+		caps, err := handshake(c.conn, dec.buf, localHello(c.protocol, s.Capabilities), s.HandshakeTimeout)
+		if err != nil {
+			return err
+		}
+		c.negotiated = caps
+		c.enc = NewProtocolEncoder(encodingProtocol(c.protocol, true, caps), c.conn)
+	}
+	return nil
+}
+
+// read reads messages until the connection fails. Messages for handlers are
+// queued on messages, or on starts when they start a stream.
+func (c *ServerConn) read(dec *Decoder, control *controlWriter, messages chan<- *Message, starts chan<- func()) error {
+	for {
+		c.heartbeat.resume()
+		msg, err := dec.Next()
+		if isDroppedFrame(err) {
+			continue
+		}
+		if err != nil {
+			return err
+		}
+		if c.heartbeat.handle(*msg, func(pong Message) { control.push(pong) }) {
+			continue
+		}
+		if c.streams.handle(*msg, func(msg Message) { control.push(msg) }) {
+			continue
+		}
+		stream, err := c.streams.start(msg, func(msg Message) { c.Send(msg) })
+		if err != nil {
+			control.push(cancelStream(msg.Header(HeaderStream), err.Error()))
+			continue
+		}
+		if stream != nil {
+			starts <- func() {
+				c.server.router.Route(*msg, c)
+				stream.Close()
+			}
+			continue
+		}
+
+		select {
+		case messages <- msg:
+		default:
+			// The handlers are behind, so the client's answers wait too.
+			c.heartbeat.pause()
+			messages <- msg
+		}
+	}
+}
+
+// Shutdown stops accepting connections, lets every connection finish the
+// message it is currently handling and then closes it. If ctx expires first,
+// the remaining connections are closed forcibly and ctx's error is returned.
+func (s *Server) Shutdown(ctx context.Context) error {
+	s.mu.Lock()
+	s.closed = true
+	for l := range s.listeners {
+		l.Close()
+	}
+	// A read deadline in the past interrupts connections waiting for their
+	// next message without touching handlers that are still running.
+	// Connections still in their handshakes set deadlines of their own, so
+	// they are closed instead.
+	for c := range s.conns {
+		if c.ready {
+			c.conn.SetReadDeadline(time.Now())
+		} else {
+			c.conn.Close()
+		}
+	}
+	s.mu.Unlock()
+
+	done := make(chan struct{})
+	go func() {
+		s.wg.Wait()
+		close(done)
+	}()
+
+	select {
+	case <-done:
+		return nil
+	case <-ctx.Done():
+		s.closeConns()
+		return ctx.Err()
+	}
+}
+
+// Close closes all listeners and connections immediately.
+func (s *Server) Close() error {
+	s.mu.Lock()
+	s.closed = true
+	for l := range s.listeners {
+		l.Close()
+	}
+	s.mu.Unlock()
+	s.closeConns()
+	return nil
+}
+
+// ConnCount returns the number of connections currently being served.
+func (s *Server) ConnCount() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return len(s.conns)
+}
+
+func (s *Server) closeConns() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for c := range s.conns {
+		c.conn.Close()
+	}
+}
+
+func (s *Server) isClosed() bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.closed
+}
+
+func (s *Server) trackListener(l net.Listener) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.closed {
+		return false
+	}
+	s.listeners[l] = struct{}{}
+	return true
+}
+
+func (s *Server) untrackListener(l net.Listener) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	delete(s.listeners, l)
+	l.Close()
+}
+
+func (s *Server) trackConn(c *ServerConn) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.closed {
+		return false
+	}
+	if s.MaxConns > 0 && len(s.conns) >= s.MaxConns {
+		return false
+	}
+	s.conns[c] = struct{}{}
+	s.wg.Add(1)
+	return true
+}
+
+// markReady records that c finished its handshakes. It reports false when
+// the server was shut down meanwhile.
+func (s *Server) markReady(c *ServerConn) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	c.ready = !s.closed
+	return c.ready
+}
+
+func (s *Server) untrackConn(c *ServerConn) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	delete(s.conns, c)
+}
+
+// ServerConn is a single connection accepted by a Server. It is passed to
+// handlers as their io.Writer; writes go straight to the underlying
+// connection, while Send writes a whole encoded Message.
+type ServerConn struct {
+	server   *Server
+	conn     net.Conn
+	protocol MessageProtocol
+
+	writeMu sync.Mutex
+	enc     *Encoder
+
+	mu     sync.Mutex
+	values map[string]any
+
+	negotiated Capabilities
+	ready      bool // guarded by server.mu
+
+	streams    streams
+	nextStream atomic.Uint64
+	heartbeat  *heartbeat
+}
+
+func (c *ServerConn) Write(p []byte) (int, error) {
+	c.writeMu.Lock()
+	defer c.writeMu.Unlock()
+	return c.conn.Write(p)
+}
+
+// Send encodes msg with the connection's protocol and writes it to the connection.
+func (c *ServerConn) Send(msg Message) error {
+	c.writeMu.Lock()
+	defer c.writeMu.Unlock()
+	return c.enc.Encode(msg)
+}
+
+// Set stores a per-connection value under key.
+func (c *ServerConn) Set(key string, value any) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.values == nil {
+		c.values = make(map[string]any)
+	}
+	c.values[key] = value
+}
+
+// Get returns the per-connection value stored under key.
+func (c *ServerConn) Get(key string) (any, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	v, ok := c.values[key]
+	return v, ok
+}
+
+// Protocol returns the protocol spoken on the connection, which differs
+// from the server's when it was sniffed.
+func (c *ServerConn) Protocol() MessageProtocol {
+	return c.protocol
+}
+
+// Negotiated returns the capabilities agreed on in the handshake.
+// It is nil when the handshake is disabled.
+func (c *ServerConn) Negotiated() Capabilities {
+	return c.negotiated
+}
+
+// PeerCertificate returns the client's verified certificate, or nil when
+// the connection does not use mutual TLS.
+func (c *ServerConn) PeerCertificate() *x509.Certificate {
+	return verifiedPeer(c.conn)
+}
+
+func (c *ServerConn) RemoteAddr() net.Addr {
+	return c.conn.RemoteAddr()
+}
+
+func (c *ServerConn) LocalAddr() net.Addr {
+	return c.conn.LocalAddr()
+}
+
+// Close closes the connection. The server stops serving it once the
+// current handler returns.
+func (c *ServerConn) Close() error {
+	return c.conn.Close()
+}
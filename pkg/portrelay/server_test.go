@@ -0,0 +1,259 @@
+package portrelay
+
+import (
+	"context"
+	"errors"
+	"io"
+	"net"
+	"reflect"
+	"strconv"
+	"sync"
+	"testing"
+	"time"
+)
+
+func startTestServer(t *testing.T, s *Server) string {
+	t.Helper()
+
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	done := make(chan error, 1)
+	go func() {
+		done <- s.Serve(l)
+	}()
+	t.Cleanup(func() {
+		s.Close()
+		if err := <-done; !errors.Is(err, ErrServerClosed) {
+			t.Errorf("Serve() error = %v, want %v", err, ErrServerClosed)
+		}
+	})
+
+	return l.Addr().String()
+}
+
+func TestServer_RoutesMessages(t *testing.T) {
+	p := NewBinaryMessageProtocol()
+	router := NewRouter()
+	router.Register("echo", FuncHandler{
+		Func: func(msg Message, out io.Writer) {
+			out.(*ServerConn).Send(Message{Command: "echoed", Arguments: msg.Arguments})
+		},
+	})
+	addr := startTestServer(t, NewServer(p, router))
+
+	conn, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	defer conn.Close()
+
+	conn.Write(p.Encode(Message{Command: "echo", Arguments: []string{"a", "b"}}))
+
+	got, err := p.Decode(conn)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	expected := &Message{Command: "echoed", Arguments: []string{"a", "b"}}
+	if !reflect.DeepEqual(got, expected) {
+		t.Errorf("reply got = %v, want %v", got, expected)
+	}
+}
+
+func TestServer_PerConnectionState(t *testing.T) {
+	p := NewBinaryMessageProtocol()
+	router := NewRouter()
+	router.Register("count", FuncHandler{
+		Func: func(msg Message, out io.Writer) {
+			c := out.(*ServerConn)
+			n, _ := c.Get("count")
+			c.Set("count", n.(int)+1)
+			c.Send(Message{Command: "count", Arguments: []string{strconv.Itoa(n.(int) + 1)}})
+		},
+	})
+	s := NewServer(p, router)
+	s.OnConnect = func(c *ServerConn) {
+		c.Set("count", 0)
+	}
+	addr := startTestServer(t, s)
+
+	for i := 0; i < 2; i++ {
+		conn, err := net.Dial("tcp", addr)
+		if err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		defer conn.Close()
+
+		for _, want := range []string{"1", "2"} {
+			conn.Write(p.Encode(Message{Command: "count"}))
+			got, err := p.Decode(conn)
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			if got.Arguments[0] != want {
+				t.Errorf("connection %d: count got = %s, want %s", i, got.Arguments[0], want)
+			}
+		}
+	}
+}
+
+func TestServer_MaxConns(t *testing.T) {
+	p := NewBinaryMessageProtocol()
+	router := NewRouter()
+	router.Register("ping", FuncHandler{
+		Func: func(msg Message, out io.Writer) {
+			out.(*ServerConn).Send(Message{Command: "pong"})
+		},
+	})
+	s := NewServer(p, router)
+	s.MaxConns = 1
+	addr := startTestServer(t, s)
+
+	first, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	defer first.Close()
+	first.Write(p.Encode(Message{Command: "ping"}))
+	if _, err := p.Decode(first); err != nil {
+		t.Fatalf("first connection: unexpected error: %v", err)
+	}
+
+	second, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	defer second.Close()
+	second.SetReadDeadline(time.Now().Add(time.Second))
+	if _, err := p.Decode(second); !errors.Is(err, io.EOF) {
+		t.Errorf("second connection: error = %v, want %v", err, io.EOF)
+	}
+}
+
+func TestServer_ShutdownWaitsForHandlers(t *testing.T) {
+	p := NewBinaryMessageProtocol()
+	started := make(chan struct{})
+	release := make(chan struct{})
+	router := NewRouter()
+	router.Register("slow", FuncHandler{
+		Func: func(msg Message, out io.Writer) {
+			close(started)
+			<-release
+			out.(*ServerConn).Send(Message{Command: "done"})
+		},
+	})
+
+	var mu sync.Mutex
+	var disconnectErr error
+	disconnected := make(chan struct{})
+	s := NewServer(p, router)
+	s.OnDisconnect = func(c *ServerConn, err error) {
+		mu.Lock()
+		disconnectErr = err
+		mu.Unlock()
+		close(disconnected)
+	}
+	addr := startTestServer(t, s)
+
+	conn, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	defer conn.Close()
+	conn.Write(p.Encode(Message{Command: "slow"}))
+	<-started
+
+	shutdown := make(chan error, 1)
+	go func() {
+		shutdown <- s.Shutdown(context.Background())
+	}()
+
+	select {
+	case err := <-shutdown:
+		t.Fatalf("Shutdown() returned %v before the handler finished", err)
+	case <-time.After(50 * time.Millisecond):
+	}
+
+	close(release)
+	if err := <-shutdown; err != nil {
+		t.Errorf("Shutdown() error = %v", err)
+	}
+
+	got, err := p.Decode(conn)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if got.Command != "done" {
+		t.Errorf("reply got = %v, want done", got.Command)
+	}
+
+	<-disconnected
+	mu.Lock()
+	defer mu.Unlock()
+	if disconnectErr != nil {
+		t.Errorf("OnDisconnect error = %v, want nil", disconnectErr)
+	}
+}
+
+func TestServer_ShutdownDeadline(t *testing.T) {
+	p := NewBinaryMessageProtocol()
+	started := make(chan struct{})
+	release := make(chan struct{})
+	defer close(release)
+	router := NewRouter()
+	router.Register("stuck", FuncHandler{
+		Func: func(msg Message, out io.Writer) {
+			close(started)
+			<-release
+		},
+	})
+	s := NewServer(p, router)
+	addr := startTestServer(t, s)
+
+	conn, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	defer conn.Close()
+	conn.Write(p.Encode(Message{Command: "stuck"}))
+	<-started
+
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	if err := s.Shutdown(ctx); !errors.Is(err, context.DeadlineExceeded) {
+		t.Errorf("Shutdown() error = %v, want %v", err, context.DeadlineExceeded)
+	}
+}
+
+func TestServer_ShutdownDuringHandshake(t *testing.T) {
+	p := NewBinaryMessageProtocol()
+	disconnected := make(chan error, 1)
+	s := NewServer(p, NewRouter())
+	s.Handshake = true
+	s.HandshakeTimeout = time.Minute
+	s.OnDisconnect = func(c *ServerConn, err error) {
+		disconnected <- err
+	}
+	addr := startTestServer(t, s)
+
+	// The client never sends its hello.
+	conn, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	defer conn.Close()
+	for s.ConnCount() == 0 {
+		time.Sleep(time.Millisecond)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	if err := s.Shutdown(ctx); err != nil {
+		t.Errorf("Shutdown() error = %v", err)
+	}
+	if err := <-disconnected; err != nil {
+		t.Errorf("OnDisconnect error = %v, want nil", err)
+	}
+}
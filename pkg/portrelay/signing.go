@@ -0,0 +1,225 @@
+package portrelay
+
+import (
+	"container/heap"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	// StageSignature is the DecodeError stage reported for frames whose
+	// HMAC signature is missing, made with an unknown key or wrong.
+	StageSignature = "verify signature"
+	// StageReplay is the DecodeError stage reported for signed frames that
+	// are outside the replay window or were already seen.
+	StageReplay = "check replay"
+)
+
+// DefaultReplayWindow is used when a Signer has no Window set.
+const DefaultReplayWindow = 30 * time.Second
+
+// Signer signs BinaryMessageProtocol frames with HMAC-SHA256 and verifies
+// the frames it receives, rejecting replays within its window.
+//
+// Keys are selected by ID, so a shared secret can be rotated without
+// downtime: add the new key everywhere with AddKey, switch senders over
+// with UseKey, then drop the old key with RemoveKey.
+type Signer struct {
+	// Window is how far a frame's timestamp may be from the local clock.
+	// Zero means DefaultReplayWindow.
+	Window time.Duration
+
+	mu    sync.Mutex
+	keys  map[string][]byte
+	keyID string
+	seen  map[string]time.Time // nonce -> when it can be forgotten
+	queue nonceQueue           // the nonces of seen, soonest forgotten first
+	now   func() time.Time
+}
+
+// NewSigner returns a Signer that signs with key under keyID.
+func NewSigner(keyID string, key []byte) (*Signer, error) {
+	if err := checkKeyID(keyID); err != nil {
+		return nil, err
+	}
+	return &Signer{
+		keys:  map[string][]byte{keyID: key},
+		keyID: keyID,
+		seen:  make(map[string]time.Time),
+		now:   time.Now,
+	}, nil
+}
+
+// checkKeyID rejects key IDs that cannot be written in a signature line.
+func checkKeyID(keyID string) error {
+	if keyID == "" || strings.ContainsAny(keyID, " \n") {
+		return fmt.Errorf("invalid key id %q", keyID)
+	}
+	return nil
+}
+
+// AddKey makes frames signed with key under keyID acceptable.
+func (s *Signer) AddKey(keyID string, key []byte) error {
+	if err := checkKeyID(keyID); err != nil {
+		return err
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.keys[keyID] = key
+	return nil
+}
+
+// UseKey switches signing to a key previously added under keyID.
+func (s *Signer) UseKey(keyID string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if _, ok := s.keys[keyID]; !ok {
+		return fmt.Errorf("unknown key id %q", keyID)
+	}
+	s.keyID = keyID
+	return nil
+}
+
+// RemoveKey stops accepting frames signed under keyID. The key used for
+// signing cannot be removed.
+func (s *Signer) RemoveKey(keyID string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if keyID == s.keyID {
+		return fmt.Errorf("key id %q is used for signing", keyID)
+	}
+	delete(s.keys, keyID)
+	return nil
+}
+
+// FORMAT
+// Signed frame: "!<key id> <unix nanoseconds> <hex nonce> <hex HMAC-SHA256>\n<frame>"
+// The HMAC covers the key id, timestamp, nonce and the frame that follows.
+
+// signatureLine returns the line that signs frame.
+func (s *Signer) signatureLine(frame string) string {
+	s.mu.Lock()
+	keyID, key := s.keyID, s.keys[s.keyID]
+	now := s.now()
+	s.mu.Unlock()
+
+	nonce := make([]byte, 16)
+	rand.Read(nonce)
+	timestamp := strconv.FormatInt(now.UnixNano(), 10)
+	nonceHex := hex.EncodeToString(nonce)
+
+	mac := sign(key, keyID, timestamp, nonceHex, frame)
+	return fmt.Sprintf("!%s %s %s %s\n", keyID, timestamp, nonceHex, hex.EncodeToString(mac))
+}
+
+// verify checks the signature line of a frame that re-encodes to frame.
+func (s *Signer) verify(line string, frame string) error {
+	fields := strings.Fields(strings.TrimPrefix(line, "!"))
+	if len(fields) != 4 {
+		return signatureError("malformed signature line", errors.New("invalid format"))
+	}
+	keyID, timestamp, nonce, signature := fields[0], fields[1], fields[2], fields[3]
+
+	s.mu.Lock()
+	key, ok := s.keys[keyID]
+	s.mu.Unlock()
+	if !ok {
+		return signatureError(fmt.Sprintf("unknown key id %q", keyID), errors.New("unknown key"))
+	}
+
+	got, err := hex.DecodeString(signature)
+	if err != nil {
+		return signatureError("signature is not hex", err)
+	}
+	if !hmac.Equal(got, sign(key, keyID, timestamp, nonce, frame)) {
+		return signatureError("signature does not match", errors.New("bad signature"))
+	}
+
+	nanos, err := strconv.ParseInt(timestamp, 10, 64)
+	if err != nil {
+		return replayError("invalid timestamp", err)
+	}
+	return s.checkReplay(time.Unix(0, nanos), nonce)
+}
+
+func (s *Signer) checkReplay(sent time.Time, nonce string) error {
+	window := s.Window
+	if window <= 0 {
+		window = DefaultReplayWindow
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	now := s.now()
+	if sent.Before(now.Add(-window)) || sent.After(now.Add(window)) {
+		return replayError(fmt.Sprintf("timestamp %s outside window of %s", sent.Format(time.RFC3339Nano), window), errors.New("stale frame"))
+	}
+
+	for len(s.queue) > 0 && now.After(s.queue[0].forget) {
+		delete(s.seen, heap.Pop(&s.queue).(seenNonce).nonce)
+	}
+	if _, ok := s.seen[nonce]; ok {
+		return replayError(fmt.Sprintf("nonce %s already seen", nonce), errors.New("replayed frame"))
+	}
+	// Past this point the timestamp check alone rejects the frame.
+	forget := sent.Add(window)
+	s.seen[nonce] = forget
+	heap.Push(&s.queue, seenNonce{nonce: nonce, forget: forget})
+	return nil
+}
+
+type seenNonce struct {
+	nonce  string
+	forget time.Time
+}
+
+// nonceQueue is a heap of nonces ordered by when they can be forgotten, so
+// that expiring them does not mean walking all of them on every frame.
+type nonceQueue []seenNonce
+
+func (q nonceQueue) Len() int           { return len(q) }
+func (q nonceQueue) Less(i, j int) bool { return q[i].forget.Before(q[j].forget) }
+func (q nonceQueue) Swap(i, j int)      { q[i], q[j] = q[j], q[i] }
+func (q *nonceQueue) Push(x any)        { *q = append(*q, x.(seenNonce)) }
+
+func (q *nonceQueue) Pop() any {
+	old := *q
+	n := old[len(old)-1]
+	*q = old[:len(old)-1]
+	return n
+}
+
+func sign(key []byte, keyID, timestamp, nonce, frame string) []byte {
+	mac := hmac.New(sha256.New, key)
+	fmt.Fprintf(mac, "%s\n%s\n%s\n", keyID, timestamp, nonce)
+	mac.Write([]byte(frame))
+	return mac.Sum(nil)
+}
+
+func signatureError(details string, err error) *DecodeError {
+	return &DecodeError{Stage: StageSignature, Index: -1, Details: details, Err: err}
+}
+
+func replayError(details string, err error) *DecodeError {
+	return &DecodeError{Stage: StageReplay, Index: -1, Details: details, Err: err}
+}
+
+// isDroppedFrame reports whether err rejected a frame that was read
+// completely, so that the stream is still in sync and the next frame can
+// be decoded.
+func isDroppedFrame(err error) bool {
+	var decodeErr *DecodeError
+	if !errors.As(err, &decodeErr) {
+		return false
+	}
+	return decodeErr.Stage == StageSignature || decodeErr.Stage == StageReplay
+}
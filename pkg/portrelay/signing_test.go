@@ -0,0 +1,238 @@
+package portrelay
+
+import (
+	"errors"
+	"io"
+	"net"
+	"reflect"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+func newTestSigner(t *testing.T, keyID string, key []byte) *Signer {
+	t.Helper()
+	s, err := NewSigner(keyID, key)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	return s
+}
+
+func signedProtocol(s *Signer) *BinaryMessageProtocol {
+	p := NewBinaryMessageProtocol()
+	p.Signer = s
+	return p
+}
+
+func wantStage(t *testing.T, err error, stage string) {
+	t.Helper()
+	var decodeErr *DecodeError
+	if !errors.As(err, &decodeErr) || decodeErr.Stage != stage {
+		t.Errorf("Decode() error = %v, want stage %q", err, stage)
+	}
+}
+
+func TestSigner_RoundTrip(t *testing.T) {
+	p := signedProtocol(newTestSigner(t, "k1", []byte("secret")))
+	msg := &Message{Command: "deploy", Arguments: []string{"service", "v2"}, ID: 9}
+
+	encoded := p.Encode(*msg)
+	if !strings.HasPrefix(string(encoded), "!k1 ") {
+		t.Errorf("Encode() = %q, want a signature line for key k1", encoded)
+	}
+
+	got, err := p.DecodeBytes(encoded)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if !reflect.DeepEqual(got, msg) {
+		t.Errorf("Decode() got = %v, want %v", got, msg)
+	}
+}
+
+func TestSigner_Rejects(t *testing.T) {
+	sender := signedProtocol(newTestSigner(t, "k1", []byte("secret")))
+	encoded := string(sender.Encode(Message{Command: "deploy", Arguments: []string{"service", "v2"}}))
+
+	tests := []struct {
+		name  string
+		input string
+	}{
+		{name: "Tampered argument", input: strings.Replace(encoded, "v2", "v3", 1)},
+		{name: "Tampered command", input: strings.Replace(encoded, "deploy", "delete", 1)},
+		{name: "Missing signature", input: encoded[strings.Index(encoded, "\n")+1:]},
+		{name: "Unknown key", input: strings.Replace(encoded, "!k1 ", "!k2 ", 1)},
+		{name: "Malformed signature", input: "!k1 garbage\n*1\n$4\nping\n"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			receiver := signedProtocol(newTestSigner(t, "k1", []byte("secret")))
+			_, err := receiver.DecodeString(tt.input)
+			wantStage(t, err, StageSignature)
+		})
+	}
+
+	t.Run("Wrong secret", func(t *testing.T) {
+		receiver := signedProtocol(newTestSigner(t, "k1", []byte("other secret")))
+		_, err := receiver.DecodeString(encoded)
+		wantStage(t, err, StageSignature)
+	})
+}
+
+func TestSigner_Replay(t *testing.T) {
+	sender := signedProtocol(newTestSigner(t, "k1", []byte("secret")))
+	receiver := signedProtocol(newTestSigner(t, "k1", []byte("secret")))
+	encoded := sender.Encode(Message{Command: "transfer", Arguments: []string{"100"}})
+
+	if _, err := receiver.DecodeBytes(encoded); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	_, err := receiver.DecodeBytes(encoded)
+	wantStage(t, err, StageReplay)
+}
+
+func TestSigner_ReplayWindow(t *testing.T) {
+	now := time.Now()
+	senderSigner := newTestSigner(t, "k1", []byte("secret"))
+	senderSigner.now = func() time.Time { return now.Add(-time.Minute) }
+	sender := signedProtocol(senderSigner)
+
+	receiverSigner := newTestSigner(t, "k1", []byte("secret"))
+	receiverSigner.Window = 10 * time.Second
+	receiverSigner.now = func() time.Time { return now }
+	receiver := signedProtocol(receiverSigner)
+
+	_, err := receiver.DecodeBytes(sender.Encode(Message{Command: "late"}))
+	wantStage(t, err, StageReplay)
+
+	// Nonces are forgotten once their timestamp alone would reject them.
+	senderSigner.now = func() time.Time { return now }
+	for i := 0; i < 3; i++ {
+		receiver.DecodeBytes(sender.Encode(Message{Command: "fresh"}))
+	}
+	later := now.Add(time.Minute)
+	senderSigner.now = func() time.Time { return later }
+	receiverSigner.now = func() time.Time { return later }
+	if _, err := receiver.DecodeBytes(sender.Encode(Message{Command: "later"})); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	receiverSigner.mu.Lock()
+	defer receiverSigner.mu.Unlock()
+	if len(receiverSigner.seen) != 1 {
+		t.Errorf("remembered %d nonces, want 1", len(receiverSigner.seen))
+	}
+}
+
+func TestSigner_KeyRotation(t *testing.T) {
+	senderSigner := newTestSigner(t, "2024", []byte("old secret"))
+	sender := signedProtocol(senderSigner)
+	receiverSigner := newTestSigner(t, "2024", []byte("old secret"))
+	receiver := signedProtocol(receiverSigner)
+
+	// Receivers learn the new key first...
+	if err := receiverSigner.AddKey("2025", []byte("new secret")); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if _, err := receiver.DecodeBytes(sender.Encode(Message{Command: "before"})); err != nil {
+		t.Errorf("old key rejected during rotation: %v", err)
+	}
+
+	// ...then senders switch over...
+	senderSigner.AddKey("2025", []byte("new secret"))
+	if err := senderSigner.UseKey("2025"); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if _, err := receiver.DecodeBytes(sender.Encode(Message{Command: "during"})); err != nil {
+		t.Errorf("new key rejected during rotation: %v", err)
+	}
+
+	// ...and the old key is retired.
+	receiverSigner.UseKey("2025")
+	if err := receiverSigner.RemoveKey("2024"); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	oldSender := signedProtocol(newTestSigner(t, "2024", []byte("old secret")))
+	_, err := receiver.DecodeBytes(oldSender.Encode(Message{Command: "after"}))
+	wantStage(t, err, StageSignature)
+
+	if err := receiverSigner.RemoveKey("2025"); err == nil {
+		t.Errorf("RemoveKey() removed the signing key")
+	}
+	if err := receiverSigner.UseKey("missing"); err == nil {
+		t.Errorf("UseKey() accepted an unknown key")
+	}
+}
+
+func TestSigner_ServerDropsBadFrames(t *testing.T) {
+	secret := []byte("secret")
+	received := make(chan string, 2)
+	router := NewRouter()
+	router.Register("run", FuncHandler{
+		Func: func(msg Message, out io.Writer) {
+			received <- msg.Arguments[0]
+		},
+	})
+	addr := startTestServer(t, NewServer(signedProtocol(newTestSigner(t, "k1", secret)), router))
+
+	conn, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	defer conn.Close()
+
+	attacker := signedProtocol(newTestSigner(t, "k1", []byte("guess")))
+	sender := signedProtocol(newTestSigner(t, "k1", secret))
+	conn.Write(attacker.Encode(Message{Command: "run", Arguments: []string{"forged"}}))
+	conn.Write(sender.Encode(Message{Command: "run", Arguments: []string{"genuine"}}))
+
+	select {
+	case got := <-received:
+		if got != "genuine" {
+			t.Errorf("handler got %q, want genuine", got)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("connection was dropped instead of the forged frame")
+	}
+}
+
+func TestNewSigner_InvalidKeyID(t *testing.T) {
+	for _, keyID := range []string{"", "two words", "line\nbreak"} {
+		if _, err := NewSigner(keyID, []byte("secret")); err == nil {
+			t.Errorf("NewSigner(%q) succeeded", keyID)
+		}
+	}
+}
+
+func TestSigner_ForgetsNoncesInOrder(t *testing.T) {
+	now := time.Unix(1_700_000_000, 0)
+	s := newTestSigner(t, "k1", []byte("secret"))
+	s.Window = time.Minute
+	s.now = func() time.Time { return now }
+
+	// Timestamps within the window arrive out of order.
+	for i, offset := range []time.Duration{30, -30, 10, -50, 0} {
+		if err := s.checkReplay(now.Add(offset*time.Second), strconv.Itoa(i)); err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+	}
+	if err := s.checkReplay(now, "3"); err == nil {
+		t.Errorf("checkReplay() accepted a nonce it has seen")
+	}
+
+	// 60s later every nonce sent up to 0s is forgotten, the others are not.
+	now = now.Add(time.Minute + time.Second)
+	if err := s.checkReplay(now, "new"); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if len(s.seen) != 3 || len(s.queue) != 3 {
+		t.Errorf("remembered %d nonces (%d queued), want 3", len(s.seen), len(s.queue))
+	}
+	for _, nonce := range []string{"0", "2", "new"} {
+		if _, ok := s.seen[nonce]; !ok {
+			t.Errorf("nonce %s was forgotten too early", nonce)
+		}
+	}
+}
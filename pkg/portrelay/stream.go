@@ -0,0 +1,443 @@
+package portrelay
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"maps"
+	"strconv"
+	"sync"
+	"sync/atomic"
+)
+
+// CapStreams allows SendStream to be used on the connection.
+const CapStreams Capability = "streams"
+
+// Control commands of a stream. Client and Server consume them; they never
+// reach handlers.
+const (
+	// StreamChunkCommand carries the stream ID and the next piece of the body.
+	StreamChunkCommand = "portrelay:chunk"
+	// StreamEndCommand marks the end of the body.
+	StreamEndCommand = "portrelay:end"
+	// StreamAbortCommand is sent by the sender when it gives up on a stream.
+	StreamAbortCommand = "portrelay:abort"
+	// StreamCancelCommand is sent by the receiver when it stops reading a stream.
+	StreamCancelCommand = "portrelay:cancel"
+	// StreamCreditCommand is sent by the receiver to let the sender send
+	// more of a stream.
+	StreamCreditCommand = "portrelay:credit"
+)
+
+// HeaderStream marks a message whose body follows it as a stream. Its value
+// is the stream's ID, chosen by the sender.
+const HeaderStream = "stream"
+
+// StreamChunkSize is the largest piece of a body sent in one chunk.
+const StreamChunkSize = 32 << 10
+
+// StreamWindow is how many bytes of a stream the sender may send before the
+// receiver's handler has read them.
+const StreamWindow = 8 * StreamChunkSize
+
+// MaxStreams is how many streams a connection receives at the same time.
+// Further streams are cancelled without calling their handler.
+const MaxStreams = 64
+
+// ErrStreamAborted is returned by the reader of a stream its sender gave up
+// on, and by SendStream when the receiver stopped reading.
+var ErrStreamAborted = errors.New("portrelay: stream aborted")
+
+// FORMAT
+// A stream is a message with a HeaderStream header, followed by any number of
+// "portrelay:chunk <id> <data>" messages and a final "portrelay:end <id>".
+// The sender may give up with "portrelay:abort <id> <reason>" instead, and the
+// receiver may ask it to stop with "portrelay:cancel <id> <reason>". Other
+// messages may be sent between the chunks.
+//
+// The sender sends at most StreamWindow bytes of chunk data the receiver has
+// not granted it yet; "portrelay:credit <id> <n>" grants n more. A receiver
+// cancels a stream whose sender does not keep to this.
+//
+// The receiver calls the handler with Message.Stream reading the chunks as
+// they arrive, and grants credit as the handler reads them. Chunks are
+// buffered, so the connection is read on while the handler is busy. When the
+// handler returns, the rest of the body is discarded and the sender is told
+// to stop.
+
+// streams tracks the streams of one connection in both directions.
+type streams struct {
+	mu       sync.Mutex
+	incoming map[string]*streamBuffer
+	outgoing map[string]*outgoingStream
+	open     int // incoming streams whose handler has not returned
+}
+
+// outgoingStream is a stream being sent.
+type outgoingStream struct {
+	stop   context.CancelCauseFunc
+	credit atomic.Int64
+	more   chan struct{} // signalled when credit grows
+}
+
+// start sets msg.Stream when msg starts a stream, and returns the body to
+// close once the handler is done with it, or nil. The handler's reads grant
+// credit with send. It fails when MaxStreams streams are open already.
+func (s *streams) start(msg *Message, send func(Message)) (*streamBuffer, error) {
+	id := msg.Header(HeaderStream)
+	if id == "" {
+		return nil, nil
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.open >= MaxStreams {
+		return nil, fmt.Errorf("more than %d streams", MaxStreams)
+	}
+	if s.incoming == nil {
+		s.incoming = make(map[string]*streamBuffer)
+	}
+	if old, ok := s.incoming[id]; ok {
+		old.finish(fmt.Errorf("%w: stream %s was reopened", ErrStreamAborted, id))
+	}
+	b := &streamBuffer{id: id, streams: s, send: send}
+	b.cond.L = &b.mu
+	s.incoming[id] = b
+	s.open++
+
+	msg.Stream = b
+	return b, nil
+}
+
+// handle consumes msg if it is a stream control message and reports whether
+// it was one. reply sends the cancel of an incoming stream that broke the
+// window; it must not block.
+func (s *streams) handle(msg Message, reply func(Message)) bool {
+	switch msg.Command {
+	case StreamChunkCommand, StreamEndCommand, StreamAbortCommand, StreamCancelCommand, StreamCreditCommand:
+	default:
+		return false
+	}
+	if len(msg.Arguments) == 0 {
+		return true
+	}
+	id := msg.Arguments[0]
+
+	s.mu.Lock()
+	b, receiving := s.incoming[id]
+	out, sending := s.outgoing[id]
+	s.mu.Unlock()
+
+	switch msg.Command {
+	case StreamCancelCommand:
+		if sending {
+			out.stop(fmt.Errorf("%w by the receiver: %s", ErrStreamAborted, argument(msg, 1)))
+		}
+	case StreamCreditCommand:
+		if n, err := strconv.Atoi(argument(msg, 1)); err == nil && n > 0 && sending {
+			out.credit.Add(int64(n))
+			select {
+			case out.more <- struct{}{}:
+			default:
+			}
+		}
+	case StreamChunkCommand:
+		if !receiving {
+			// A stream the handler already stopped reading.
+			break
+		}
+		if !b.write(msg.ArgBytes(1)) {
+			s.remove(b)
+			b.finish(fmt.Errorf("%w: the sender exceeded the window", ErrStreamAborted))
+			reply(cancelStream(id, "window exceeded"))
+		}
+	case StreamEndCommand:
+		if receiving {
+			s.remove(b)
+			b.finish(io.EOF)
+		}
+	case StreamAbortCommand:
+		if receiving {
+			s.remove(b)
+			b.finish(fmt.Errorf("%w by the sender: %s", ErrStreamAborted, argument(msg, 1)))
+		}
+	}
+	return true
+}
+
+// remove forgets b, unless its stream was reopened since.
+func (s *streams) remove(b *streamBuffer) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.incoming[b.id] == b {
+		delete(s.incoming, b.id)
+	}
+}
+
+// closeAll fails every stream with err once the connection is gone.
+func (s *streams) closeAll(err error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for id, b := range s.incoming {
+		b.finish(err)
+		delete(s.incoming, id)
+	}
+	for _, out := range s.outgoing {
+		out.stop(err)
+	}
+}
+
+// streamBuffer is the body of an incoming stream. It holds the chunks that
+// arrived but were not read yet, at most StreamWindow bytes of them.
+type streamBuffer struct {
+	id      string
+	streams *streams
+	send    func(Message)
+
+	mu      sync.Mutex
+	cond    sync.Cond
+	chunks  [][]byte
+	size    int
+	unacked int   // bytes read but not granted back to the sender yet
+	err     error // returned once the chunks are read: io.EOF or why the stream failed
+	closed  bool
+}
+
+// write adds a chunk and reports whether it fit into the window.
+func (b *streamBuffer) write(chunk []byte) bool {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.closed || b.err != nil {
+		return true
+	}
+	if b.size+len(chunk) > StreamWindow {
+		return false
+	}
+	if len(chunk) > 0 {
+		b.chunks = append(b.chunks, chunk)
+		b.size += len(chunk)
+		b.cond.Signal()
+	}
+	return true
+}
+
+// finish ends the stream with err once the buffered chunks are read.
+func (b *streamBuffer) finish(err error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.err == nil {
+		b.err = err
+	}
+	b.cond.Broadcast()
+}
+
+func (b *streamBuffer) Read(p []byte) (int, error) {
+	b.mu.Lock()
+	for len(b.chunks) == 0 && b.err == nil && !b.closed {
+		b.cond.Wait()
+	}
+	if b.closed {
+		b.mu.Unlock()
+		return 0, io.ErrClosedPipe
+	}
+	if len(b.chunks) == 0 {
+		defer b.mu.Unlock()
+		return 0, b.err
+	}
+
+	n := copy(p, b.chunks[0])
+	if b.chunks[0] = b.chunks[0][n:]; len(b.chunks[0]) == 0 {
+		b.chunks = b.chunks[1:]
+	}
+	b.size -= n
+	b.unacked += n
+	grant := 0
+	if b.unacked >= StreamWindow/2 && b.err == nil {
+		grant, b.unacked = b.unacked, 0
+	}
+	b.mu.Unlock()
+
+	if grant > 0 {
+		b.send(Message{Command: StreamCreditCommand, Arguments: []string{b.id, strconv.Itoa(grant)}})
+	}
+	return n, nil
+}
+
+// Close discards the rest of the body and, unless it was all received
+// already, tells the sender to stop.
+func (b *streamBuffer) Close() error {
+	b.mu.Lock()
+	if b.closed {
+		b.mu.Unlock()
+		return nil
+	}
+	b.closed = true
+	b.chunks = nil
+	received := b.err != nil
+	b.cond.Broadcast()
+	b.mu.Unlock()
+
+	b.streams.mu.Lock()
+	b.streams.open--
+	b.streams.mu.Unlock()
+	if !received {
+		b.streams.remove(b)
+		b.send(cancelStream(b.id, "receiver stopped reading"))
+	}
+	return nil
+}
+
+// send sends msg as stream id followed by body, one frame at a time with send.
+func (s *streams) send(ctx context.Context, id string, msg Message, body io.Reader, send func(context.Context, Message) error) error {
+	ctx, stop := context.WithCancelCause(ctx)
+	defer stop(nil)
+
+	out := &outgoingStream{stop: stop, more: make(chan struct{}, 1)}
+	out.credit.Store(StreamWindow)
+	s.mu.Lock()
+	if s.outgoing == nil {
+		s.outgoing = make(map[string]*outgoingStream)
+	}
+	s.outgoing[id] = out
+	s.mu.Unlock()
+	defer func() {
+		s.mu.Lock()
+		delete(s.outgoing, id)
+		s.mu.Unlock()
+	}()
+
+	msg.Headers = maps.Clone(msg.Headers)
+	msg.SetHeader(HeaderStream, id)
+	msg.Stream = nil
+	if err := send(ctx, msg); err != nil {
+		return err
+	}
+
+	abort := func(err error) error {
+		if !errors.Is(err, ErrStreamAborted) && !errors.Is(err, ErrConnectionClosed) {
+			send(context.WithoutCancel(ctx), Message{Command: StreamAbortCommand, Arguments: []string{id, err.Error()}})
+		}
+		return err
+	}
+
+	buf := make([]byte, StreamChunkSize)
+	for {
+		if ctx.Err() != nil {
+			return abort(context.Cause(ctx))
+		}
+
+		n, err := body.Read(buf)
+		if n > 0 {
+			// Wait for the receiver to make room for the chunk.
+			for out.credit.Load() < int64(n) {
+				select {
+				case <-out.more:
+				case <-ctx.Done():
+					return abort(context.Cause(ctx))
+				}
+			}
+			out.credit.Add(-int64(n))
+
+			chunk := Message{Command: StreamChunkCommand, Arguments: []string{id, string(buf[:n])}}
+			if err := send(ctx, chunk); err != nil {
+				if ctx.Err() != nil {
+					return abort(context.Cause(ctx))
+				}
+				return err
+			}
+		}
+		if err == io.EOF {
+			return send(ctx, Message{Command: StreamEndCommand, Arguments: []string{id}})
+		}
+		if err != nil {
+			return abort(err)
+		}
+	}
+}
+
+// SendStream sends msg with Message.Stream on the server reading body until
+// io.EOF. It returns once the whole body is sent, or when ctx is done, body
+// fails or the receiver stops reading; the server's reader then fails with
+// ErrStreamAborted.
+func (c *Client) SendStream(ctx context.Context, msg Message, body io.Reader) error {
+	if _, _, err := c.current(); err != nil {
+		return err
+	}
+	if !c.supports(CapStreams) {
+		return fmt.Errorf("%w: %s", ErrNotNegotiated, CapStreams)
+	}
+	id := strconv.FormatUint(c.nextID.Add(1), 10)
+	return c.streams.send(ctx, id, msg, body, c.Send)
+}
+
+// SendStream sends msg with Message.Stream on the client reading body until
+// io.EOF, like Client.SendStream. Handlers may call it, as the connection is
+// read on while it waits for the client to read the body.
+func (c *ServerConn) SendStream(ctx context.Context, msg Message, body io.Reader) error {
+	if c.server.Handshake && !c.negotiated.Has(CapStreams) {
+		return fmt.Errorf("%w: %s", ErrNotNegotiated, CapStreams)
+	}
+	id := strconv.FormatUint(c.nextStream.Add(1), 10)
+	return c.streams.send(ctx, id, msg, body, func(ctx context.Context, msg Message) error {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		return c.Send(msg)
+	})
+}
+
+// cancelStream tells the sender of stream id to stop.
+func cancelStream(id string, reason string) Message {
+	return Message{Command: StreamCancelCommand, Arguments: []string{id, reason}}
+}
+
+// controlWriter writes heartbeats and the control messages a read loop
+// answers with, such as pongs and stream cancels, from a goroutine of its
+// own, so that reading never waits for the peer to read. Messages that find
+// its queue full are dropped.
+type controlWriter struct {
+	queue chan Message
+}
+
+func newControlWriter() *controlWriter {
+	return &controlWriter{queue: make(chan Message, MaxStreams)}
+}
+
+// run sends the queued messages with send until done is closed.
+func (w *controlWriter) run(done <-chan struct{}, send func(Message)) {
+	for {
+		select {
+		case msg := <-w.queue:
+			send(msg)
+		case <-done:
+			return
+		}
+	}
+}
+
+// push queues msg and reports whether there was room for it.
+func (w *controlWriter) push(msg Message) bool {
+	select {
+	case w.queue <- msg:
+		return true
+	default:
+		return false
+	}
+}
+
+// argument returns argument i of msg, or "" when there is none.
+func argument(msg Message, i int) string {
+	if i >= len(msg.Arguments) {
+		return ""
+	}
+	return msg.Arguments[i]
+}
+
+// closeStream closes the body of a message once its handler returned, which
+// makes the sender stop if the handler did not read it all.
+func closeStream(stream *streamBuffer) {
+	if stream != nil {
+		stream.Close()
+	}
+}
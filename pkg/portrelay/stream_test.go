@@ -0,0 +1,374 @@
+package portrelay
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"errors"
+	"io"
+	"net"
+	"strconv"
+	"testing"
+	"time"
+)
+
+// startStreamClient connects a client to router over protocols that refuse
+// arguments larger than two chunks.
+func startStreamClient(t *testing.T, router *CommandRouter) *Client {
+	t.Helper()
+
+	limits := DefaultDecodeLimits
+	limits.MaxArgSize = 2 * StreamChunkSize
+	addr := startTestServer(t, NewServer(&BinaryMessageProtocol{Limits: limits}, router))
+	host, port, _ := net.SplitHostPort(addr)
+
+	client := NewClient(&BinaryMessageProtocol{Limits: limits})
+	if err := client.Start(context.Background(), host, port); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	t.Cleanup(func() { client.Close() })
+	return client
+}
+
+type streamResult struct {
+	msg  Message
+	body []byte
+	err  error
+}
+
+func TestSendStream(t *testing.T) {
+	received := make(chan streamResult, 1)
+	router := NewRouter()
+	router.Register("upload", FuncHandler{
+		Func: func(msg Message, out io.Writer) {
+			body, err := io.ReadAll(msg.Stream)
+			received <- streamResult{msg: msg, body: body, err: err}
+		},
+	})
+	client := startStreamClient(t, router)
+
+	body := make([]byte, 1<<20+7)
+	rand.Read(body)
+	ctx, cancel := context.WithTimeout(context.Background(), time.Minute)
+	defer cancel()
+	msg := Message{Command: "upload", Arguments: []string{"file.bin"}}
+	if err := client.SendStream(ctx, msg, bytes.NewReader(body)); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	got := <-received
+	if got.err != nil {
+		t.Fatalf("reading the stream: unexpected error: %v", got.err)
+	}
+	if !bytes.Equal(got.body, body) {
+		t.Errorf("stream got %d bytes, want the %d bytes sent", len(got.body), len(body))
+	}
+	if len(got.msg.Arguments) != 1 || got.msg.Arguments[0] != "file.bin" || got.msg.Header(HeaderStream) == "" {
+		t.Errorf("message got = %+v", got.msg)
+	}
+	if msg.Headers != nil {
+		t.Errorf("SendStream() changed the caller's headers: %v", msg.Headers)
+	}
+}
+
+// failingReader returns n bytes and then err.
+type failingReader struct {
+	n   int
+	err error
+}
+
+func (r *failingReader) Read(p []byte) (int, error) {
+	if r.n == 0 {
+		return 0, r.err
+	}
+	n := min(len(p), r.n)
+	clear(p[:n])
+	r.n -= n
+	return n, nil
+}
+
+func TestSendStream_SenderAborts(t *testing.T) {
+	received := make(chan streamResult, 1)
+	router := NewRouter()
+	router.Register("upload", FuncHandler{
+		Func: func(msg Message, out io.Writer) {
+			body, err := io.ReadAll(msg.Stream)
+			received <- streamResult{body: body, err: err}
+		},
+	})
+	client := startStreamClient(t, router)
+
+	readErr := errors.New("disk on fire")
+	err := client.SendStream(context.Background(), Message{Command: "upload"}, &failingReader{n: 3 * StreamChunkSize, err: readErr})
+	if !errors.Is(err, readErr) {
+		t.Errorf("SendStream() error = %v, want %v", err, readErr)
+	}
+
+	got := <-received
+	if !errors.Is(got.err, ErrStreamAborted) {
+		t.Errorf("reading the stream: error = %v, want %v", got.err, ErrStreamAborted)
+	}
+	if len(got.body) != 3*StreamChunkSize {
+		t.Errorf("stream got %d bytes before the abort, want %d", len(got.body), 3*StreamChunkSize)
+	}
+}
+
+// endlessReader never runs out of data.
+type endlessReader struct{}
+
+func (endlessReader) Read(p []byte) (int, error) {
+	return len(p), nil
+}
+
+func TestSendStream_ReceiverStops(t *testing.T) {
+	router := NewRouter()
+	router.Register("upload", FuncHandler{
+		Func: func(msg Message, out io.Writer) {
+			io.ReadFull(msg.Stream, make([]byte, 10))
+		},
+	})
+	router.Register("echo", FuncHandler{
+		Func: func(msg Message, out io.Writer) {
+			Reply(out, msg, Message{Command: "echo"})
+		},
+	})
+	client := startStreamClient(t, router)
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Minute)
+	defer cancel()
+	if err := client.SendStream(ctx, Message{Command: "upload"}, endlessReader{}); !errors.Is(err, ErrStreamAborted) {
+		t.Fatalf("SendStream() error = %v, want %v", err, ErrStreamAborted)
+	}
+
+	// Chunks still in flight are dropped and the connection stays usable.
+	if _, err := client.Call(ctx, Message{Command: "echo"}); err != nil {
+		t.Errorf("Call() after the stream was cancelled: unexpected error: %v", err)
+	}
+}
+
+func TestSendStream_ConnectionLost(t *testing.T) {
+	started := make(chan struct{})
+	router := NewRouter()
+	router.Register("download", FuncHandler{
+		Func: func(msg Message, out io.Writer) {
+			close(started)
+			out.(*ServerConn).SendStream(context.Background(), Message{Command: "file"}, endlessReader{})
+		},
+	})
+	server := NewServer(NewBinaryMessageProtocol(), router)
+	addr := startTestServer(t, server)
+	host, port, _ := net.SplitHostPort(addr)
+
+	received := make(chan error, 1)
+	client := NewClient(NewBinaryMessageProtocol())
+	client.RegisterHandler("file", FuncHandler{
+		Func: func(msg Message, out io.Writer) {
+			_, err := io.Copy(io.Discard, msg.Stream)
+			received <- err
+		},
+	})
+	if err := client.Start(context.Background(), host, port); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if err := client.SendMessage(Message{Command: "download"}); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	<-started
+	server.Close()
+	select {
+	case err := <-received:
+		if !errors.Is(err, ErrConnectionClosed) {
+			t.Errorf("reading the stream: error = %v, want %v", err, ErrConnectionClosed)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("the stream was not failed when the connection was lost")
+	}
+}
+
+func TestSendStream_NotNegotiated(t *testing.T) {
+	client := NewClient(NewBinaryMessageProtocol())
+	client.Handshake = true
+	client.state = StateConnected
+	client.negotiated = Capabilities{CapMessageIDs}
+	if err := client.SendStream(context.Background(), Message{Command: "x"}, endlessReader{}); !errors.Is(err, ErrNotNegotiated) {
+		t.Errorf("SendStream() error = %v, want %v", err, ErrNotNegotiated)
+	}
+}
+
+func TestSendStream_ClientHandlerCalls(t *testing.T) {
+	router := NewRouter()
+	router.Register("download", FuncHandler{
+		Func: func(msg Message, out io.Writer) {
+			go out.(*ServerConn).SendStream(context.Background(), Message{Command: "file"}, bytes.NewReader(make([]byte, 4*StreamWindow)))
+		},
+	})
+	router.Register("echo", FuncHandler{
+		Func: func(msg Message, out io.Writer) {
+			Reply(out, msg, Message{Command: "echo"})
+		},
+	})
+	host, port, _ := net.SplitHostPort(startTestServer(t, NewServer(NewBinaryMessageProtocol(), router)))
+
+	received := make(chan streamResult, 1)
+	client := NewClient(NewBinaryMessageProtocol())
+	client.RegisterHandler("file", FuncHandler{
+		Func: func(msg Message, out io.Writer) {
+			// The chunks keep arriving while the handler waits for a reply.
+			ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+			defer cancel()
+			if _, err := client.Call(ctx, Message{Command: "echo"}); err != nil {
+				received <- streamResult{err: err}
+				return
+			}
+			body, err := io.ReadAll(msg.Stream)
+			received <- streamResult{body: body, err: err}
+		},
+	})
+	if err := client.Start(context.Background(), host, port); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	defer client.Close()
+	if err := client.SendMessage(Message{Command: "download"}); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	select {
+	case got := <-received:
+		if got.err != nil {
+			t.Fatalf("unexpected error: %v", got.err)
+		}
+		if len(got.body) != 4*StreamWindow {
+			t.Errorf("stream got %d bytes, want %d", len(got.body), 4*StreamWindow)
+		}
+	case <-time.After(10 * time.Second):
+		t.Fatal("the handler did not finish")
+	}
+}
+
+func TestStreams_Limits(t *testing.T) {
+	var s streams
+	var sent []Message
+	send := func(msg Message) { sent = append(sent, msg) }
+
+	var open []*streamBuffer
+	for i := range MaxStreams {
+		msg := Message{Command: "upload", Headers: map[string]string{HeaderStream: strconv.Itoa(i)}}
+		b, err := s.start(&msg, send)
+		if err != nil {
+			t.Fatalf("start() of stream %d: unexpected error: %v", i, err)
+		}
+		open = append(open, b)
+	}
+	extra := Message{Command: "upload", Headers: map[string]string{HeaderStream: "extra"}}
+	if _, err := s.start(&extra, send); err == nil {
+		t.Errorf("start() of stream %d succeeded, want an error", MaxStreams+1)
+	}
+	open[0].Close()
+	if _, err := s.start(&extra, send); err != nil {
+		t.Errorf("start() after a stream was closed: unexpected error: %v", err)
+	}
+
+	// A sender that ignores the window is cancelled.
+	var replies []Message
+	reply := func(msg Message) { replies = append(replies, msg) }
+	for range StreamWindow/StreamChunkSize + 1 {
+		s.handle(Message{Command: StreamChunkCommand, Arguments: []string{"1", string(make([]byte, StreamChunkSize))}}, reply)
+	}
+	if len(replies) != 1 || replies[0].Command != StreamCancelCommand {
+		t.Errorf("replies = %v, want a cancel", replies)
+	}
+	if _, err := io.ReadAll(open[1]); !errors.Is(err, ErrStreamAborted) {
+		t.Errorf("reading the stream: error = %v, want %v", err, ErrStreamAborted)
+	}
+}
+
+func TestSendStream_FromServerHandler(t *testing.T) {
+	body := make([]byte, 1<<20)
+	rand.Read(body)
+	sent := make(chan error, 1)
+	router := NewRouter()
+	router.Register("download", FuncHandler{
+		Func: func(msg Message, out io.Writer) {
+			// The handler waits for credit, which the connection keeps reading.
+			ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+			defer cancel()
+			sent <- out.(*ServerConn).SendStream(ctx, Message{Command: "file"}, bytes.NewReader(body))
+		},
+	})
+	host, port, _ := net.SplitHostPort(startTestServer(t, NewServer(NewBinaryMessageProtocol(), router)))
+
+	received := make(chan streamResult, 1)
+	client := NewClient(NewBinaryMessageProtocol())
+	client.RegisterHandler("file", FuncHandler{
+		Func: func(msg Message, out io.Writer) {
+			body, err := io.ReadAll(msg.Stream)
+			received <- streamResult{body: body, err: err}
+		},
+	})
+	if err := client.Start(context.Background(), host, port); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	defer client.Close()
+	if err := client.SendMessage(Message{Command: "download"}); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	if err := <-sent; err != nil {
+		t.Fatalf("SendStream() error = %v", err)
+	}
+	got := <-received
+	if got.err != nil {
+		t.Fatalf("reading the stream: unexpected error: %v", got.err)
+	}
+	if !bytes.Equal(got.body, body) {
+		t.Errorf("stream got %d bytes, want the %d bytes sent", len(got.body), len(body))
+	}
+}
+
+func TestServer_ShutdownWaitsForStreamHandlers(t *testing.T) {
+	started := make(chan struct{})
+	release := make(chan struct{})
+	finished := make(chan struct{})
+	router := NewRouter()
+	router.Register("upload", FuncHandler{
+		Func: func(msg Message, out io.Writer) {
+			io.ReadAll(msg.Stream)
+			close(started)
+			<-release
+			close(finished)
+		},
+	})
+	s := NewServer(NewBinaryMessageProtocol(), router)
+	host, port, _ := net.SplitHostPort(startTestServer(t, s))
+
+	client := NewClient(NewBinaryMessageProtocol())
+	if err := client.Start(context.Background(), host, port); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	defer client.Close()
+	if err := client.SendStream(context.Background(), Message{Command: "upload"}, bytes.NewReader([]byte("body"))); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	<-started
+
+	shutdown := make(chan error, 1)
+	go func() {
+		shutdown <- s.Shutdown(context.Background())
+	}()
+	select {
+	case err := <-shutdown:
+		t.Fatalf("Shutdown() returned %v before the stream handler finished", err)
+	case <-time.After(50 * time.Millisecond):
+	}
+
+	close(release)
+	if err := <-shutdown; err != nil {
+		t.Errorf("Shutdown() error = %v", err)
+	}
+	select {
+	case <-finished:
+	default:
+		t.Error("Shutdown() returned while the stream handler was running")
+	}
+}
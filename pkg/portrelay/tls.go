@@ -0,0 +1,124 @@
+package portrelay
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"net"
+	"reflect"
+	"time"
+)
+
+// TLSError is returned when the TLS handshake fails because a certificate
+// was rejected. It is distinct from ConnError: the peer was reachable, but
+// could not be trusted or did not trust us. Other handshake failures, such
+// as the connection dropping or timing out, are returned as they are.
+type TLSError struct {
+	Err error
+}
+
+func (e *TLSError) Error() string {
+	return fmt.Sprintf("tls handshake failed: %v", e.Err)
+}
+
+func (e *TLSError) Unwrap() error {
+	return e.Err
+}
+
+// clientTLS runs the client side of a TLS handshake over conn. The server
+// name defaults to host so that the certificate is checked against it.
+func clientTLS(conn net.Conn, config *tls.Config, host string, timeout time.Duration) (*tls.Conn, error) {
+	config = config.Clone()
+	if config.ServerName == "" {
+		config.ServerName = host
+	}
+
+	tlsConn := tls.Client(conn, config)
+	if err := tlsHandshake(tlsConn, false, timeout); err != nil {
+		return nil, err
+	}
+	return tlsConn, nil
+}
+
+// tlsHandshake runs the handshake of conn. requireCert says the peer must
+// present a certificate, as a server with ClientAuth set to require one does.
+func tlsHandshake(conn *tls.Conn, requireCert bool, timeout time.Duration) error {
+	if timeout <= 0 {
+		timeout = DefaultHandshakeTimeout
+	}
+	conn.SetDeadline(time.Now().Add(timeout))
+	defer conn.SetDeadline(time.Time{})
+
+	err := conn.Handshake()
+	if err == nil {
+		return nil
+	}
+	if certificateRejected(err) || requireCert && len(conn.ConnectionState().PeerCertificates) == 0 && !isNetError(err) {
+		return &TLSError{Err: err}
+	}
+	return err
+}
+
+// certificateRejected reports whether err is about a certificate, either
+// ours rejected by the peer, which tells with a certificate alert, or the peer's.
+func certificateRejected(err error) bool {
+	var (
+		verifyErr   *tls.CertificateVerificationError
+		unknownCA   x509.UnknownAuthorityError
+		hostname    x509.HostnameError
+		invalid     x509.CertificateInvalidError
+		systemRoots x509.SystemRootsError
+	)
+	alert, ok := alertCode(err)
+	return errors.As(err, &verifyErr) || ok && certificateAlert(alert) ||
+		errors.As(err, &unknownCA) || errors.As(err, &hostname) ||
+		errors.As(err, &invalid) || errors.As(err, &systemRoots)
+}
+
+// alertCode returns the TLS alert carried by err. Alerts received from the
+// peer come as a "remote error" holding crypto/tls's unexported alert type,
+// which is a uint8 like tls.AlertError.
+func alertCode(err error) (uint8, bool) {
+	var alert tls.AlertError
+	if errors.As(err, &alert) {
+		return uint8(alert), true
+	}
+	var opErr *net.OpError
+	if errors.As(err, &opErr) && opErr.Op == "remote error" && opErr.Err != nil {
+		if v := reflect.ValueOf(opErr.Err); v.Kind() == reflect.Uint8 {
+			return uint8(v.Uint()), true
+		}
+	}
+	return 0, false
+}
+
+// certificateAlert reports whether a is one of the alerts a peer sends when
+// it does not accept our certificate.
+func certificateAlert(a uint8) bool {
+	switch a {
+	case 42, // bad_certificate
+		43,  // unsupported_certificate
+		44,  // certificate_revoked
+		45,  // certificate_expired
+		46,  // certificate_unknown
+		48,  // unknown_ca
+		116: // certificate_required
+		return true
+	}
+	return false
+}
+
+// verifiedPeer returns the leaf certificate of the first verified chain of
+// conn, or nil when conn is not TLS or the peer was not verified.
+func verifiedPeer(conn net.Conn) *x509.Certificate {
+	tlsConn, ok := conn.(*tls.Conn)
+	if !ok {
+		return nil
+	}
+	state := tlsConn.ConnectionState()
+	if len(state.VerifiedChains) == 0 || len(state.VerifiedChains[0]) == 0 {
+		return nil
+	}
+	return state.VerifiedChains[0][0]
+}
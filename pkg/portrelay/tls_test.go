@@ -0,0 +1,279 @@
+package portrelay
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"errors"
+	"io"
+	"math/big"
+	"net"
+	"testing"
+	"time"
+)
+
+type testCA struct {
+	cert *x509.Certificate
+	key  *ecdsa.PrivateKey
+	pool *x509.CertPool
+}
+
+func newTestCA(t *testing.T) *testCA {
+	t.Helper()
+
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	template := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "portrelay test CA"},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		IsCA:                  true,
+		KeyUsage:              x509.KeyUsageCertSign,
+		BasicConstraintsValid: true,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	cert, _ := x509.ParseCertificate(der)
+
+	pool := x509.NewCertPool()
+	pool.AddCert(cert)
+	return &testCA{cert: cert, key: key, pool: pool}
+}
+
+func (ca *testCA) issue(t *testing.T, commonName string, usage x509.ExtKeyUsage) tls.Certificate {
+	t.Helper()
+
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(time.Now().UnixNano()),
+		Subject:      pkix.Name{CommonName: commonName},
+		DNSNames:     []string{commonName},
+		IPAddresses:  []net.IP{net.ParseIP("127.0.0.1")},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{usage},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, ca.cert, &key.PublicKey, ca.key)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	return tls.Certificate{Certificate: [][]byte{der}, PrivateKey: key}
+}
+
+func startTLSServer(t *testing.T, config *tls.Config, router *CommandRouter) (host, port string, disconnects chan error) {
+	t.Helper()
+
+	s := NewServer(NewBinaryMessageProtocol(), router)
+	s.TLSConfig = config
+	disconnects = make(chan error, 1)
+	s.OnDisconnect = func(c *ServerConn, err error) {
+		disconnects <- err
+	}
+	host, port, _ = net.SplitHostPort(startTestServer(t, s))
+	return host, port, disconnects
+}
+
+func TestTLS_MutualIdentity(t *testing.T) {
+	ca := newTestCA(t)
+	identities := make(chan string, 1)
+	router := NewRouter()
+	router.Register("whoami", FuncHandler{
+		Func: func(msg Message, out io.Writer) {
+			identities <- out.(*ServerConn).PeerCertificate().Subject.CommonName
+		},
+	})
+
+	host, port, _ := startTLSServer(t, &tls.Config{
+		Certificates: []tls.Certificate{ca.issue(t, "127.0.0.1", x509.ExtKeyUsageServerAuth)},
+		ClientAuth:   tls.RequireAndVerifyClientCert,
+		ClientCAs:    ca.pool,
+	}, router)
+
+	client := NewClient(NewBinaryMessageProtocol())
+	client.TLSConfig = &tls.Config{
+		RootCAs:      ca.pool,
+		Certificates: []tls.Certificate{ca.issue(t, "worker-1", x509.ExtKeyUsageClientAuth)},
+	}
+	if err := client.Start(context.Background(), host, port); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	defer client.Close()
+
+	if got := client.PeerCertificate(); got == nil || got.Subject.CommonName != "127.0.0.1" {
+		t.Errorf("PeerCertificate() = %v, want the server certificate", got)
+	}
+
+	client.SendMessage(Message{Command: "whoami"})
+	select {
+	case identity := <-identities:
+		if identity != "worker-1" {
+			t.Errorf("handler saw identity %q, want worker-1", identity)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("handler was not called")
+	}
+}
+
+func TestTLS_UntrustedServer(t *testing.T) {
+	ca := newTestCA(t)
+	host, port, _ := startTLSServer(t, &tls.Config{
+		Certificates: []tls.Certificate{ca.issue(t, "127.0.0.1", x509.ExtKeyUsageServerAuth)},
+	}, NewRouter())
+
+	client := NewClient(NewBinaryMessageProtocol())
+	client.TLSConfig = &tls.Config{RootCAs: newTestCA(t).pool}
+	err := client.Start(context.Background(), host, port)
+
+	var tlsErr *TLSError
+	if !errors.As(err, &tlsErr) {
+		t.Fatalf("Start() error = %v, want *TLSError", err)
+	}
+	var connErr *ConnError
+	if errors.As(err, &connErr) {
+		t.Errorf("Start() error = %v is also a *ConnError", err)
+	}
+	var verifyErr *tls.CertificateVerificationError
+	if !errors.As(err, &verifyErr) {
+		t.Errorf("Start() error = %v, want it to wrap *tls.CertificateVerificationError", err)
+	}
+}
+
+func TestTLS_WrongServerName(t *testing.T) {
+	ca := newTestCA(t)
+	host, port, _ := startTLSServer(t, &tls.Config{
+		Certificates: []tls.Certificate{ca.issue(t, "127.0.0.1", x509.ExtKeyUsageServerAuth)},
+	}, NewRouter())
+
+	client := NewClient(NewBinaryMessageProtocol())
+	client.TLSConfig = &tls.Config{RootCAs: ca.pool, ServerName: "relay.example.com"}
+	err := client.Start(context.Background(), host, port)
+
+	var hostErr x509.HostnameError
+	if !errors.As(err, &hostErr) {
+		t.Errorf("Start() error = %v, want x509.HostnameError", err)
+	}
+}
+
+func TestTLS_MissingClientCertificate(t *testing.T) {
+	ca := newTestCA(t)
+	host, port, disconnects := startTLSServer(t, &tls.Config{
+		Certificates: []tls.Certificate{ca.issue(t, "127.0.0.1", x509.ExtKeyUsageServerAuth)},
+		ClientAuth:   tls.RequireAndVerifyClientCert,
+		ClientCAs:    ca.pool,
+	}, NewRouter())
+
+	client := NewClient(NewBinaryMessageProtocol())
+	client.TLSConfig = &tls.Config{RootCAs: ca.pool}
+	// With TLS 1.3 the client finishes its side of the handshake before
+	// the server rejects it, so the failure shows up on the server.
+	client.Start(context.Background(), host, port)
+	defer client.Close()
+
+	select {
+	case err := <-disconnects:
+		var tlsErr *TLSError
+		if !errors.As(err, &tlsErr) {
+			t.Errorf("OnDisconnect error = %v, want *TLSError", err)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("server did not drop the connection")
+	}
+}
+
+func TestTLS_DroppedConnection(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	defer l.Close()
+	go func() {
+		conn, err := l.Accept()
+		if err == nil {
+			conn.Close()
+		}
+	}()
+	host, port, _ := net.SplitHostPort(l.Addr().String())
+
+	client := NewClient(NewBinaryMessageProtocol())
+	client.TLSConfig = &tls.Config{RootCAs: newTestCA(t).pool}
+	err = client.Start(context.Background(), host, port)
+	var tlsErr *TLSError
+	if err == nil || errors.As(err, &tlsErr) {
+		t.Errorf("Start() error = %v, want a failure that is not a *TLSError", err)
+	}
+
+	ca := newTestCA(t)
+	host, port, disconnects := startTLSServer(t, &tls.Config{
+		Certificates: []tls.Certificate{ca.issue(t, "127.0.0.1", x509.ExtKeyUsageServerAuth)},
+		ClientAuth:   tls.RequireAndVerifyClientCert,
+		ClientCAs:    ca.pool,
+	}, NewRouter())
+	conn, err := net.Dial("tcp", net.JoinHostPort(host, port))
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	conn.Close()
+	select {
+	case err := <-disconnects:
+		if errors.As(err, &tlsErr) {
+			t.Errorf("OnDisconnect error = %v, want no *TLSError for a dropped connection", err)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("server did not drop the connection")
+	}
+}
+
+func TestTLS_VersionMismatch(t *testing.T) {
+	ca := newTestCA(t)
+	host, port, _ := startTLSServer(t, &tls.Config{
+		Certificates: []tls.Certificate{ca.issue(t, "127.0.0.1", x509.ExtKeyUsageServerAuth)},
+		MinVersion:   tls.VersionTLS13,
+	}, NewRouter())
+
+	// The server answers with a protocol_version alert, which says nothing
+	// about certificates.
+	client := NewClient(NewBinaryMessageProtocol())
+	client.TLSConfig = &tls.Config{RootCAs: ca.pool, MaxVersion: tls.VersionTLS12}
+	err := client.Start(context.Background(), host, port)
+	var tlsErr *TLSError
+	if err == nil || errors.As(err, &tlsErr) {
+		t.Errorf("Start() error = %v, want a failure that is not a *TLSError", err)
+	}
+}
+
+func TestTLS_ClientCertificateAlert(t *testing.T) {
+	ca := newTestCA(t)
+	host, port, _ := startTLSServer(t, &tls.Config{
+		Certificates: []tls.Certificate{ca.issue(t, "127.0.0.1", x509.ExtKeyUsageServerAuth)},
+		ClientAuth:   tls.RequireAndVerifyClientCert,
+		ClientCAs:    ca.pool,
+	}, NewRouter())
+
+	// With TLS 1.2 the server rejects the client before the client's
+	// handshake finishes, so the client sees the server's bad_certificate
+	// alert for a certificate from a CA it does not trust.
+	client := NewClient(NewBinaryMessageProtocol())
+	client.TLSConfig = &tls.Config{
+		Certificates: []tls.Certificate{newTestCA(t).issue(t, "client", x509.ExtKeyUsageClientAuth)},
+		RootCAs:      ca.pool,
+		MaxVersion:   tls.VersionTLS12,
+	}
+	err := client.Start(context.Background(), host, port)
+	var tlsErr *TLSError
+	if !errors.As(err, &tlsErr) {
+		t.Errorf("Start() error = %v, want *TLSError", err)
+	}
+}
@@ -0,0 +1,497 @@
+package portrelay
+
+import (
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// ErrValueType is wrapped by the errors of the typed accessors when a value
+// cannot be converted to the requested type.
+var ErrValueType = errors.New("portrelay: wrong value type")
+
+// Kind is the type of a Value.
+type Kind int
+
+const (
+	KindBulk Kind = iota
+	KindInt
+	KindFloat
+	KindBool
+	KindNull
+	KindArray
+	KindMap
+	KindSimple
+	KindError
+)
+
+func (k Kind) String() string {
+	switch k {
+	case KindBulk:
+		return "bulk"
+	case KindInt:
+		return "integer"
+	case KindFloat:
+		return "float"
+	case KindBool:
+		return "boolean"
+	case KindNull:
+		return "null"
+	case KindArray:
+		return "array"
+	case KindMap:
+		return "map"
+	case KindSimple:
+		return "simple string"
+	case KindError:
+		return "error"
+	}
+	return fmt.Sprintf("Kind(%d)", int(k))
+}
+
+// FORMAT
+// Typed values replace "$<length>\n<data>\n" for an argument after the command:
+//
+//	":<integer>\n"          integer
+//	",<float>\n"            float
+//	"#t\n" or "#f\n"        boolean
+//	"_\n"                   null
+//	"*<n>\n" + n values     array
+//	"%<n>\n" + 2n values    map, as key value pairs
+//	"+<text>\n"             simple string
+//	"-<text>\n"             error
+//
+// Frames made only of bulk arguments are unchanged, so peers that do not
+// know typed values can still read them.
+//
+// Value is a typed argument. Only the field matching Kind is used; Str holds
+// bulk strings, simple strings and errors. The zero Value is an empty bulk
+// string.
+type Value struct {
+	Kind  Kind
+	Str   string
+	Int   int64
+	Float float64
+	Bool  bool
+	Array []Value
+	Map   []Pair
+}
+
+// Pair is an entry of a map Value. Keys may be of any kind.
+type Pair struct {
+	Key   Value
+	Value Value
+}
+
+func BulkValue(s string) Value {
+	return Value{Kind: KindBulk, Str: s}
+}
+
+func BytesValue(b []byte) Value {
+	return Value{Kind: KindBulk, Str: string(b)}
+}
+
+// SimpleValue returns a simple string, a status such as "OK". It cannot
+// contain line breaks.
+func SimpleValue(s string) Value {
+	return Value{Kind: KindSimple, Str: s}
+}
+
+// ErrorValue returns an error value with the message text. It cannot
+// contain line breaks.
+func ErrorValue(text string) Value {
+	return Value{Kind: KindError, Str: text}
+}
+
+func IntValue(n int64) Value {
+	return Value{Kind: KindInt, Int: n}
+}
+
+func FloatValue(f float64) Value {
+	return Value{Kind: KindFloat, Float: f}
+}
+
+func BoolValue(b bool) Value {
+	return Value{Kind: KindBool, Bool: b}
+}
+
+func NullValue() Value {
+	return Value{Kind: KindNull}
+}
+
+func ArrayValue(values ...Value) Value {
+	return Value{Kind: KindArray, Array: values}
+}
+
+func MapValue(pairs ...Pair) Value {
+	return Value{Kind: KindMap, Map: pairs}
+}
+
+// String returns the text form of v, which is what Message.Arguments holds
+// for typed arguments. Null is the empty string.
+func (v Value) String() string {
+	switch v.Kind {
+	case KindInt:
+		return strconv.FormatInt(v.Int, 10)
+	case KindFloat:
+		return strconv.FormatFloat(v.Float, 'g', -1, 64)
+	case KindBool:
+		return strconv.FormatBool(v.Bool)
+	case KindNull:
+		return ""
+	case KindArray:
+		parts := make([]string, len(v.Array))
+		for i, elem := range v.Array {
+			parts[i] = elem.String()
+		}
+		return "[" + strings.Join(parts, " ") + "]"
+	case KindMap:
+		parts := make([]string, len(v.Map))
+		for i, pair := range v.Map {
+			parts[i] = pair.Key.String() + ":" + pair.Value.String()
+		}
+		return "map[" + strings.Join(parts, " ") + "]"
+	}
+	return v.Str
+}
+
+// AsInt returns v as an integer. Bulk values are parsed, so handlers work
+// with peers that send numbers as text.
+func (v Value) AsInt() (int64, error) {
+	switch v.Kind {
+	case KindInt:
+		return v.Int, nil
+	case KindBulk, KindSimple:
+		n, err := strconv.ParseInt(v.Str, 10, 64)
+		if err != nil {
+			return 0, fmt.Errorf("%w: %q is not an integer", ErrValueType, v.Str)
+		}
+		return n, nil
+	}
+	return 0, fmt.Errorf("%w: %s is not an integer", ErrValueType, v.Kind)
+}
+
+// AsFloat returns v as a float. Integers are converted and bulk values are parsed.
+func (v Value) AsFloat() (float64, error) {
+	switch v.Kind {
+	case KindFloat:
+		return v.Float, nil
+	case KindInt:
+		return float64(v.Int), nil
+	case KindBulk, KindSimple:
+		f, err := strconv.ParseFloat(v.Str, 64)
+		if err != nil {
+			return 0, fmt.Errorf("%w: %q is not a float", ErrValueType, v.Str)
+		}
+		return f, nil
+	}
+	return 0, fmt.Errorf("%w: %s is not a float", ErrValueType, v.Kind)
+}
+
+// AsBool returns v as a boolean. Bulk values are parsed with strconv.ParseBool.
+func (v Value) AsBool() (bool, error) {
+	switch v.Kind {
+	case KindBool:
+		return v.Bool, nil
+	case KindBulk, KindSimple:
+		b, err := strconv.ParseBool(v.Str)
+		if err != nil {
+			return false, fmt.Errorf("%w: %q is not a boolean", ErrValueType, v.Str)
+		}
+		return b, nil
+	}
+	return false, fmt.Errorf("%w: %s is not a boolean", ErrValueType, v.Kind)
+}
+
+// Err returns v as an error when it is an error value, and nil otherwise.
+func (v Value) Err() error {
+	if v.Kind != KindError {
+		return nil
+	}
+	return errors.New(v.Str)
+}
+
+// IsNull reports whether v is null.
+func (v Value) IsNull() bool {
+	return v.Kind == KindNull
+}
+
+// NewValueMessage returns a message with values as its typed arguments.
+func NewValueMessage(command string, values ...Value) Message {
+	msg := Message{Command: command}
+	for _, v := range values {
+		msg.AddValue(v)
+	}
+	return msg
+}
+
+// ArgValue returns argument i as a Value. Plain string arguments are bulk
+// values. It returns null when there is no such argument.
+func (m Message) ArgValue(i int) Value {
+	if i < 0 || i >= m.argCount() {
+		return NullValue()
+	}
+	if m.Values != nil {
+		return m.Values[i]
+	}
+	return BulkValue(m.Arguments[i])
+}
+
+func (m Message) ArgInt(i int) (int64, error) {
+	if err := m.checkArg(i); err != nil {
+		return 0, err
+	}
+	return m.ArgValue(i).AsInt()
+}
+
+func (m Message) ArgFloat(i int) (float64, error) {
+	if err := m.checkArg(i); err != nil {
+		return 0, err
+	}
+	return m.ArgValue(i).AsFloat()
+}
+
+func (m Message) ArgBool(i int) (bool, error) {
+	if err := m.checkArg(i); err != nil {
+		return false, err
+	}
+	return m.ArgValue(i).AsBool()
+}
+
+// argCount returns the number of arguments, not counting the command.
+func (m Message) argCount() int {
+	if m.Values != nil {
+		return len(m.Values)
+	}
+	return len(m.Arguments)
+}
+
+func (m Message) checkArg(i int) error {
+	n := m.argCount()
+	if i < 0 || i >= n {
+		return fmt.Errorf("portrelay: argument %d of %d does not exist", i, n)
+	}
+	return nil
+}
+
+// AddValue appends v to the arguments, keeping Values and Arguments in step.
+func (m *Message) AddValue(v Value) {
+	if m.Values == nil {
+		m.Values = make([]Value, len(m.Arguments), len(m.Arguments)+1)
+		for i, arg := range m.Arguments {
+			m.Values[i] = BulkValue(arg)
+		}
+	}
+	m.Values = append(m.Values, v)
+	m.Arguments = append(m.Arguments, v.String())
+}
+
+func appendValue(dst []byte, v Value) []byte {
+	switch v.Kind {
+	case KindInt:
+		dst = append(dst, ':')
+		dst = strconv.AppendInt(dst, v.Int, 10)
+		return append(dst, '\n')
+	case KindFloat:
+		dst = append(dst, ',')
+		dst = strconv.AppendFloat(dst, v.Float, 'g', -1, 64)
+		return append(dst, '\n')
+	case KindBool:
+		if v.Bool {
+			return append(dst, "#t\n"...)
+		}
+		return append(dst, "#f\n"...)
+	case KindNull:
+		return append(dst, "_\n"...)
+	case KindSimple:
+		dst = append(dst, '+')
+		dst = append(dst, v.Str...)
+		return append(dst, '\n')
+	case KindError:
+		dst = append(dst, '-')
+		dst = append(dst, v.Str...)
+		return append(dst, '\n')
+	case KindArray:
+		dst = append(dst, '*')
+		dst = strconv.AppendInt(dst, int64(len(v.Array)), 10)
+		dst = append(dst, '\n')
+		for _, elem := range v.Array {
+			dst = appendValue(dst, elem)
+		}
+		return dst
+	case KindMap:
+		dst = append(dst, '%')
+		dst = strconv.AppendInt(dst, int64(len(v.Map)), 10)
+		dst = append(dst, '\n')
+		for _, pair := range v.Map {
+			dst = appendValue(dst, pair.Key)
+			dst = appendValue(dst, pair.Value)
+		}
+		return dst
+	}
+	return appendArgument(dst, v.Str)
+}
+
+// checkValue validates v, argument index of a message, against limits
+// before it is encoded.
+func checkValue(v Value, index int, depth int, limits DecodeLimits) error {
+	switch v.Kind {
+	case KindBulk:
+		if limits.MaxArgSize > 0 && len(v.Str) > limits.MaxArgSize {
+			return encodeExceeded(index, "argument of %d bytes exceeds %d", len(v.Str), limits.MaxArgSize)
+		}
+	case KindInt, KindFloat, KindBool, KindNull:
+	case KindSimple, KindError:
+		if strings.ContainsAny(v.Str, "\r\n") {
+			return &EncodeError{
+				Stage:   "validate value",
+				Index:   index,
+				Details: fmt.Sprintf("%s contains a line break", v.Kind),
+				Err:     ErrValueType,
+			}
+		}
+		if limits.MaxLineLength > 0 && len(v.Str)+2 > limits.MaxLineLength {
+			return encodeExceeded(index, "%s longer than %d bytes", v.Kind, limits.MaxLineLength)
+		}
+	case KindArray, KindMap:
+		if limits.MaxDepth > 0 && depth > limits.MaxDepth {
+			return encodeExceeded(index, "values nested deeper than %d", limits.MaxDepth)
+		}
+		n := len(v.Array) + len(v.Map)
+		if limits.MaxArgs > 0 && n > limits.MaxArgs {
+			return encodeExceeded(index, "%d elements exceed %d", n, limits.MaxArgs)
+		}
+		for _, elem := range v.Array {
+			if err := checkValue(elem, index, depth+1, limits); err != nil {
+				return err
+			}
+		}
+		for _, pair := range v.Map {
+			if err := checkValue(pair.Key, index, depth+1, limits); err != nil {
+				return err
+			}
+			if err := checkValue(pair.Value, index, depth+1, limits); err != nil {
+				return err
+			}
+		}
+	default:
+		return &EncodeError{
+			Stage:   "validate value",
+			Index:   index,
+			Details: fmt.Sprintf("unknown kind %d", int(v.Kind)),
+			Err:     ErrValueType,
+		}
+	}
+	return nil
+}
+
+// nested returns the number of elements of v at any depth, counting both
+// the key and the value of a map entry.
+func (v Value) nested() int {
+	n := len(v.Array) + 2*len(v.Map)
+	for _, elem := range v.Array {
+		n += elem.nested()
+	}
+	for _, pair := range v.Map {
+		n += pair.Key.nested() + pair.Value.nested()
+	}
+	return n
+}
+
+// readValue decodes the rest of the value whose first line is line. index
+// is the argument the value belongs to, depth its nesting level.
+func (r *frameReader) readValue(index int, line string, depth int) (Value, error) {
+	text := strings.TrimSuffix(line[1:], "\n")
+	invalid := func(stage string, err error) error {
+		return &DecodeError{
+			Stage:   stage,
+			Index:   index,
+			Details: fmt.Sprintf("invalid line: %q", strings.TrimSpace(line)),
+			Err:     err,
+		}
+	}
+
+	switch line[0] {
+	case '$':
+		data, err := r.readBulk(index, line)
+		if err != nil {
+			return Value{}, err
+		}
+		return BulkValue(data), nil
+	case ':':
+		n, err := strconv.ParseInt(text, 10, 64)
+		if err != nil {
+			return Value{}, invalid("parse integer", err)
+		}
+		return IntValue(n), nil
+	case ',':
+		f, err := strconv.ParseFloat(text, 64)
+		if err != nil {
+			return Value{}, invalid("parse float", err)
+		}
+		return FloatValue(f), nil
+	case '#':
+		if text != "t" && text != "f" {
+			return Value{}, invalid("parse boolean", errors.New("invalid format"))
+		}
+		return BoolValue(text == "t"), nil
+	case '_':
+		if text != "" {
+			return Value{}, invalid("parse null", errors.New("invalid format"))
+		}
+		return NullValue(), nil
+	case '+':
+		return SimpleValue(text), nil
+	case '-':
+		return ErrorValue(text), nil
+	case '*', '%':
+		n, err := strconv.Atoi(text)
+		if err != nil || n < 0 {
+			if err == nil {
+				err = errors.New("invalid format")
+			}
+			return Value{}, invalid("parse aggregate length", err)
+		}
+		if r.limits.MaxDepth > 0 && depth > r.limits.MaxDepth {
+			return Value{}, exceeded(index, "values nested deeper than %d", r.limits.MaxDepth)
+		}
+		if r.limits.MaxArgs > 0 && n > r.limits.MaxArgs {
+			return Value{}, exceeded(index, "%d elements exceed %d", n, r.limits.MaxArgs)
+		}
+
+		elems := n
+		if line[0] == '%' {
+			elems = 2 * n
+		}
+		if err := r.addValues(index, elems); err != nil {
+			return Value{}, err
+		}
+		// The slice grows as elements arrive rather than as declared.
+		var values []Value
+		for range elems {
+			next, err := r.readLine("read value line", index, "could not read nested value")
+			if err != nil {
+				return Value{}, err
+			}
+			v, err := r.readValue(index, next, depth+1)
+			if err != nil {
+				return Value{}, err
+			}
+			values = append(values, v)
+		}
+
+		if line[0] == '*' {
+			return ArrayValue(values...), nil
+		}
+		var pairs []Pair
+		if n > 0 {
+			pairs = make([]Pair, n)
+		}
+		for i := range pairs {
+			pairs[i] = Pair{Key: values[2*i], Value: values[2*i+1]}
+		}
+		return MapValue(pairs...), nil
+	}
+	return Value{}, invalid("parse value type", errors.New("invalid format"))
+}
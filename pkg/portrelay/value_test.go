@@ -0,0 +1,205 @@
+package portrelay
+
+import (
+	"errors"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestValue_RoundTrip(t *testing.T) {
+	msg := NewValueMessage("set",
+		BulkValue("key"),
+		IntValue(-42),
+		FloatValue(0.25),
+		BoolValue(false),
+		NullValue(),
+		ArrayValue(IntValue(1), BulkValue("two"), ArrayValue()),
+		MapValue(Pair{Key: BulkValue("ttl"), Value: IntValue(60)}),
+	)
+
+	p := NewBinaryMessageProtocol()
+	got, err := p.DecodeBytes(p.Encode(msg))
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if !reflect.DeepEqual(got.Values, msg.Values) {
+		t.Errorf("Values got = %v, want %v", got.Values, msg.Values)
+	}
+	wantArgs := []string{"key", "-42", "0.25", "false", "", "[1 two []]", "map[ttl:60]"}
+	if !reflect.DeepEqual(got.Arguments, wantArgs) {
+		t.Errorf("Arguments got = %q, want %q", got.Arguments, wantArgs)
+	}
+}
+
+func TestValue_PlainFramesHaveNoValues(t *testing.T) {
+	p := NewBinaryMessageProtocol()
+	msg, err := p.DecodeString("*3\n$3\nadd\n$1\n1\n$1\n2\n")
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if msg.Values != nil {
+		t.Errorf("Values = %v, want nil", msg.Values)
+	}
+
+	// Text arguments still work with the typed accessors.
+	if n, err := msg.ArgInt(1); err != nil || n != 2 {
+		t.Errorf("ArgInt(1) = %d, %v, want 2", n, err)
+	}
+}
+
+func TestValue_MixedFrame(t *testing.T) {
+	p := NewBinaryMessageProtocol()
+	msg, err := p.DecodeString("*4\n$3\nset\n$3\nkey\n:5\n$2\nex\n")
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	want := []Value{BulkValue("key"), IntValue(5), BulkValue("ex")}
+	if !reflect.DeepEqual(msg.Values, want) {
+		t.Errorf("Values got = %v, want %v", msg.Values, want)
+	}
+	if got := string(p.Encode(*msg)); got != "*4\n$3\nset\n$3\nkey\n:5\n$2\nex\n" {
+		t.Errorf("Encode() = %q", got)
+	}
+}
+
+func TestMessage_TypedAccessors(t *testing.T) {
+	msg := NewValueMessage("x", IntValue(7), FloatValue(1.5), BoolValue(true), BulkValue("2.5"), NullValue())
+
+	if n, err := msg.ArgInt(0); err != nil || n != 7 {
+		t.Errorf("ArgInt(0) = %d, %v, want 7", n, err)
+	}
+	if f, err := msg.ArgFloat(1); err != nil || f != 1.5 {
+		t.Errorf("ArgFloat(1) = %v, %v, want 1.5", f, err)
+	}
+	if f, err := msg.ArgFloat(0); err != nil || f != 7 {
+		t.Errorf("ArgFloat(0) = %v, %v, want 7", f, err)
+	}
+	if b, err := msg.ArgBool(2); err != nil || !b {
+		t.Errorf("ArgBool(2) = %v, %v, want true", b, err)
+	}
+	if f, err := msg.ArgFloat(3); err != nil || f != 2.5 {
+		t.Errorf("ArgFloat(3) = %v, %v, want 2.5", f, err)
+	}
+	if !msg.ArgValue(4).IsNull() {
+		t.Errorf("ArgValue(4) = %v, want null", msg.ArgValue(4))
+	}
+
+	if _, err := msg.ArgInt(2); !errors.Is(err, ErrValueType) {
+		t.Errorf("ArgInt(2) error = %v, want %v", err, ErrValueType)
+	}
+	if _, err := msg.ArgInt(3); !errors.Is(err, ErrValueType) {
+		t.Errorf("ArgInt(3) error = %v, want %v", err, ErrValueType)
+	}
+	if _, err := msg.ArgInt(5); err == nil {
+		t.Errorf("ArgInt(5) error = nil, want an error")
+	}
+}
+
+func TestMessage_AddValueKeepsArguments(t *testing.T) {
+	msg := Message{Command: "x", Arguments: []string{"a"}}
+	msg.AddValue(IntValue(1))
+
+	if !reflect.DeepEqual(msg.Arguments, []string{"a", "1"}) {
+		t.Errorf("Arguments = %q", msg.Arguments)
+	}
+	if !reflect.DeepEqual(msg.Values, []Value{BulkValue("a"), IntValue(1)}) {
+		t.Errorf("Values = %v", msg.Values)
+	}
+}
+
+func TestValue_Limits(t *testing.T) {
+	p := &BinaryMessageProtocol{Limits: DecodeLimits{MaxArgs: 3, MaxArgSize: 4, MaxDepth: 2}}
+
+	tests := []struct {
+		name  string
+		input string
+		value Value
+	}{
+		{name: "Too deep", input: "*2\n$1\nx\n*1\n*1\n*0\n", value: ArrayValue(ArrayValue(ArrayValue()))},
+		{name: "Too many elements", input: "*2\n$1\nx\n*4\n", value: ArrayValue(IntValue(1), IntValue(2), IntValue(3), IntValue(4))},
+		{name: "Nested bulk too large", input: "*2\n$1\nx\n%1\n$5\n12345\n", value: MapValue(Pair{Key: BulkValue("12345"), Value: NullValue()})},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := p.DecodeString(tt.input)
+			var decodeErr *DecodeError
+			if !errors.As(err, &decodeErr) || !errors.Is(err, ErrLimitExceeded) || decodeErr.Index != 1 {
+				t.Errorf("Decode() error = %v, want a limit error at argument 1", err)
+			}
+
+			_, err = p.AppendEncode(nil, NewValueMessage("x", tt.value))
+			var encodeErr *EncodeError
+			if !errors.As(err, &encodeErr) || !errors.Is(err, ErrLimitExceeded) || encodeErr.Index != 1 {
+				t.Errorf("AppendEncode() error = %v, want a limit error at argument 1", err)
+			}
+		})
+	}
+}
+
+func TestValue_MaxValues(t *testing.T) {
+	p := &BinaryMessageProtocol{Limits: DecodeLimits{MaxValues: 4}}
+	three := ArrayValue(IntValue(1), IntValue(2), IntValue(3))
+	if _, err := p.AppendEncode(nil, NewValueMessage("x", three, three)); !errors.Is(err, ErrLimitExceeded) {
+		t.Errorf("AppendEncode() error = %v, want %v", err, ErrLimitExceeded)
+	}
+	if _, err := p.DecodeString("*3\n$1\nx\n*3\n:1\n:2\n:3\n*3\n:1\n:2\n:3\n"); !errors.Is(err, ErrLimitExceeded) {
+		t.Errorf("Decode() error = %v, want %v", err, ErrLimitExceeded)
+	}
+
+	// A frame of a million booleans is well within the default frame size.
+	frame := "*2\n$1\nx\n*1024\n" + strings.Repeat("*1024\n"+strings.Repeat("#t\n", 1024), 1024)
+	_, err := NewBinaryMessageProtocol().DecodeString(frame)
+	var decodeErr *DecodeError
+	if !errors.As(err, &decodeErr) || !errors.Is(err, ErrLimitExceeded) {
+		t.Errorf("Decode() error = %v, want a limit error", err)
+	}
+}
+
+func TestValue_DecodeErrors(t *testing.T) {
+	tests := []struct {
+		name      string
+		input     string
+		wantStage string
+	}{
+		{name: "Invalid integer", input: "*2\n$1\nx\n:1.5\n", wantStage: "parse integer"},
+		{name: "Invalid float", input: "*2\n$1\nx\n,abc\n", wantStage: "parse float"},
+		{name: "Invalid boolean", input: "*2\n$1\nx\n#true\n", wantStage: "parse boolean"},
+		{name: "Invalid null", input: "*2\n$1\nx\n_0\n", wantStage: "parse null"},
+		{name: "Negative array length", input: "*2\n$1\nx\n*-1\n", wantStage: "parse aggregate length"},
+		{name: "Unknown type", input: "*2\n$1\nx\n?\n", wantStage: "parse value type"},
+		{name: "Typed command", input: "*1\n:1\n", wantStage: "parse argument length"},
+	}
+
+	p := NewBinaryMessageProtocol()
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := p.DecodeString(tt.input)
+			var decodeErr *DecodeError
+			if !errors.As(err, &decodeErr) || decodeErr.Stage != tt.wantStage {
+				t.Errorf("Decode() error = %v, want stage %q", err, tt.wantStage)
+			}
+		})
+	}
+}
+
+func TestValue_Signed(t *testing.T) {
+	p := &BinaryMessageProtocol{Signer: newTestSigner(t, "k1", []byte("secret"))}
+	msg := NewValueMessage("x", FloatValue(0.1), MapValue(Pair{Key: IntValue(1), Value: BoolValue(true)}))
+
+	got, err := p.DecodeBytes(p.Encode(msg))
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if !reflect.DeepEqual(got.Values, msg.Values) {
+		t.Errorf("Values got = %v, want %v", got.Values, msg.Values)
+	}
+}
+
+func TestJSONLines_RejectsValues(t *testing.T) {
+	_, err := NewJSONLinesProtocol().AppendEncode(nil, NewValueMessage("x", IntValue(1)))
+	if !errors.Is(err, ErrValueType) {
+		t.Errorf("AppendEncode() error = %v, want %v", err, ErrValueType)
+	}
+}